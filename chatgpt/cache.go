@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cacheDirName = "cache"
+	// Largest size of the cache unless cache_size is set
+	cacheSize = "500MB"
+)
+
+// A Cache keeps api responses in files named by the hash of their request,
+// so asking for the same thing again does not call the api. When the files
+// grow over maxSize the least recently used ones are removed.
+type Cache struct {
+	dir     string
+	maxSize int64
+	chatTTL time.Duration // how long answers are kept, 0 does not cache answers
+	mu      sync.Mutex
+	size    int64 // bytes of all files, -1 until they are counted
+}
+
+// The cache of the run, nil when caching is off. It is set in main.
+var cache *Cache
+
+func OpenCache(dir string, maxSize int64, chatTTL time.Duration) *Cache {
+	return &Cache{dir: dir, maxSize: maxSize, chatTTL: chatTTL, size: -1}
+}
+
+// The cache in the data directory with the size and ttl of the config,
+// nil if cache_size is 0
+func openConfiguredCache() (*Cache, error) {
+	// Both are checked by validate
+	size, _ := parseSize(config.CacheSize)
+	var ttl time.Duration
+	if config.ChatCacheTTL != "" {
+		ttl, _ = parseAge(config.ChatCacheTTL)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	dir, err := getDataPath(cacheDirName)
+	if err != nil {
+		return nil, err
+	}
+	return OpenCache(dir, size, ttl), nil
+}
+
+// Vector of an input, saved with the model the api said produced it
+type cachedEmbedding struct {
+	Model  string
+	Vector []float32 // the index keeps float32 as well
+}
+
+// An answer and when it was received, for the ttl
+type cachedAnswer struct {
+	Created  time.Time
+	Response GptResponse
+}
+
+// Hash of the parts of a request
+func cacheKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Files are spread over folders by the first two characters of the key
+func (c *Cache) path(kind string, key string) string {
+	return filepath.Join(c.dir, kind, key[:2], key)
+}
+
+// Read the entry into value. A hit counts as a use, so it is evicted last.
+func (c *Cache) Get(kind string, key string, value interface{}) bool {
+	if c == nil {
+		return false
+	}
+	path := c.path(kind, key)
+	content, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(content, value) != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return true
+}
+
+// Save the entry and evict old entries if the cache grew too large
+func (c *Cache) Put(kind string, key string, value interface{}) error {
+	if c == nil {
+		return nil
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size < 0 {
+		c.size = 0
+		for _, file := range c.files() {
+			c.size += file.size
+		}
+	}
+	path := c.path(kind, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache folder: %w", err)
+	}
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	// Written to a temporary file first, so readers never see half an entry
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0644); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	c.size += int64(len(content)) - previous
+	if c.size > c.maxSize {
+		c.evict()
+	}
+	return nil
+}
+
+// Remove an entry, for example an answer that is too old
+func (c *Cache) Remove(kind string, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.path(kind, key)
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil && c.size >= 0 {
+		c.size -= info.Size()
+	}
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Every entry of the cache
+func (c *Cache) files() []cacheFile {
+	var files []cacheFile
+	filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, cacheFile{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	return files
+}
+
+// Remove the least recently used entries until the cache is a tenth below
+// its limit, so the next entries do not evict again right away
+func (c *Cache) evict() {
+	files := c.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		if c.size <= c.maxSize-c.maxSize/10 {
+			break
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		c.size -= file.size
+	}
+}
+
+// Key of the embedding of input, empty if the model of the embedder is not known.
+// The hashing embedder is faster than the cache and is not cached, and a dry
+// run has no vectors to cache.
+func embeddingCacheKey(input string) string {
+	model := embedModel()
+	switch activeEmbedder().(type) {
+	case *HashingEmbedder, *dryRunEmbedder:
+		return ""
+	}
+	if model == "" {
+		return ""
+	}
+	return cacheKey(model, input)
+}
+
+// Key of a chat request, empty if answers are not cached. The whole body is
+// hashed, since the model, temperature and max_tokens change the answer.
+func chatCacheKey(messages []Message) string {
+	p, ok := provider.(*OpenAIProvider)
+	if !ok || cache == nil || cache.chatTTL == 0 {
+		return ""
+	}
+	body, err := json.Marshal(p.chatBody(messages))
+	if err != nil {
+		return ""
+	}
+	return cacheKey(string(body))
+}
+
+// The cached answer to the messages if it is younger than the ttl
+func cachedChat(key string) (GptResponse, bool) {
+	var entry cachedAnswer
+	if key == "" || !cache.Get("chat", key, &entry) {
+		return GptResponse{}, false
+	}
+	if time.Since(entry.Created) > cache.chatTTL {
+		cache.Remove("chat", key)
+		return GptResponse{}, false
+	}
+	return entry.Response, true
+}
+
+func saveChat(key string, response GptResponse) {
+	if key == "" {
+		return
+	}
+	if err := cache.Put("chat", key, cachedAnswer{time.Now(), response}); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+}
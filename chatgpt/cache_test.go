@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Server that embeds every input as its length and answers every question the same way.
+// It records how many inputs and questions it was sent.
+func cachingServer(t *testing.T, inputs *[]string, questions *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chat/completions" {
+			*questions++
+			fmt.Fprint(w, `{"model": "test-chat", "choices": [{"message": {"role": "assistant", "content": "cached answer"}}]}`)
+			return
+		}
+		var body struct{ Input []string }
+		json.NewDecoder(r.Body).Decode(&body)
+		*inputs = append(*inputs, body.Input...)
+		response := EmbeddingResponse{Model: "test-embed-v2"}
+		for i, input := range body.Input {
+			response.Data = append(response.Data, EmbeddingData{Index: i, Embedding: []float64{float64(len(input)), 1}})
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func useCache(t *testing.T, c *Cache, p Provider) {
+	previousCache, previousProvider := cache, provider
+	cache, provider = c, p
+	t.Cleanup(func() { cache, provider = previousCache, previousProvider })
+}
+
+func TestCallEmbeddingsOnlySendsInputsThatAreNotCached(t *testing.T) {
+	var inputs []string
+	server := cachingServer(t, &inputs, new(int))
+	useCache(t, OpenCache(t.TempDir(), 1<<20, 0), &OpenAIProvider{BaseURL: server.URL, EmbedModel: "test-embed"})
+	if _, err := CallEmbeddings([]string{"a", "bb"}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := CallEmbeddings([]string{"bb", "ccc", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 3 || inputs[2] != "ccc" {
+		t.Fatalf("expected only ccc to be sent again, sent %v", inputs)
+	}
+	for i, length := range []float64{2, 3, 1} {
+		if response.Data[i].Embedding[0] != length {
+			t.Fatalf("unexpected embedding %v of input %v", response.Data[i].Embedding, i)
+		}
+	}
+	// The model the api named is kept, so collections can check it
+	if response.Model != "test-embed-v2" {
+		t.Fatalf("unexpected model %q", response.Model)
+	}
+	cache = nil
+	if _, err := CallEmbeddings([]string{"a"}); err != nil || len(inputs) != 4 {
+		t.Fatalf("expected the input to be sent without a cache, sent %v", inputs)
+	}
+}
+
+func TestDryRunDoesNotCacheEmbeddings(t *testing.T) {
+	useDataDir(t)
+	var inputs []string
+	server := cachingServer(t, &inputs, new(int))
+	useCache(t, OpenCache(t.TempDir(), 1<<20, 0), &OpenAIProvider{BaseURL: server.URL, EmbedModel: "test-embed"})
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("some notes"), 0644)
+	if err := StartEmbedding(dir, "", "", nil, WalkOptions{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartEmbedding(dir, "", "", nil, WalkOptions{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 1 {
+		t.Fatalf("expected the chunk to be sent after the dry run, sent %v", inputs)
+	}
+	index, err := LoadCollection("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Dim() != 2 {
+		t.Fatalf("expected vectors of 2 dimensions, got %v", index.Dim())
+	}
+}
+
+func TestCallChatgptCachesAnswersForTheTTL(t *testing.T) {
+	questions := 0
+	server := cachingServer(t, new([]string), &questions)
+	p := &OpenAIProvider{BaseURL: server.URL, ChatModel: "test-chat", MaxTokens: 100}
+	useCache(t, OpenCache(t.TempDir(), 1<<20, 0), p)
+	// Answers are only cached with a ttl
+	for i := 0; i < 2; i++ {
+		if _, err := CallChatgpt("question", "context"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if questions != 2 {
+		t.Fatalf("expected both questions to be sent without a ttl, sent %v", questions)
+	}
+	cache.chatTTL = time.Hour
+	for i := 0; i < 2; i++ {
+		response, err := CallChatgpt("question", "context")
+		if err != nil || response.Choices[0].Message.Content != "cached answer" {
+			t.Fatalf("unexpected answer %+v, %v", response, err)
+		}
+	}
+	if questions != 3 {
+		t.Fatalf("expected the second question to be answered from the cache, sent %v", questions)
+	}
+	// Another temperature is another request
+	temperature := 1.5
+	p.Temperature = &temperature
+	if _, err := CallChatgpt("question", "context"); err != nil || questions != 4 {
+		t.Fatalf("expected a new request for another temperature, sent %v, %v", questions, err)
+	}
+	cache.chatTTL = time.Nanosecond
+	if _, err := CallChatgpt("question", "context"); err != nil || questions != 5 {
+		t.Fatalf("expected an expired answer to be asked again, sent %v, %v", questions, err)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c := OpenCache(dir, 300, 0)
+	value := struct{ Text string }{fmt.Sprintf("%090d", 0)}
+	keys := []string{cacheKey("old"), cacheKey("used"), cacheKey("new")}
+	for i, key := range keys[:2] {
+		if err := c.Put("test", key, value); err != nil {
+			t.Fatal(err)
+		}
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(c.path("test", key), past, past)
+	}
+	// Reading an entry makes it the most recently used
+	if !c.Get("test", keys[0], &value) {
+		t.Fatal("expected a cached entry")
+	}
+	if err := c.Put("test", keys[2], value); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{keys[0]: true, keys[1]: false, keys[2]: true} {
+		if _, err := os.Stat(c.path("test", key)); (err == nil) != expected {
+			t.Fatalf("entry %v: expected kept %v", key, expected)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "test", "*", "*")); len(matches) != 2 {
+		t.Fatalf("expected 2 entries, got %v", len(matches))
+	}
+}
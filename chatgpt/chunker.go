@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Default token budget of a chunk, well below the input limit of embedding models
+	chunkTokens = 600
+	// Default number of tokens repeated from the end of the previous window
+	chunkTokenOverlap = 60
+)
+
+// A Chunk is a part of a file that is embedded on its own.
+// RowStart is the first line of the chunk counting from 0 and RowEnd the
+// line after the last one, so the chunk holds lines[RowStart:RowEnd].
+// Pieces of a single long line have the same rows.
+type Chunk struct {
+	RowStart int
+	RowEnd   int
+	Content  string
+}
+
+// A Chunker splits the content of a file into chunks
+type Chunker interface {
+	Chunk(content string) []Chunk
+}
+
+// Rough number of tokens of a text. OpenAI tokenizers average about
+// four characters per token for English text and code.
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// Return the chunker with the given name, or pick one by file type if the name is empty or auto
+func ChunkerFor(path string, name string) (Chunker, error) {
+	extension := strings.ToLower(filepath.Ext(path))
+	// Web pages and documents are reduced to markdown-like text
+	if isURL(path) {
+		extension = ".md"
+	}
+	switch extension {
+	case ".html", ".htm", ".xhtml", ".docx", ".epub", ".ipynb":
+		extension = ".md"
+	}
+	switch name {
+	case "", "auto":
+		switch extension {
+		case ".md", ".markdown":
+			return MarkdownChunker{MaxTokens: config.ChunkTokens}, nil
+		case ".go":
+			return GoChunker{MaxTokens: config.ChunkTokens}, nil
+		case ".py":
+			return PythonChunker{MaxTokens: config.ChunkTokens}, nil
+		case ".txt", ".pdf", ".rst", ".csv", ".tsv", ".json", ".jsonl", ".ndjson":
+			return ParagraphChunker{MaxTokens: config.ChunkTokens}, nil
+		}
+		return TokenChunker{MaxTokens: config.ChunkTokens, Overlap: config.ChunkTokenOverlap}, nil
+	case "lines":
+		return LineChunker{Size: config.ChunkSize, Overlap: config.ChunkOverlap}, nil
+	case "tokens":
+		return TokenChunker{MaxTokens: config.ChunkTokens, Overlap: config.ChunkTokenOverlap}, nil
+	case "markdown":
+		return MarkdownChunker{MaxTokens: config.ChunkTokens}, nil
+	case "paragraph":
+		return ParagraphChunker{MaxTokens: config.ChunkTokens}, nil
+	case "code":
+		switch extension {
+		case ".go":
+			return GoChunker{MaxTokens: config.ChunkTokens}, nil
+		case ".py":
+			return PythonChunker{MaxTokens: config.ChunkTokens}, nil
+		}
+		return TokenChunker{MaxTokens: config.ChunkTokens, Overlap: config.ChunkTokenOverlap}, nil
+	}
+	return nil, fmt.Errorf("unknown chunker %q, expected auto, lines, tokens, markdown, paragraph or code", name)
+}
+
+// Fixed windows of Size lines that overlap the previous window by Overlap lines.
+// This is how files were always split, regardless of their token count.
+type LineChunker struct {
+	Size    int
+	Overlap int
+}
+
+func (c LineChunker) Chunk(content string) []Chunk {
+	var chunks []Chunk
+	var rowStart int
+	var rowEnd int
+	var lines []string = strings.Split(content, "\n")
+	for i := 0; i < len(lines); i += c.Size {
+		if i-c.Overlap >= 0 {
+			rowStart = i - c.Overlap
+		} else {
+			rowStart = i
+		}
+		if i+c.Size+c.Overlap <= len(lines) {
+			rowEnd = i + c.Size + c.Overlap
+		} else {
+			rowEnd = len(lines)
+		}
+		chunks = append(chunks, Chunk{rowStart, rowEnd, strings.Join(lines[rowStart:rowEnd], "\n")})
+	}
+	return chunks
+}
+
+// Windows of whole lines that stay below MaxTokens.
+// The next window starts Overlap tokens before the end of the previous one.
+// A single line above the budget, like minified code, is cut into pieces.
+type TokenChunker struct {
+	MaxTokens int
+	Overlap   int
+}
+
+func (c TokenChunker) Chunk(content string) []Chunk {
+	return c.chunkLines(strings.Split(content, "\n"), 0)
+}
+
+// Split lines that start at row offset into windows
+func (c TokenChunker) chunkLines(lines []string, offset int) []Chunk {
+	var chunks []Chunk
+	start := 0
+	for start < len(lines) {
+		if EstimateTokens(lines[start]) > c.MaxTokens {
+			for _, piece := range splitLongLine(lines[start], c.MaxTokens) {
+				chunks = append(chunks, Chunk{offset + start, offset + start + 1, piece})
+			}
+			start++
+			continue
+		}
+		end := start
+		tokens := 0
+		for end < len(lines) {
+			lineTokens := EstimateTokens(lines[end]) + 1
+			if tokens+lineTokens > c.MaxTokens && end > start {
+				break
+			}
+			tokens += lineTokens
+			end++
+		}
+		chunks = append(chunks, Chunk{offset + start, offset + end, strings.Join(lines[start:end], "\n")})
+		if end == len(lines) {
+			break
+		}
+		// Step back over the last lines until Overlap tokens are repeated
+		next := end
+		overlap := 0
+		for next-1 > start && overlap+EstimateTokens(lines[next-1])+1 <= c.Overlap {
+			next--
+			overlap += EstimateTokens(lines[next]) + 1
+		}
+		start = next
+	}
+	return chunks
+}
+
+// Cut a line into pieces of at most maxTokens without splitting characters
+func splitLongLine(line string, maxTokens int) []string {
+	var pieces []string
+	size := maxTokens * 4
+	for len(line) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		pieces = append(pieces, line[:cut])
+		line = line[cut:]
+	}
+	return append(pieces, line)
+}
+
+// A unit is a range of lines that should stay together, like a section or a function
+type unit struct {
+	start int
+	end   int
+}
+
+// Pack consecutive units into chunks below maxTokens.
+// Units above the budget are split into token windows.
+func packUnits(lines []string, units []unit, maxTokens int) []Chunk {
+	var chunks []Chunk
+	windows := TokenChunker{MaxTokens: maxTokens, Overlap: min(config.ChunkTokenOverlap, maxTokens/2)}
+	current := unit{-1, -1}
+	tokens := 0
+	flush := func() {
+		if current.start >= 0 {
+			chunks = append(chunks, Chunk{current.start, current.end, strings.Join(lines[current.start:current.end], "\n")})
+		}
+		current = unit{-1, -1}
+		tokens = 0
+	}
+	for _, u := range units {
+		unitTokens := EstimateTokens(strings.Join(lines[u.start:u.end], "\n"))
+		if unitTokens > maxTokens {
+			flush()
+			chunks = append(chunks, windows.chunkLines(lines[u.start:u.end], u.start)...)
+			continue
+		}
+		if current.start >= 0 && tokens+unitTokens > maxTokens {
+			flush()
+		}
+		if current.start < 0 {
+			current.start = u.start
+		}
+		current.end = u.end
+		tokens += unitTokens
+	}
+	flush()
+	return chunks
+}
+
+// Turn the first line of every unit into units that cover all lines
+func unitsFromStarts(starts []int, lineCount int) []unit {
+	var units []unit
+	previous := 0
+	for _, start := range starts {
+		if start > previous {
+			units = append(units, unit{previous, start})
+			previous = start
+		}
+	}
+	if previous < lineCount {
+		units = append(units, unit{previous, lineCount})
+	}
+	return units
+}
+
+var markdownHeading = regexp.MustCompile(`^#{1,6}\s`)
+
+// One chunk per heading section. Sections are never merged,
+// sections above MaxTokens are split into token windows.
+type MarkdownChunker struct {
+	MaxTokens int
+}
+
+func (c MarkdownChunker) Chunk(content string) []Chunk {
+	lines := strings.Split(content, "\n")
+	var starts []int
+	inFence := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if !inFence && markdownHeading.MatchString(line) {
+			starts = append(starts, i)
+		}
+	}
+	var chunks []Chunk
+	for _, section := range unitsFromStarts(starts, len(lines)) {
+		chunks = append(chunks, packUnits(lines, []unit{section}, c.MaxTokens)...)
+	}
+	return chunks
+}
+
+var sentenceEnd = regexp.MustCompile(`[.!?]+["')\]]*\s+`)
+
+// Paragraphs separated by blank lines, packed together up to MaxTokens.
+// Paragraphs above the budget are split into sentences.
+type ParagraphChunker struct {
+	MaxTokens int
+}
+
+func (c ParagraphChunker) Chunk(content string) []Chunk {
+	lines := strings.Split(content, "\n")
+	var paragraphs []unit
+	start := -1
+	for i, line := range lines {
+		blank := strings.TrimSpace(line) == ""
+		if !blank && start < 0 {
+			start = i
+		}
+		if blank && start >= 0 {
+			paragraphs = append(paragraphs, unit{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		paragraphs = append(paragraphs, unit{start, len(lines)})
+	}
+	var chunks []Chunk
+	var small []unit
+	for _, paragraph := range paragraphs {
+		if EstimateTokens(strings.Join(lines[paragraph.start:paragraph.end], "\n")) <= c.MaxTokens {
+			small = append(small, paragraph)
+			continue
+		}
+		chunks = append(chunks, packUnits(lines, small, c.MaxTokens)...)
+		small = nil
+		chunks = append(chunks, c.chunkSentences(lines, paragraph)...)
+	}
+	return append(chunks, packUnits(lines, small, c.MaxTokens)...)
+}
+
+// Split a long paragraph into sentences and pack them up to MaxTokens,
+// remembering on which lines every chunk starts and ends
+func (c ParagraphChunker) chunkSentences(lines []string, paragraph unit) []Chunk {
+	var chunks []Chunk
+	var current strings.Builder
+	rowStart := -1
+	rowEnd := -1
+	flush := func() {
+		if rowStart >= 0 {
+			chunks = append(chunks, Chunk{rowStart, rowEnd, strings.TrimSpace(current.String())})
+		}
+		current.Reset()
+		rowStart = -1
+	}
+	for row := paragraph.start; row < paragraph.end; row++ {
+		line := lines[row]
+		var sentences []string
+		previous := 0
+		for _, match := range sentenceEnd.FindAllStringIndex(line, -1) {
+			sentences = append(sentences, line[previous:match[1]])
+			previous = match[1]
+		}
+		if previous < len(line) {
+			sentences = append(sentences, line[previous:])
+		}
+		for i, sentence := range sentences {
+			for _, piece := range splitLongLine(sentence, c.MaxTokens) {
+				if rowStart >= 0 && EstimateTokens(current.String()+piece) > c.MaxTokens {
+					flush()
+				}
+				if rowStart < 0 {
+					rowStart = row
+				} else if i == 0 {
+					current.WriteString("\n")
+				}
+				current.WriteString(piece)
+				rowEnd = row + 1
+			}
+		}
+	}
+	flush()
+	return chunks
+}
+
+// Go source split at top level declarations, a declaration keeps its doc comment.
+// Files that do not parse are split into token windows.
+type GoChunker struct {
+	MaxTokens int
+}
+
+func (c GoChunker) Chunk(content string) []Chunk {
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, "", content, parser.ParseComments)
+	if err != nil {
+		return TokenChunker{MaxTokens: c.MaxTokens, Overlap: min(config.ChunkTokenOverlap, c.MaxTokens/2)}.Chunk(content)
+	}
+	var starts []int
+	for _, decl := range file.Decls {
+		position := decl.Pos()
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				position = d.Doc.Pos()
+			}
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				position = d.Doc.Pos()
+			}
+		}
+		starts = append(starts, fileSet.Position(position).Line-1)
+	}
+	lines := strings.Split(content, "\n")
+	return packUnits(lines, unitsFromStarts(starts, len(lines)), c.MaxTokens)
+}
+
+var pythonDefinition = regexp.MustCompile(`^(async\s+def|def|class)\s`)
+
+// Python source split at top level functions and classes.
+// Decorators and comments directly above a definition stay with it.
+type PythonChunker struct {
+	MaxTokens int
+}
+
+func (c PythonChunker) Chunk(content string) []Chunk {
+	lines := strings.Split(content, "\n")
+	var starts []int
+	for i, line := range lines {
+		if !pythonDefinition.MatchString(line) {
+			continue
+		}
+		start := i
+		for start > 0 && (strings.HasPrefix(lines[start-1], "@") || strings.HasPrefix(lines[start-1], "#")) {
+			start--
+		}
+		starts = append(starts, start)
+	}
+	return packUnits(lines, unitsFromStarts(starts, len(lines)), c.MaxTokens)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Every chunk must be made of the lines its rows point at
+func checkRows(t *testing.T, name string, content string, chunks []Chunk) {
+	t.Helper()
+	lines := strings.Split(content, "\n")
+	if len(chunks) == 0 {
+		t.Fatalf("%v: no chunks", name)
+	}
+	for _, chunk := range chunks {
+		if chunk.RowStart < 0 || chunk.RowEnd > len(lines) || chunk.RowStart >= chunk.RowEnd {
+			t.Fatalf("%v: invalid rows %v-%v", name, chunk.RowStart, chunk.RowEnd)
+		}
+		original := strings.Join(lines[chunk.RowStart:chunk.RowEnd], "\n")
+		for _, part := range strings.Split(chunk.Content, "\n") {
+			if !strings.Contains(original, strings.TrimSpace(part)) {
+				t.Fatalf("%v: chunk rows %v-%v do not contain %q", name, chunk.RowStart, chunk.RowEnd, part)
+			}
+		}
+	}
+}
+
+func TestChunkersKeepRowsAccurate(t *testing.T) {
+	markdown := "# Title\nintro\n\n## Setup\n```\n# not a heading\n```\nstep one\n## Usage\nrun it"
+	long := strings.Repeat("word ", 3000)
+	paragraphs := "First paragraph.\nStill first.\n\n" + strings.Repeat("A sentence that goes on. ", 200) + "\n\nLast one."
+	python := "import os\n\n@decorator\ndef first():\n    pass\n\nclass Second:\n    def method(self):\n        pass\n"
+	golang := "package main\n\nimport \"fmt\"\n\n// Doc comment\nfunc First() {\n\tfmt.Println()\n}\n\ntype Second struct{}\n"
+	cases := map[string]struct {
+		chunker Chunker
+		content string
+	}{
+		"lines":     {LineChunker{Size: 3, Overlap: 1}, markdown},
+		"tokens":    {TokenChunker{MaxTokens: 5, Overlap: 2}, markdown},
+		"long line": {TokenChunker{MaxTokens: 100, Overlap: 10}, "short\n" + long + "\nend"},
+		"markdown":  {MarkdownChunker{MaxTokens: 100}, markdown},
+		"paragraph": {ParagraphChunker{MaxTokens: 100}, paragraphs},
+		"python":    {PythonChunker{MaxTokens: 10}, python},
+		"go":        {GoChunker{MaxTokens: 10}, golang},
+	}
+	for name, c := range cases {
+		checkRows(t, name, c.content, c.chunker.Chunk(c.content))
+	}
+}
+
+func TestTokenChunkerStaysBelowBudget(t *testing.T) {
+	content := "short\n" + strings.Repeat("x", 10000) + "\nend"
+	for _, chunk := range (TokenChunker{MaxTokens: 100, Overlap: 10}).Chunk(content) {
+		if EstimateTokens(chunk.Content) > 100 {
+			t.Fatalf("chunk of rows %v-%v has %v tokens", chunk.RowStart, chunk.RowEnd, EstimateTokens(chunk.Content))
+		}
+	}
+}
+
+func TestMarkdownChunkerSplitsAtHeadings(t *testing.T) {
+	chunks := MarkdownChunker{MaxTokens: 100}.Chunk("# Title\nintro\n## Setup\n```\n# comment\n```\n## Usage\nrun")
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 sections, got %+v", chunks)
+	}
+	if chunks[1].RowStart != 2 || chunks[1].RowEnd != 6 {
+		t.Fatalf("expected the setup section on rows 2-6, got %v-%v", chunks[1].RowStart, chunks[1].RowEnd)
+	}
+}
+
+func TestCodeChunkersSplitAtFunctions(t *testing.T) {
+	golang := "package main\n\n// First does things\nfunc First() {\n}\n\nfunc Second() {\n}\n"
+	chunks := GoChunker{MaxTokens: 8}.Chunk(golang)
+	if len(chunks) < 2 || chunks[1].RowStart != 2 || !strings.HasPrefix(chunks[1].Content, "// First") {
+		t.Fatalf("expected First with its doc comment in its own chunk, got %+v", chunks)
+	}
+	python := "import os\n\n@cache\ndef first():\n    return 1\n\ndef second():\n    return 2\n"
+	chunks = PythonChunker{MaxTokens: 8}.Chunk(python)
+	if len(chunks) < 2 || chunks[1].RowStart != 2 || !strings.HasPrefix(chunks[1].Content, "@cache") {
+		t.Fatalf("expected first with its decorator in its own chunk, got %+v", chunks)
+	}
+}
+
+func TestChunkerForPicksByFileType(t *testing.T) {
+	for path, expected := range map[string]string{
+		"README.md": "main.MarkdownChunker", "main.go": "main.GoChunker", "app.py": "main.PythonChunker",
+		"notes.txt": "main.ParagraphChunker", "bundle.min.js": "main.TokenChunker",
+	} {
+		chunker, err := ChunkerFor(path, "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := fmt.Sprintf("%T", chunker); name != expected {
+			t.Fatalf("%v: expected %v, got %v", path, expected, name)
+		}
+	}
+	if _, err := ChunkerFor("a.md", "nope"); err == nil {
+		t.Fatal("expected error for unknown chunker")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Citation is a retrieved chunk that was given to the model as a numbered source
+type Citation struct {
+	Number     int // number the model uses to refer to the chunk, like [1]
+	Collection string
+	File       string
+	RowStart   int // first line counting from 0
+	RowEnd     int // line after the last one
+	PageStart  int // first page of a pdf counting from 1, 0 for files without pages
+	PageEnd    int
+	Score      float64
+	Metric     Metric
+}
+
+// Numbered citations of the chunks given to the model
+func GetCitations(embeddingDistances []EmbeddingDistance) []Citation {
+	var citations []Citation
+	for i, embeddingDistance := range embeddingDistances {
+		citations = append(citations, Citation{
+			Number:     i + 1,
+			Collection: embeddingDistance.Collection,
+			File:       embeddingDistance.Embedding.File,
+			RowStart:   embeddingDistance.Embedding.RowStart,
+			RowEnd:     embeddingDistance.Embedding.RowEnd,
+			PageStart:  embeddingDistance.Embedding.PageStart,
+			PageEnd:    embeddingDistance.Embedding.PageEnd,
+			Score:      embeddingDistance.Score,
+			Metric:     embeddingDistance.Metric,
+		})
+	}
+	return citations
+}
+
+// Lines of the chunk as shown to people, counting from 1
+func (c Citation) Lines() string {
+	first, last := c.RowStart+1, max(c.RowEnd, c.RowStart+1)
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("%v–%v", first, last)
+}
+
+// Pages of the chunk like 12–13, empty for files without pages
+func (c Citation) Pages() string {
+	if c.PageStart == 0 {
+		return ""
+	}
+	if c.PageEnd <= c.PageStart {
+		return strconv.Itoa(c.PageStart)
+	}
+	return fmt.Sprintf("%v–%v", c.PageStart, c.PageEnd)
+}
+
+// Location in the path:line form that terminals and editors open on click.
+// Websites have no lines, so only the url is returned, and the lines of
+// a pdf mean nothing to its reader, so pdfs are cited by page like manual.pdf p.12–13.
+func (c Citation) Location() string {
+	if c.PageStart > 0 {
+		return fmt.Sprintf("%v p.%v", c.File, c.Pages())
+	}
+	if isURL(c.File) {
+		return c.File
+	}
+	return fmt.Sprintf("%v:%v", c.File, c.RowStart+1)
+}
+
+// Reference for the terminal, for example [1] docs/setup.md:12 lines 12–30 (cosine 0.8731)
+func (c Citation) String() string {
+	reference := fmt.Sprintf("[%v] %v", c.Number, c.Location())
+	if !isURL(c.File) && c.PageStart == 0 {
+		reference += " lines " + c.Lines()
+	}
+	if c.Collection != "" && c.Collection != defaultCollection {
+		reference += " in " + c.Collection
+	}
+	return reference + fmt.Sprintf(" (%v %.4f)", c.Metric, c.Score)
+}
+
+// Reference for answer.md with a link that opens the file at the first line
+func (c Citation) Markdown() string {
+	if c.PageStart > 0 {
+		link := filepath.ToSlash(c.File)
+		if !isURL(c.File) {
+			link = "file://" + link
+		}
+		return fmt.Sprintf("[%v] [%v](%v#page=%v) (%v %.4f)", c.Number, c.Location(), link, c.PageStart, c.Metric, c.Score)
+	}
+	if isURL(c.File) {
+		return fmt.Sprintf("[%v] <%v> (%v %.4f)", c.Number, c.File, c.Metric, c.Score)
+	}
+	link := "file://" + filepath.ToSlash(c.File) + fmt.Sprintf("#L%v", c.RowStart+1)
+	return fmt.Sprintf("[%v] [%v](%v) lines %v (%v %.4f)", c.Number, c.Location(), link, c.Lines(), c.Metric, c.Score)
+}
+
+var (
+	// [1] or [1, 2], but not an index like list[0]
+	citationNumberPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+	citationLinePattern   = regexp.MustCompile(`([\w./~-]+\.\w+):(\d+)`)
+	// manual.pdf p.12 or manual.pdf, pp. 12–13
+	citationPagePattern = regexp.MustCompile(`([\w./~-]+\.pdf),? pp?\. ?(\d+)`)
+)
+
+// Find citations in the answer that do not match a source: numbers that were
+// never given to the model and path:line references outside the cited chunks.
+// Only references to files that were cited are checked, so a host and port like
+// api.openai.com:443 in the answer is not taken for a line of a source.
+func CheckCitations(answer string, citations []Citation) []string {
+	var invented []string
+	seen := map[string]bool{}
+	flag := func(reference string) {
+		if !seen[reference] {
+			seen[reference] = true
+			invented = append(invented, reference)
+		}
+	}
+	for _, match := range citationNumberPattern.FindAllStringSubmatchIndex(answer, -1) {
+		if match[0] > 0 && isIndexed(answer[match[0]-1]) {
+			continue
+		}
+		for _, part := range strings.Split(answer[match[2]:match[3]], ",") {
+			number, _ := strconv.Atoi(strings.TrimSpace(part))
+			if number < 1 || number > len(citations) {
+				flag(fmt.Sprintf("[%v]", number))
+			}
+		}
+	}
+	for _, match := range citationLinePattern.FindAllStringSubmatch(answer, -1) {
+		if strings.Contains(match[1], "://") || strings.HasPrefix(match[1], "//") || !citesFile(citations, match[1]) {
+			continue
+		}
+		line, _ := strconv.Atoi(match[2])
+		if !citesLine(citations, match[1], line) {
+			flag(match[0])
+		}
+	}
+	for _, match := range citationPagePattern.FindAllStringSubmatch(answer, -1) {
+		page, _ := strconv.Atoi(match[2])
+		if !citesPage(citations, match[1], page) {
+			flag(match[0])
+		}
+	}
+	sort.Strings(invented)
+	return invented
+}
+
+// Brackets after a name or call are an index in code, not a citation
+func isIndexed(before byte) bool {
+	return before == '_' || before == ')' || unicode.IsLetter(rune(before)) || unicode.IsDigit(rune(before))
+}
+
+// Whether one of the citations has the same file name as path
+func citesFile(citations []Citation, path string) bool {
+	for _, c := range citations {
+		if filepath.Base(filepath.ToSlash(c.File)) == filepath.Base(filepath.ToSlash(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether one of the citations is a chunk of the file that contains the line.
+// The file may be named by its full path or only by its last elements.
+func citesLine(citations []Citation, path string, line int) bool {
+	for _, c := range citations {
+		if sameFile(c.File, path) && line >= c.RowStart+1 && line <= max(c.RowEnd, c.RowStart+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether one of the citations is a chunk of the pdf on the page
+func citesPage(citations []Citation, path string, page int) bool {
+	for _, c := range citations {
+		if sameFile(c.File, path) && page >= c.PageStart && page <= max(c.PageEnd, c.PageStart) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether path names the file by its full path or its last elements
+func sameFile(file string, path string) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	file = filepath.ToSlash(file)
+	return file == path || strings.HasSuffix(file, "/"+strings.TrimPrefix(path, "./"))
+}
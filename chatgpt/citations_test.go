@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func testCitations() []Citation {
+	return GetCitations([]EmbeddingDistance{
+		{Embedding: Embedding{File: "/docs/setup.md", RowStart: 11, RowEnd: 30}, Score: 0.91, Metric: MetricCosine},
+		{Embedding: Embedding{File: "https://example.com/faq"}, Score: 0.82, Metric: MetricCosine},
+	})
+}
+
+func TestCitationReferences(t *testing.T) {
+	citations := testCitations()
+	if s := citations[0].String(); s != "[1] /docs/setup.md:12 lines 12–30 (cosine 0.9100)" {
+		t.Fatalf("unexpected reference %q", s)
+	}
+	if s := citations[1].String(); s != "[2] https://example.com/faq (cosine 0.8200)" {
+		t.Fatalf("unexpected reference %q", s)
+	}
+	if s := citations[0].Markdown(); !strings.Contains(s, "[/docs/setup.md:12](file:///docs/setup.md#L12)") {
+		t.Fatalf("missing link in %q", s)
+	}
+}
+
+func TestCheckCitationsFlagsInventedSources(t *testing.T) {
+	citations := testCitations()
+	answer := "Run make [1][2], see setup.md:15 and list[0]. The config is in [3] and setup.md:99, also [1, 4]."
+	invented := CheckCitations(answer, citations)
+	if strings.Join(invented, " ") != "[3] [4] setup.md:99" {
+		t.Fatalf("unexpected invented citations %q", invented)
+	}
+	if invented := CheckCitations("All from [1] and [2].", citations); len(invented) != 0 {
+		t.Fatalf("expected no invented citations, got %q", invented)
+	}
+	// Hosts and ports are not lines of a source
+	if invented := CheckCitations("Connect to api.openai.com:443 or localhost:8080 [1].", citations); len(invented) != 0 {
+		t.Fatalf("expected hosts to be left alone, got %q", invented)
+	}
+}
+
+func TestWriteAnswerToFileListsAllSources(t *testing.T) {
+	previous := config
+	config.AnswerPath = t.TempDir() + "/answer.md"
+	t.Cleanup(func() { config = previous })
+	response := GptResponse{Model: "fake", Choices: []Choice{{Message: Message{Content: "Use make [1] and [5]."}}}}
+	err := WriteAnswerToFile(response, []EmbeddingDistance{
+		{Embedding: Embedding{File: "/a.md", RowStart: 0, RowEnd: 3, Content: "first chunk"}},
+		{Embedding: Embedding{File: "/b.md", RowStart: 9, RowEnd: 12, Content: "second chunk"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(config.AnswerPath)
+	for _, expected := range []string{"[1] [/a.md:1]", "[2] [/b.md:10]", "first chunk", "second chunk", "[5] which are not among the sources"} {
+		if !strings.Contains(string(content), expected) {
+			t.Fatalf("answer.md is missing %q:\n%s", expected, content)
+		}
+	}
+}
+
+func TestCitationPages(t *testing.T) {
+	citations := GetCitations([]EmbeddingDistance{
+		{Embedding: Embedding{File: "/docs/manual.pdf", RowStart: 40, RowEnd: 90, PageStart: 12, PageEnd: 13}, Score: 0.9, Metric: MetricCosine},
+	})
+	if s := citations[0].String(); s != "[1] /docs/manual.pdf p.12–13 (cosine 0.9000)" {
+		t.Fatalf("unexpected reference %q", s)
+	}
+	if s := citations[0].Markdown(); !strings.Contains(s, "[/docs/manual.pdf p.12–13](file:///docs/manual.pdf#page=12)") {
+		t.Fatalf("missing link in %q", s)
+	}
+	invented := CheckCitations("See manual.pdf p.13 and manual.pdf, pp. 40.", citations)
+	if strings.Join(invented, " ") != "manual.pdf, pp. 40" {
+		t.Fatalf("unexpected invented citations %q", invented)
+	}
+}
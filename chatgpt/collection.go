@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	defaultCollection      = "default"
+	collectionSettingsFile = "collection.json"
+)
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// How the vectors of a collection were produced.
+// Vectors of different embedding models cannot be compared,
+// so a collection only ever holds vectors of one model.
+type CollectionSettings struct {
+	Created        time.Time
+	EmbeddingModel string
+	Embedder       string // embedder of the vectors, empty for collections embedded before it was recorded
+	Chunker        string // chunker of the last --embed, auto picks one by file type
+	ChunkTokens    int    // token budget of the token based chunkers
+	ChunkSize      int    // lines per chunk of the lines chunker
+	ChunkOverlap   int
+}
+
+// A Collection is a named knowledge base with its own index,
+// so questions about one project do not retrieve chunks of another.
+type Collection struct {
+	Name     string
+	Settings CollectionSettings
+	*VectorIndex
+}
+
+// Collections are saved in folders in the data directory
+func getCollectionsPath() (string, error) {
+	return getDataPath("collections")
+}
+
+func getCollectionPath(name string) (string, error) {
+	return getDataPath("collections", name)
+}
+
+// Open the collection in dir, creating it if it does not exist yet
+func OpenCollection(name string, dir string) (*Collection, error) {
+	if !collectionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid collection name %q, use letters, digits, dots, dashes and underscores", name)
+	}
+	index, err := OpenIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	collection := &Collection{Name: name, VectorIndex: index}
+	content, err := os.ReadFile(index.path(collectionSettingsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		collection.Settings = CollectionSettings{
+			Created:      time.Now(),
+			Chunker:      "auto",
+			ChunkTokens:  config.ChunkTokens,
+			ChunkSize:    config.ChunkSize,
+			ChunkOverlap: config.ChunkOverlap,
+		}
+		return collection, collection.saveSettings()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collection settings: %w", err)
+	}
+	if err := json.Unmarshal(content, &collection.Settings); err != nil {
+		return nil, fmt.Errorf("failed to parse collection settings: %w", err)
+	}
+	return collection, nil
+}
+
+func (c *Collection) saveSettings() error {
+	content, err := json.MarshalIndent(c.Settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal collection settings: %w", err)
+	}
+	return os.WriteFile(c.path(collectionSettingsFile), content, 0644)
+}
+
+// Embedder that produced the vectors of the collection, empty while it has none
+func (s CollectionSettings) embedder() string {
+	if s.Embedder == "" && s.EmbeddingModel != "" {
+		// Only the provider could embed before the embedder was recorded
+		return EmbedderProvider
+	}
+	return s.Embedder
+}
+
+// Make sure vectors of the embedder and model can be compared with the collection
+func (c *Collection) CheckModel(embedder string, model string) error {
+	if model == "" {
+		return nil
+	}
+	if recorded := c.Settings.embedder(); recorded != "" && recorded != embedder {
+		return fmt.Errorf("collection %v was embedded by the %v embedder, not %v, use --embedder %v",
+			c.Name, recorded, embedder, recorded)
+	}
+	if c.Settings.EmbeddingModel != "" && c.Settings.EmbeddingModel != model {
+		return fmt.Errorf("collection %v was embedded with %v, not %v", c.Name, c.Settings.EmbeddingModel, model)
+	}
+	return nil
+}
+
+// Like CheckModel before vectors are stored. The first embedder and model
+// are remembered for the collection, searching it does not pin them.
+func (c *Collection) RecordModel(embedder string, model string) error {
+	if err := c.CheckModel(embedder, model); err != nil || model == "" {
+		return err
+	}
+	if c.Settings.Embedder == embedder && c.Settings.EmbeddingModel == model {
+		return nil
+	}
+	c.Settings.Embedder = embedder
+	c.Settings.EmbeddingModel = model
+	return c.saveSettings()
+}
+
+// Remember which chunker produced the chunks of the collection
+func (c *Collection) SetChunker(name string) error {
+	if name == "" {
+		name = "auto"
+	}
+	if c.Settings.Chunker == name && c.Settings.ChunkTokens == config.ChunkTokens &&
+		c.Settings.ChunkSize == config.ChunkSize && c.Settings.ChunkOverlap == config.ChunkOverlap {
+		return nil
+	}
+	c.Settings.Chunker = name
+	c.Settings.ChunkTokens = config.ChunkTokens
+	c.Settings.ChunkSize = config.ChunkSize
+	c.Settings.ChunkOverlap = config.ChunkOverlap
+	return c.saveSettings()
+}
+
+// Names of all collections in the user's home directory
+func ListCollections() ([]string, error) {
+	collectionsPath, err := getCollectionsPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(collectionsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && collectionNamePattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open a collection in the user's home directory. A collection that does not
+// exist is an error, so a mistyped name is not asked as an empty collection.
+// The default collection takes over the index of older versions.
+func LoadCollection(name string) (*Collection, error) {
+	return loadCollection(name, false)
+}
+
+// Open a collection in the user's home directory, it is created if it does not exist
+func LoadOrCreateCollection(name string) (*Collection, error) {
+	return loadCollection(name, true)
+}
+
+func loadCollection(name string, create bool) (*Collection, error) {
+	if name == "" {
+		name = defaultCollection
+	}
+	if name == defaultCollection {
+		if err := migrateDefaultCollection(); err != nil {
+			return nil, err
+		}
+	}
+	collectionPath, err := getCollectionPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if !create && collectionNamePattern.MatchString(name) {
+		if _, err := os.Stat(collectionPath); errors.Is(err, os.ErrNotExist) && !hasJSONEmbeddings(name) {
+			return nil, fmt.Errorf("%w: collection %v does not exist, create it with --embed <path> --collection %v", ErrUsage, name, name)
+		}
+	}
+	collection, err := OpenCollection(name, collectionPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open collection: %w", err)
+	}
+	if name == defaultCollection {
+		embeddingsPath, err := getEmbeddingsPath()
+		if err != nil {
+			return nil, err
+		}
+		if hasJSONEmbeddings(name) && collection.Len() == 0 {
+			fmt.Println("Migrating embeddings from", embeddingsPath)
+			n, err := MigrateJSONEmbeddings(embeddingsPath, collection.VectorIndex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to migrate embeddings: %w", err)
+			}
+			fmt.Printf("Migrated %v embeddings to collection %v\n", n, name)
+		}
+	}
+	return collection, nil
+}
+
+// Whether the embeddings file of older versions is there to be migrated into the collection
+func hasJSONEmbeddings(name string) bool {
+	if name != defaultCollection {
+		return false
+	}
+	embeddingsPath, err := getEmbeddingsPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(embeddingsPath)
+	return err == nil
+}
+
+// Names of the collections to open, all collections if names contains "all"
+func expandCollectionNames(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return []string{defaultCollection}, nil
+	}
+	for _, name := range names {
+		if name == "all" {
+			return ListCollections()
+		}
+	}
+	return names, nil
+}
+
+// Embedder the collections were embedded by, read without opening them.
+// Empty if none of them has vectors yet. Collections of different embedders
+// cannot be asked together, their vectors cannot be compared.
+func RecordedEmbedder(names []string) (string, error) {
+	names, err := expandCollectionNames(names)
+	if err != nil {
+		return "", err
+	}
+	recorded, from := "", ""
+	for _, name := range names {
+		if !collectionNamePattern.MatchString(name) {
+			continue
+		}
+		collectionPath, err := getCollectionPath(name)
+		if err != nil {
+			return "", err
+		}
+		content, err := os.ReadFile(filepath.Join(collectionPath, collectionSettingsFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read collection settings: %w", err)
+		}
+		var settings CollectionSettings
+		if err := json.Unmarshal(content, &settings); err != nil {
+			return "", fmt.Errorf("failed to parse collection settings: %w", err)
+		}
+		embedder := settings.embedder()
+		if embedder == "" || embedder == recorded {
+			continue
+		}
+		if recorded != "" {
+			return "", fmt.Errorf("%w: collection %v was embedded by the %v embedder and %v by %v, ask them one at a time",
+				ErrUsage, from, recorded, name, embedder)
+		}
+		recorded, from = embedder, name
+	}
+	return recorded, nil
+}
+
+// Open several collections, all collections if names contains "all"
+func LoadCollections(names []string) ([]*Collection, error) {
+	names, err := expandCollectionNames(names)
+	if err != nil {
+		return nil, err
+	}
+	var collections []*Collection
+	for _, name := range names {
+		collection, err := LoadCollection(name)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+// Move the single index of older versions to the default collection
+func migrateDefaultCollection() error {
+	collectionsPath, err := getCollectionsPath()
+	if err != nil {
+		return err
+	}
+	oldPath := filepath.Join(filepath.Dir(collectionsPath), "index")
+	newPath := filepath.Join(collectionsPath, defaultCollection)
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(collectionsPath, 0755); err != nil {
+		return fmt.Errorf("failed to create collections folder: %w", err)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to move index to the default collection: %w", err)
+	}
+	fmt.Println("Moved", oldPath, "to collection", defaultCollection)
+	return nil
+}
+
+// Search several collections and merge the results.
+// Distances of collections with the same metric are comparable, otherwise
+// the results are interleaved by rank. Only sources matching the filter are searched.
+func SearchCollections(collections []*Collection, query []float64, n int, filter Filter) ([]EmbeddingDistance, error) {
+	var results [][]EmbeddingDistance
+	sameMetric := true
+	for _, collection := range collections {
+		distances, err := collection.SearchAllowed(query, n, collection.FilterIds(filter))
+		if err != nil {
+			return nil, fmt.Errorf("collection %v: %w", collection.Name, err)
+		}
+		for i := range distances {
+			distances[i].Collection = collection.Name
+		}
+		results = append(results, distances)
+		sameMetric = sameMetric && collection.Metric() == collections[0].Metric()
+	}
+	var merged []EmbeddingDistance
+	if sameMetric {
+		for _, distances := range results {
+			merged = append(merged, distances...)
+		}
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].Distance < merged[j].Distance })
+	} else {
+		for rank := 0; rank < n; rank++ {
+			for _, distances := range results {
+				if rank < len(distances) {
+					merged = append(merged, distances[rank])
+				}
+			}
+		}
+	}
+	return merged[:min(n, len(merged))], nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSearchCollectionsMergesResults(t *testing.T) {
+	work, err := OpenCollection("work", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := OpenCollection("home", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	work.Add([]Embedding{{File: "work.txt", Vector: []float64{1, 0.1}}})
+	home.Add([]Embedding{{File: "home.txt", Vector: []float64{1, 0}}, {File: "far.txt", Vector: []float64{-1, 0}}})
+	results, err := SearchCollections([]*Collection{work, home}, []float64{1, 0}, 2, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Collection != "home" || results[1].Collection != "work" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+}
+
+func TestCollectionRemembersEmbeddingModel(t *testing.T) {
+	dir := t.TempDir()
+	collection, err := OpenCollection("docs", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.RecordModel(EmbedderProvider, "model-a"); err != nil {
+		t.Fatal(err)
+	}
+	collection, err = OpenCollection("docs", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection.Settings.EmbeddingModel != "model-a" || collection.Settings.ChunkSize != chunkSize {
+		t.Fatalf("settings were not saved: %+v", collection.Settings)
+	}
+	if err := collection.RecordModel(EmbedderProvider, "model-b"); err == nil {
+		t.Fatal("expected error when mixing embedding models")
+	}
+	if _, err := OpenCollection("../escape", t.TempDir()); err == nil {
+		t.Fatal("expected error for invalid collection name")
+	}
+}
+
+func TestAskingUnknownCollectionDoesNotCreateIt(t *testing.T) {
+	useDataDir(t)
+	err := StartChat("question", []string{"wrok-docs"}, false, "", Filter{}, true)
+	if !errors.Is(err, ErrUsage) || !strings.Contains(err.Error(), "wrok-docs") {
+		t.Fatalf("expected usage error naming the collection, got %v", err)
+	}
+	if names, _ := ListCollections(); len(names) != 0 {
+		t.Fatalf("expected no collections, got %v", names)
+	}
+	if _, err := LoadOrCreateCollection("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCollection("docs"); err != nil {
+		t.Fatal(err)
+	}
+}
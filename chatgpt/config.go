@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Settings of the tool, read from config.yaml in the config directory.
+// Values of the selected profile replace the top level values, and
+// environment variables and flags replace both. Keys that are not set keep the default.
+type Config struct {
+	Provider    string `yaml:"provider"` // openai or local
+	BaseURL     string `yaml:"base_url"` // empty uses the default of the provider
+	ChatModel   string `yaml:"chat_model"`
+	EmbedModel  string `yaml:"embed_model"`
+	VisionModel string `yaml:"vision_model"`
+	RerankModel string `yaml:"rerank_model"` // cross-encoder of the /rerank api
+	// Name of the api key in the key store, keys are saved per provider
+	KeyName     string   `yaml:"key_name"`
+	Temperature *float64 `yaml:"temperature"` // not sent when nil, so the model default is used
+	MaxTokens   int      `yaml:"max_tokens"`  // tokens of an answer
+	// Tokens the chat model can read and write in one request
+	ContextTokens int `yaml:"context_tokens"`
+	// Most chunks given to the model as context, 0 takes chunks until context_budget is used
+	RetrievalK int `yaml:"retrieval_k"`
+	// Most tokens of the chunks given to the model as context
+	ContextBudget int `yaml:"context_budget"`
+	// How the candidates are reranked before they are selected: none, llm or cross-encoder
+	Rerank string `yaml:"rerank"`
+	// Weight of relevance against diversity when selecting chunks, between 0 and 1
+	MMRLambda float64 `yaml:"mmr_lambda"`
+	// How chunks are found: vector, keyword or hybrid
+	RetrievalMode string `yaml:"retrieval_mode"`
+	// Weights of the vector and keyword ranks in hybrid mode
+	VectorWeight  float64 `yaml:"vector_weight"`
+	KeywordWeight float64 `yaml:"keyword_weight"`
+	// What turns chunks into vectors: provider (its embedding api) or hashing
+	// (built in, works offline). Empty uses the embedder of the collection.
+	Embedder string `yaml:"embedder"`
+	// Chunker used by --embed: auto, lines, tokens, markdown, paragraph or code
+	Chunker           string `yaml:"chunker"`
+	ChunkTokens       int    `yaml:"chunk_tokens"`
+	ChunkTokenOverlap int    `yaml:"chunk_token_overlap"`
+	ChunkSize         int    `yaml:"chunk_size"` // lines per chunk of the lines chunker
+	ChunkOverlap      int    `yaml:"chunk_overlap"`
+	// Links followed from an --embed url, 0 only embeds the page itself
+	CrawlDepth   int      `yaml:"crawl_depth"`
+	CrawlPages   int      `yaml:"crawl_pages"`   // pages fetched by one crawl at most
+	CrawlDomains []string `yaml:"crawl_domains"` // hosts besides the host of the url
+	// Files of a folder larger than this are not embedded, like 10MB, 0 for no limit
+	MaxFileSize string `yaml:"max_file_size"`
+	// Commands that print the text of a file read from stdin, by extension
+	// like .rtf or media type like application/rtf
+	Extractors map[string]string `yaml:"extractors"`
+	// Dollars per million tokens of models that are missing or priced differently
+	// in the built-in list, used to estimate and report costs
+	Prices map[string]Price `yaml:"prices"`
+	// Api calls are refused once the calls of the month cost this many
+	// dollars or used this many tokens, 0 for no limit
+	MonthlyBudget float64 `yaml:"monthly_budget"`
+	MonthlyTokens int     `yaml:"monthly_tokens"`
+	// Largest size of the cache of embeddings and answers, like 500MB, 0 turns it off
+	CacheSize string `yaml:"cache_size"`
+	// How long answers are cached, like 24h or 7d, answers are not cached when empty
+	ChatCacheTTL string `yaml:"chat_cache_ttl"`
+	// Folder of the collections and sessions, ~/.chatgpt by default
+	DataDir string `yaml:"data_dir"`
+	// File the last answer is written to, ~/answer.md by default
+	AnswerPath string `yaml:"answer_path"`
+	// Profile used when --profile is not given
+	Profile  string            `yaml:"profile"`
+	Profiles map[string]Config `yaml:"profiles"`
+}
+
+// The active configuration, loaded in main
+var config Config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Provider:          "openai",
+		KeyName:           defaultKeyName,
+		MaxTokens:         chatMaxTokens,
+		ContextTokens:     chatContextTokens,
+		RetrievalK:        retrievalK,
+		ContextBudget:     contextBudget,
+		Rerank:            RerankNone,
+		MMRLambda:         mmrLambda,
+		RetrievalMode:     ModeHybrid,
+		VectorWeight:      1,
+		KeywordWeight:     1,
+		Chunker:           "auto",
+		ChunkTokens:       chunkTokens,
+		ChunkTokenOverlap: chunkTokenOverlap,
+		ChunkSize:         chunkSize,
+		ChunkOverlap:      chunkOverlap,
+		CrawlPages:        crawlPages,
+		MaxFileSize:       maxFileSize,
+		CacheSize:         cacheSize,
+	}
+}
+
+// The config file is $CHATGPT_CONFIG, or config.yaml in
+// $XDG_CONFIG_HOME/chatgpt which defaults to ~/.config/chatgpt
+func getConfigPath() (string, error) {
+	if path := os.Getenv("CHATGPT_CONFIG"); path != "" {
+		return path, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "chatgpt", "config.yaml"), nil
+	}
+	return getHomePath(".config", "chatgpt", "config.yaml")
+}
+
+// Read the config file at path and apply the profile and environment variables.
+// A missing file is fine unless the path was given explicitly. An empty profile
+// falls back to $CHATGPT_PROFILE and then to the profile named in the file.
+func LoadConfig(path string, profile string) (Config, error) {
+	explicit := path != ""
+	if !explicit {
+		var err error
+		path, err = getConfigPath()
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	var file Config
+	keys := map[string]bool{}
+	content, err := os.ReadFile(path)
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return Config{}, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(content, &file); err != nil {
+			return Config{}, fmt.Errorf("%w: failed to parse config %v: %v", ErrUsage, path, err)
+		}
+		if keys, err = configKeys(content, ""); err != nil {
+			return Config{}, fmt.Errorf("%w: failed to parse config %v: %v", ErrUsage, path, err)
+		}
+	}
+	result := defaultConfig()
+	result.merge(file, keys)
+	if profile == "" {
+		profile = getEnv("CHATGPT_PROFILE", file.Profile)
+	}
+	if profile != "" {
+		values, ok := file.Profiles[profile]
+		if !ok {
+			return Config{}, fmt.Errorf("%w: profile %q not found in %v", ErrUsage, profile, path)
+		}
+		profileKeys, err := configKeys(content, profile)
+		if err != nil {
+			return Config{}, fmt.Errorf("%w: failed to parse config %v: %v", ErrUsage, path, err)
+		}
+		result.merge(values, profileKeys)
+	}
+	result.Profile = profile
+	result.Profiles = file.Profiles
+	if err := result.applyEnv(); err != nil {
+		return Config{}, err
+	}
+	return result, result.validate()
+}
+
+// Replace the values of the keys that are set in other, even zero values like
+// crawl_depth: 0. Extractors and prices are merged by key, so a profile can add
+// one without repeating the others.
+func (c *Config) merge(other Config, set map[string]bool) {
+	target, source := reflect.ValueOf(c).Elem(), reflect.ValueOf(other)
+	for i := 0; i < target.NumField(); i++ {
+		key := strings.Split(target.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if !set[key] || key == "profile" || key == "profiles" {
+			continue
+		}
+		value := source.Field(i)
+		if value.Kind() == reflect.Map {
+			merged := reflect.MakeMap(value.Type())
+			for _, m := range []reflect.Value{target.Field(i), value} {
+				for entries := m.MapRange(); entries.Next(); {
+					merged.SetMapIndex(entries.Key(), entries.Value())
+				}
+			}
+			value = merged
+		}
+		target.Field(i).Set(value)
+	}
+}
+
+// Keys of a config file or of one of its profiles, the profile is left out when empty
+func configKeys(content []byte, profile string) (map[string]bool, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	if profile != "" {
+		profiles, _ := raw["profiles"].(map[interface{}]interface{})
+		values, _ := profiles[profile].(map[interface{}]interface{})
+		raw = map[string]interface{}{}
+		for key, value := range values {
+			raw[fmt.Sprint(key)] = value
+		}
+	}
+	keys := map[string]bool{}
+	for key := range raw {
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// Environment variables replace the values of the config file
+func (c *Config) applyEnv() error {
+	var env Config
+	// The variables are named after the keys of the config file
+	set := map[string]bool{}
+	key := func(name string) string {
+		return strings.ToLower(strings.TrimPrefix(name, "CHATGPT_"))
+	}
+	for name, value := range map[string]*string{
+		"CHATGPT_PROVIDER":       &env.Provider,
+		"CHATGPT_BASE_URL":       &env.BaseURL,
+		"CHATGPT_CHAT_MODEL":     &env.ChatModel,
+		"CHATGPT_EMBED_MODEL":    &env.EmbedModel,
+		"CHATGPT_VISION_MODEL":   &env.VisionModel,
+		"CHATGPT_RERANK_MODEL":   &env.RerankModel,
+		"CHATGPT_RERANK":         &env.Rerank,
+		"CHATGPT_KEY_NAME":       &env.KeyName,
+		"CHATGPT_EMBEDDER":       &env.Embedder,
+		"CHATGPT_CHUNKER":        &env.Chunker,
+		"CHATGPT_RETRIEVAL_MODE": &env.RetrievalMode,
+		"CHATGPT_DATA_DIR":       &env.DataDir,
+		"CHATGPT_ANSWER_PATH":    &env.AnswerPath,
+		"CHATGPT_MAX_FILE_SIZE":  &env.MaxFileSize,
+		"CHATGPT_CACHE_SIZE":     &env.CacheSize,
+		"CHATGPT_CHAT_CACHE_TTL": &env.ChatCacheTTL,
+	} {
+		if *value = os.Getenv(name); *value != "" {
+			set[key(name)] = true
+		}
+	}
+	if value := os.Getenv("CHATGPT_TEMPERATURE"); value != "" {
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid CHATGPT_TEMPERATURE %q", ErrUsage, value)
+		}
+		env.Temperature = &temperature
+		set["temperature"] = true
+	}
+	for name, value := range map[string]*float64{
+		"CHATGPT_VECTOR_WEIGHT":  &env.VectorWeight,
+		"CHATGPT_KEYWORD_WEIGHT": &env.KeywordWeight,
+		"CHATGPT_MMR_LAMBDA":     &env.MMRLambda,
+		"CHATGPT_MONTHLY_BUDGET": &env.MonthlyBudget,
+	} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(os.Getenv(name), 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %v %q", ErrUsage, name, os.Getenv(name))
+		}
+		*value = weight
+		set[key(name)] = true
+	}
+	for name, value := range map[string]*int{
+		"CHATGPT_MAX_TOKENS":          &env.MaxTokens,
+		"CHATGPT_CONTEXT_TOKENS":      &env.ContextTokens,
+		"CHATGPT_RETRIEVAL_K":         &env.RetrievalK,
+		"CHATGPT_CONTEXT_BUDGET":      &env.ContextBudget,
+		"CHATGPT_CHUNK_TOKENS":        &env.ChunkTokens,
+		"CHATGPT_CHUNK_TOKEN_OVERLAP": &env.ChunkTokenOverlap,
+		"CHATGPT_CHUNK_SIZE":          &env.ChunkSize,
+		"CHATGPT_CHUNK_OVERLAP":       &env.ChunkOverlap,
+		"CHATGPT_CRAWL_DEPTH":         &env.CrawlDepth,
+		"CHATGPT_CRAWL_PAGES":         &env.CrawlPages,
+		"CHATGPT_MONTHLY_TOKENS":      &env.MonthlyTokens,
+	} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(os.Getenv(name))
+		if err != nil {
+			return fmt.Errorf("%w: invalid %v %q", ErrUsage, name, os.Getenv(name))
+		}
+		*value = n
+		set[key(name)] = true
+	}
+	c.merge(env, set)
+	return nil
+}
+
+func (c Config) validate() error {
+	if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 2) {
+		return fmt.Errorf("%w: temperature must be between 0 and 2, got %v", ErrUsage, *c.Temperature)
+	}
+	for name, value := range map[string]int{
+		"max_tokens":     c.MaxTokens,
+		"context_tokens": c.ContextTokens,
+		"context_budget": c.ContextBudget,
+		"chunk_tokens":   c.ChunkTokens,
+		"chunk_size":     c.ChunkSize,
+		"crawl_pages":    c.CrawlPages,
+	} {
+		if value < 1 {
+			return fmt.Errorf("%w: %v must be at least 1, got %v", ErrUsage, name, value)
+		}
+	}
+	switch c.RetrievalMode {
+	case ModeVector, ModeKeyword, ModeHybrid:
+	default:
+		return fmt.Errorf("%w: retrieval_mode must be vector, keyword or hybrid, got %q", ErrUsage, c.RetrievalMode)
+	}
+	switch c.Rerank {
+	case RerankNone, RerankLLM, RerankCrossEncoder:
+	default:
+		return fmt.Errorf("%w: rerank must be none, llm or cross-encoder, got %q", ErrUsage, c.Rerank)
+	}
+	if c.MMRLambda < 0 || c.MMRLambda > 1 {
+		return fmt.Errorf("%w: mmr_lambda must be between 0 and 1, got %v", ErrUsage, c.MMRLambda)
+	}
+	if c.VectorWeight < 0 || c.KeywordWeight < 0 {
+		return fmt.Errorf("%w: vector_weight and keyword_weight must not be negative", ErrUsage)
+	}
+	if c.RetrievalMode == ModeHybrid && c.VectorWeight == 0 && c.KeywordWeight == 0 {
+		return fmt.Errorf("%w: vector_weight and keyword_weight must not both be 0", ErrUsage)
+	}
+	if c.MaxTokens >= c.ContextTokens {
+		return fmt.Errorf("%w: max_tokens %v must be less than context_tokens %v", ErrUsage, c.MaxTokens, c.ContextTokens)
+	}
+	if c.CrawlDepth < 0 {
+		return fmt.Errorf("%w: crawl_depth must not be negative, got %v", ErrUsage, c.CrawlDepth)
+	}
+	if c.ChunkOverlap < 0 || c.ChunkOverlap >= c.ChunkSize {
+		return fmt.Errorf("%w: chunk_overlap must be between 0 and chunk_size", ErrUsage)
+	}
+	if c.ChunkTokenOverlap < 0 || c.ChunkTokenOverlap >= c.ChunkTokens {
+		return fmt.Errorf("%w: chunk_token_overlap must be between 0 and chunk_tokens", ErrUsage)
+	}
+	if _, err := parseSize(c.MaxFileSize); err != nil {
+		return fmt.Errorf("%w: max_file_size: %v", ErrUsage, err)
+	}
+	for key, command := range c.Extractors {
+		if !strings.HasPrefix(key, ".") && !strings.Contains(key, "/") {
+			return fmt.Errorf("%w: extractor %q must be an extension like .rtf or a media type like application/rtf", ErrUsage, key)
+		}
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("%w: extractor %v has no command", ErrUsage, key)
+		}
+	}
+	if _, err := parseSize(c.CacheSize); err != nil {
+		return fmt.Errorf("%w: cache_size: %v", ErrUsage, err)
+	}
+	if c.ChatCacheTTL != "" {
+		if ttl, err := parseAge(c.ChatCacheTTL); err != nil || ttl < 0 {
+			return fmt.Errorf("%w: chat_cache_ttl must be a duration like 24h or 7d, got %q", ErrUsage, c.ChatCacheTTL)
+		}
+	}
+	if c.RetrievalK < 0 {
+		return fmt.Errorf("%w: retrieval_k must not be negative, got %v", ErrUsage, c.RetrievalK)
+	}
+	if c.MonthlyBudget < 0 || c.MonthlyTokens < 0 {
+		return fmt.Errorf("%w: monthly_budget and monthly_tokens must not be negative", ErrUsage)
+	}
+	for model, price := range c.Prices {
+		if price.Input < 0 || price.Output < 0 {
+			return fmt.Errorf("%w: price of %v must not be negative", ErrUsage, model)
+		}
+	}
+	if _, err := ChunkerFor("", c.Chunker); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	if _, err := NewEmbedder(c.Embedder); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Paths in the config may start with ~ for the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	return getHomePath(strings.TrimPrefix(strings.TrimPrefix(path, "~"), "/"))
+}
+
+// Path of a file in the data directory
+func getDataPath(name ...string) (string, error) {
+	if config.DataDir == "" {
+		return getHomePath(append([]string{".chatgpt"}, name...)...)
+	}
+	dir, err := expandHome(config.DataDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{dir}, name...)...), nil
+}
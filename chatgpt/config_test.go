@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `
+provider: openai
+chat_model: gpt-4o-mini
+max_tokens: 800
+retrieval_k: 3
+chunk_tokens: 400
+profile: work
+profiles:
+  work:
+    retrieval_k: 5
+    temperature: 0.2
+  offline:
+    provider: local
+    chat_model: llama3
+    chunker: paragraph
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigAppliesProfile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	c, err := LoadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The profile named in the file is used by default
+	if c.Profile != "work" || c.RetrievalK != 5 || c.Temperature == nil || *c.Temperature != 0.2 {
+		t.Fatalf("profile work not applied: %+v", c)
+	}
+	if c.ChatModel != "gpt-4o-mini" || c.MaxTokens != 800 || c.ChunkTokens != 400 || c.ChunkSize != chunkSize {
+		t.Fatalf("top level values or defaults missing: %+v", c)
+	}
+	c, err = LoadConfig(path, "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Provider != "local" || c.ChatModel != "llama3" || c.Chunker != "paragraph" || c.RetrievalK != 3 {
+		t.Fatalf("profile offline not applied: %+v", c)
+	}
+	if _, err := LoadConfig(path, "missing"); !errors.Is(err, ErrUsage) {
+		t.Fatalf("expected usage error for unknown profile, got %v", err)
+	}
+}
+
+func TestEnvironmentOverridesConfig(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	t.Setenv("CHATGPT_CHAT_MODEL", "gpt-4o")
+	t.Setenv("CHATGPT_RETRIEVAL_K", "7")
+	t.Setenv("CHATGPT_PROFILE", "offline")
+	for name, value := range map[string]string{
+		"CHATGPT_CONTEXT_TOKENS":      "8000",
+		"CHATGPT_CHUNK_TOKENS":        "300",
+		"CHATGPT_CHUNK_TOKEN_OVERLAP": "30",
+		"CHATGPT_CHUNK_SIZE":          "40",
+		"CHATGPT_CHUNK_OVERLAP":       "0",
+		"CHATGPT_CRAWL_DEPTH":         "2",
+		"CHATGPT_CRAWL_PAGES":         "20",
+	} {
+		t.Setenv(name, value)
+	}
+	c, err := LoadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Profile != "offline" || c.ChatModel != "gpt-4o" || c.RetrievalK != 7 {
+		t.Fatalf("environment not applied: %+v", c)
+	}
+	if c.ContextTokens != 8000 || c.ChunkTokens != 300 || c.ChunkTokenOverlap != 30 || c.ChunkSize != 40 ||
+		c.ChunkOverlap != 0 || c.CrawlDepth != 2 || c.CrawlPages != 20 {
+		t.Fatalf("chunking and crawling variables not applied: %+v", c)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	for _, content := range []string{
+		"max_tokens: 5000\ncontext_tokens: 4096\n",
+		"temperature: 3\n",
+		"chunker: sentences\n",
+		"unknown_setting: 1\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content), ""); !errors.Is(err, ErrUsage) {
+			t.Fatalf("expected usage error for %q, got %v", content, err)
+		}
+	}
+	// Without a config file the defaults are used
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	c, err := LoadConfig("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RetrievalK != retrievalK || c.MaxTokens != chatMaxTokens || c.Chunker != "auto" {
+		t.Fatalf("unexpected defaults %+v", c)
+	}
+}
+
+func TestZeroValuesOverrideDefaults(t *testing.T) {
+	path := writeConfig(t, "crawl_depth: 2\nmmr_lambda: 0\nvector_weight: 0\ncache_size: 0\nprofiles:\n  shallow:\n    crawl_depth: 0\n")
+	c, err := LoadConfig(path, "shallow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CrawlDepth != 0 || c.MMRLambda != 0 || c.VectorWeight != 0 || c.KeywordWeight != 1 || c.CacheSize != "0" {
+		t.Fatalf("zero values were not applied: %+v", c)
+	}
+	t.Setenv("CHATGPT_MONTHLY_BUDGET", "0")
+	t.Setenv("CHATGPT_KEYWORD_WEIGHT", "0")
+	if _, err := LoadConfig(writeConfig(t, "vector_weight: 0\n"), ""); !errors.Is(err, ErrUsage) {
+		t.Fatalf("expected usage error for weights that are both 0, got %v", err)
+	}
+	c, err = LoadConfig(writeConfig(t, "monthly_budget: 5\nvector_weight: 0\nretrieval_mode: vector\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MonthlyBudget != 0 || c.KeywordWeight != 0 {
+		t.Fatalf("zero values of the environment were not applied: %+v", c)
+	}
+}
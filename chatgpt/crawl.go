@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// Pages fetched by one crawl unless crawl_pages is set
+	crawlPages = 100
+	// Sitemaps read from one site, sitemap indexes can point to many
+	crawlSitemaps  = 10
+	crawlRedirects = 10
+	crawlUserAgent = "chatgpt-cli"
+)
+
+// A Crawler follows the links of a website, starting at one page.
+// It stays on the host of the first page and the extra Domains,
+// honours robots.txt and reads the sitemap.xml of the site.
+type Crawler struct {
+	MaxDepth int      // links followed from the first page, 0 only fetches the first page
+	MaxPages int      // pages fetched at most
+	Domains  []string // hosts besides the host of the first page
+	client   *resty.Client
+	robots   map[string]*robotsRules // by scheme and host
+	allowed  map[string]bool         // hosts of the crawl, set by Crawl
+}
+
+// A page of a crawl with the text extracted from its html
+type Page struct {
+	URL     string // canonical url of the page
+	Content string
+	Depth   int
+}
+
+// Result of a crawl. Gone pages answered 404 or 410 and can be removed from the index.
+type CrawlResult struct {
+	Pages  []Page
+	Gone   []string
+	Failed map[string]error
+}
+
+func NewCrawler(maxDepth int, maxPages int, domains []string) *Crawler {
+	c := &Crawler{
+		MaxDepth: maxDepth,
+		MaxPages: maxPages,
+		Domains:  domains,
+		robots:   map[string]*robotsRules{},
+	}
+	c.client = resty.New().
+		SetHeader("User-Agent", crawlUserAgent).
+		SetRedirectPolicy(resty.RedirectPolicyFunc(c.checkRedirect))
+	return c
+}
+
+// Redirects are only followed to the hosts of the crawl, otherwise the text of
+// another site would be saved under a url of this one. robots.txt may move,
+// the rules it ends up at are still the rules of the site that was asked.
+func (c *Crawler) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= crawlRedirects {
+		return fmt.Errorf("stopped after %v redirects", crawlRedirects)
+	}
+	if c.allowed == nil || via[0].URL.Path == "/robots.txt" || c.allowed[strings.ToLower(request.URL.Hostname())] {
+		return nil
+	}
+	return fmt.Errorf("%w to %v", errOffSite, request.URL.Host)
+}
+
+// A page redirected to a host the crawl does not visit
+var errOffSite = errors.New("redirected off the site")
+
+// Visit the pages reachable from start breadth first. Pages listed in the
+// sitemap are visited as if the first page linked to them. Pages with the
+// same canonical url or the same text are only returned once.
+func (c *Crawler) Crawl(start string) (CrawlResult, error) {
+	result := CrawlResult{Failed: map[string]error{}}
+	startURL, err := url.Parse(start)
+	if err != nil || (startURL.Scheme != "http" && startURL.Scheme != "https") {
+		return result, fmt.Errorf("%w: cannot crawl %q, expected an http or https url", ErrUsage, start)
+	}
+	allowed := map[string]bool{strings.ToLower(startURL.Hostname()): true}
+	for _, domain := range c.Domains {
+		allowed[strings.ToLower(domain)] = true
+	}
+	c.allowed = allowed
+	type queued struct {
+		url   string
+		depth int
+	}
+	// Pages are known by their url without the scheme, so a page linked over
+	// http and https is visited once, and saved under the scheme of the start url
+	seen := map[string]bool{}
+	crawled := map[string]bool{}
+	texts := map[string]bool{}
+	var queue []queued
+	enqueue := func(link string, depth int) {
+		normalised, err := normaliseURL(link)
+		if err != nil || seen[pageKey(normalised)] || depth > c.MaxDepth {
+			return
+		}
+		parsed, _ := url.Parse(normalised)
+		if !allowed[parsed.Hostname()] {
+			return
+		}
+		seen[pageKey(normalised)] = true
+		queue = append(queue, queued{normalised, depth})
+	}
+	enqueue(start, 0)
+	if c.MaxDepth > 0 {
+		for _, link := range c.sitemapURLs(startURL) {
+			enqueue(link, 1)
+		}
+	}
+	for len(queue) > 0 && len(result.Pages) < c.MaxPages {
+		next := queue[0]
+		queue = queue[1:]
+		if !c.allowedByRobots(next.url) {
+			continue
+		}
+		fmt.Println("Crawling", next.url)
+		document, status, err := c.fetch(next.url)
+		if status == http.StatusNotFound || status == http.StatusGone {
+			result.Gone = append(result.Gone, withScheme(next.url, startURL.Scheme))
+			continue
+		}
+		if err != nil {
+			result.Failed[next.url] = err
+			continue
+		}
+		for _, link := range document.Links {
+			enqueue(link, next.depth+1)
+		}
+		// Pages are saved under their canonical url if it is on the site
+		pageURL := next.url
+		if canonical, err := normaliseURL(document.Canonical); err == nil {
+			if parsed, _ := url.Parse(canonical); allowed[parsed.Hostname()] {
+				pageURL = canonical
+			}
+		}
+		pageURL = withScheme(pageURL, startURL.Scheme)
+		hash := hashContent(document.Text)
+		if crawled[pageKey(pageURL)] || texts[hash] || strings.TrimSpace(document.Text) == "" {
+			continue
+		}
+		crawled[pageKey(pageURL)] = true
+		texts[hash] = true
+		result.Pages = append(result.Pages, Page{URL: pageURL, Content: document.Text, Depth: next.depth})
+	}
+	return result, nil
+}
+
+// Fetch a page and extract its text. Pages that are not html are skipped
+// with an error, except plain text which is kept as it is.
+func (c *Crawler) fetch(link string) (HTMLDocument, int, error) {
+	response, err := c.client.R().Get(link)
+	if errors.Is(err, errOffSite) {
+		return HTMLDocument{}, 0, fmt.Errorf("skipped %v: %w", link, errOffSite)
+	}
+	if err != nil {
+		return HTMLDocument{}, 0, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	if response.IsError() {
+		return HTMLDocument{}, response.StatusCode(), fmt.Errorf("failed to download %v: %v", link, response.Status())
+	}
+	// Redirects stay on the site, links are resolved against the final url
+	final := link
+	if response.RawResponse != nil && response.RawResponse.Request != nil {
+		final = response.RawResponse.Request.URL.String()
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "":
+		document, err := ExtractHTML(response.String(), final)
+		return document, response.StatusCode(), err
+	case "text/plain", "text/markdown":
+		return HTMLDocument{Text: response.String()}, response.StatusCode(), nil
+	}
+	return HTMLDocument{}, response.StatusCode(), fmt.Errorf("skipped %v of type %v", link, mediaType)
+}
+
+// The form of a url that is used to recognise the same page: lower case scheme
+// and host, no default port, no fragment, / for an empty path and the folder
+// instead of its index.html
+func normaliseURL(link string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return "", fmt.Errorf("not a web url: %v", link)
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	if port := parsed.Port(); (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		parsed.Host = parsed.Hostname()
+	}
+	for _, index := range []string{"index.html", "index.htm"} {
+		if strings.HasSuffix(parsed.Path, "/"+index) {
+			parsed.Path = strings.TrimSuffix(parsed.Path, index)
+			parsed.RawPath = ""
+		}
+	}
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	return parsed.String(), nil
+}
+
+// A normalised url without its scheme, the same page is served over http and https
+func pageKey(normalised string) string {
+	_, rest, _ := strings.Cut(normalised, ":")
+	return rest
+}
+
+// The normalised url with the given scheme
+func withScheme(normalised string, scheme string) string {
+	return strings.ToLower(scheme) + ":" + pageKey(normalised)
+}
+
+// Allow and Disallow rules of robots.txt that apply to the crawler
+type robotsRules struct {
+	allow    []robotsRule
+	disallow []robotsRule
+	sitemaps []string
+}
+
+type robotsRule struct {
+	pattern *regexp.Regexp
+	length  int // length of the rule, longer rules are more specific
+}
+
+func (c *Crawler) robotsFor(site *url.URL) *robotsRules {
+	key := site.Scheme + "://" + site.Host
+	if rules, ok := c.robots[key]; ok {
+		return rules
+	}
+	rules := &robotsRules{}
+	response, err := c.client.R().Get(key + "/robots.txt")
+	if err == nil && response.IsSuccess() {
+		rules = parseRobots(response.String(), crawlUserAgent)
+	}
+	c.robots[key] = rules
+	return rules
+}
+
+func (c *Crawler) allowedByRobots(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return c.robotsFor(parsed).allowed(parsed.RequestURI())
+}
+
+// Parse robots.txt. The group named after the product token of the user agent
+// is used if there is one, then the longest group that is a prefix of the token,
+// otherwise the group of *.
+func parseRobots(content string, userAgent string) *robotsRules {
+	groups := map[string]*robotsRules{}
+	var agents []string
+	inRules := false
+	var sitemaps []string
+	for _, line := range strings.Split(content, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			// A user-agent line after rules starts a new group
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			if groups[agent] == nil {
+				groups[agent] = &robotsRules{}
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			rule := parseRobotsRule(value)
+			for _, agent := range agents {
+				if key == "allow" {
+					groups[agent].allow = append(groups[agent].allow, rule)
+				} else {
+					groups[agent].disallow = append(groups[agent].disallow, rule)
+				}
+			}
+		case "sitemap":
+			sitemaps = append(sitemaps, value)
+		}
+	}
+	token, _, _ := strings.Cut(strings.ToLower(userAgent), "/")
+	rules := groups["*"]
+	longest := ""
+	for agent, group := range groups {
+		if agent != "*" && strings.HasPrefix(token, agent) && len(agent) > len(longest) {
+			rules, longest = group, agent
+		}
+	}
+	if rules == nil {
+		rules = &robotsRules{}
+	}
+	rules.sitemaps = sitemaps
+	return rules
+}
+
+// Rules match the start of the path, * matches anything and $ the end
+func parseRobotsRule(rule string) robotsRule {
+	length := len(rule)
+	anchored := strings.HasSuffix(rule, "$")
+	rule = strings.TrimSuffix(rule, "$")
+	parts := strings.Split(rule, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	pattern := "^" + strings.Join(parts, ".*")
+	if anchored {
+		pattern += "$"
+	}
+	return robotsRule{regexp.MustCompile(pattern), length}
+}
+
+// The longest matching rule wins, Allow wins a tie
+func (r *robotsRules) allowed(path string) bool {
+	longest := func(rules []robotsRule) int {
+		length := -1
+		for _, rule := range rules {
+			if rule.pattern.MatchString(path) {
+				length = max(length, rule.length)
+			}
+		}
+		return length
+	}
+	return longest(r.allow) >= longest(r.disallow)
+}
+
+// Urls of the sitemaps of robots.txt or /sitemap.xml, following sitemap indexes
+func (c *Crawler) sitemapURLs(site *url.URL) []string {
+	queue := c.robotsFor(site).sitemaps
+	if len(queue) == 0 {
+		queue = []string{site.Scheme + "://" + site.Host + "/sitemap.xml"}
+	}
+	var links []string
+	for read := 0; len(queue) > 0 && read < crawlSitemaps; read++ {
+		response, err := c.client.R().Get(queue[0])
+		queue = queue[1:]
+		if err != nil || !response.IsSuccess() {
+			continue
+		}
+		var sitemap struct {
+			URLs []struct {
+				Loc string `xml:"loc"`
+			} `xml:"url"`
+			Sitemaps []struct {
+				Loc string `xml:"loc"`
+			} `xml:"sitemap"`
+		}
+		if xml.Unmarshal(response.Body(), &sitemap) != nil {
+			continue
+		}
+		for _, entry := range sitemap.URLs {
+			links = append(links, strings.TrimSpace(entry.Loc))
+		}
+		for _, entry := range sitemap.Sitemaps {
+			queue = append(queue, strings.TrimSpace(entry.Loc))
+		}
+	}
+	return links
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCrawlFollowsLinksWithinLimits(t *testing.T) {
+	var server *httptest.Server
+	pages := map[string]string{
+		"/":               `<h1>Home</h1><a href="/docs">Docs</a><a href="/private/secret">Secret</a><a href="https://other.example/">Other</a>`,
+		"/docs":           `<link rel="canonical" href="/docs/"><h1>Docs</h1><a href="/docs/deep">Deep</a><a href="/missing">Missing</a><a href="/copy">Copy</a>`,
+		"/docs/":          `<h1>Docs</h1><a href="/docs/deep">Deep</a>`,
+		"/docs/deep":      `<h1>Deep</h1><a href="/docs/deeper">Deeper</a>`,
+		"/docs/deeper":    `<h1>Deeper</h1>`,
+		"/copy":           `<h1>Home</h1><a href="/docs">Docs</a><a href="/private/secret">Secret</a><a href="https://other.example/">Other</a>`,
+		"/private/secret": `<h1>Secret</h1>`,
+		"/listed":         `<h1>Only in the sitemap</h1>`,
+	}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nDisallow: /private/\nSitemap: %v/sitemap.xml\n", server.URL)
+			return
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0"?><urlset><url><loc>%v/listed</loc></url></urlset>`, server.URL)
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><body>%v<script>tracking()</script></body></html>", page)
+	}))
+	defer server.Close()
+
+	result, err := NewCrawler(2, 10, nil).Crawl(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var crawled []string
+	for _, page := range result.Pages {
+		crawled = append(crawled, strings.TrimPrefix(page.URL, server.URL))
+		if strings.Contains(page.Content, "tracking") {
+			t.Fatalf("script of %v was embedded: %q", page.URL, page.Content)
+		}
+	}
+	sort.Strings(crawled)
+	// /docs is saved under its canonical url, /copy has the text of the home page,
+	// /private is disallowed and /docs/deeper is three links away
+	if strings.Join(crawled, " ") != "/ /docs/ /docs/deep /listed" {
+		t.Fatalf("unexpected pages %v", crawled)
+	}
+	if len(result.Gone) != 1 || result.Gone[0] != server.URL+"/missing" {
+		t.Fatalf("expected /missing to be gone, got %v", result.Gone)
+	}
+
+	result, err = NewCrawler(2, 2, nil).Crawl(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Pages) != 2 {
+		t.Fatalf("expected the crawl to stop after 2 pages, got %v", len(result.Pages))
+	}
+}
+
+func TestCrawlVisitsPagesOverHTTPAndHTTPSOnce(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			secure := strings.Replace(server.URL, "http:", "https:", 1)
+			fmt.Fprintf(w, `<h1>Home</h1><a href="/guide/index.html">Guide</a><a href="%v/guide/">Guide</a><a href="%v/index.html">Home</a>`, secure, secure)
+		case "/guide/":
+			fmt.Fprint(w, `<h1>Guide</h1>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	result, err := NewCrawler(1, 10, nil).Crawl(server.URL + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var crawled []string
+	for _, page := range result.Pages {
+		crawled = append(crawled, page.URL)
+	}
+	if strings.Join(crawled, " ") != server.URL+"/ "+server.URL+"/guide/" || len(result.Failed) != 0 {
+		t.Fatalf("unexpected pages %v, failed %v", crawled, result.Failed)
+	}
+}
+
+func TestCrawlDoesNotFollowRedirectsOffTheSite(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<h1>Another site</h1>")
+	}))
+	defer other.Close()
+	// The other server is reached as localhost, a host the crawl does not visit
+	away := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<h1>Home</h1><a href="/moved">Moved</a><a href="/away">Away</a>`)
+		case "/moved":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/new":
+			fmt.Fprint(w, "<h1>New home of the page</h1>")
+		case "/away":
+			http.Redirect(w, r, away, http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	result, err := NewCrawler(1, 10, nil).Crawl(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range result.Pages {
+		if strings.Contains(page.Content, "Another site") {
+			t.Fatalf("%v has the text of another site", page.URL)
+		}
+	}
+	if len(result.Pages) != 2 || !errors.Is(result.Failed[server.URL+"/away"], errOffSite) {
+		t.Fatalf("expected /away to fail and the redirect on the site to be followed, got %v pages, %v", len(result.Pages), result.Failed)
+	}
+}
+
+func TestRobotsPicksTheGroupOfTheUserAgent(t *testing.T) {
+	content := "User-agent: *\nDisallow: /all\n\nUser-agent: gpt\nDisallow: /gpt\n\n" +
+		"User-agent: chatgpt\nDisallow: /chatgpt\n\nUser-agent: chatgpt-cli\nDisallow: /cli\n"
+	// Groups are kept in a map, the choice must not depend on its order
+	for i := 0; i < 20; i++ {
+		if rules := parseRobots(content, "chatgpt-cli/1.0"); rules.allowed("/cli") || !rules.allowed("/chatgpt") {
+			t.Fatal("expected the group of chatgpt-cli")
+		}
+		if rules := parseRobots(content, "chatgpt-web"); rules.allowed("/chatgpt") || !rules.allowed("/cli") {
+			t.Fatal("expected the longest group that is a prefix of the token")
+		}
+		if rules := parseRobots(content, "other-bot"); rules.allowed("/all") || !rules.allowed("/gpt") {
+			t.Fatal("expected the group of *")
+		}
+	}
+}
+
+func TestRobotsRules(t *testing.T) {
+	rules := parseRobots("User-agent: *\nDisallow: /\n\nUser-agent: chatgpt-cli\nDisallow: /tmp\nAllow: /tmp/public\nDisallow: /*.pdf$\n", crawlUserAgent)
+	for path, allowed := range map[string]bool{
+		"/docs":            true,
+		"/tmp/cache":       false,
+		"/tmp/public/page": true,
+		"/manual.pdf":      false,
+		"/manual.pdf?x=1":  true,
+	} {
+		if rules.allowed(path) != allowed {
+			t.Errorf("expected %v to be allowed: %v", path, allowed)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+// Embedders of the embedder setting
+const (
+	EmbedderProvider = "provider" // the embedding api of the provider
+	EmbedderHashing  = "hashing"  // built in, works without network
+	// Length of the vectors of the hashing embedder
+	hashingDimensions = 1024
+)
+
+// An Embedder turns texts into vectors. Providers embed with their api,
+// the hashing embedder embeds on this machine.
+type Embedder interface {
+	Embed(inputs []string) (EmbeddingResponse, error)
+}
+
+// The embedder used by CallEmbeddings, the provider when it is nil.
+// It is set in main from the --embedder flag.
+var embedder Embedder
+
+func activeEmbedder() Embedder {
+	if embedder != nil {
+		return embedder
+	}
+	return provider
+}
+
+// Name of the active embedder, as recorded in the settings of a collection
+func activeEmbedderName() string {
+	if _, ok := activeEmbedder().(*HashingEmbedder); ok {
+		return EmbedderHashing
+	}
+	return EmbedderProvider
+}
+
+// Create the embedder named in the config, nil for the embedding api of the provider
+func NewEmbedder(name string) (Embedder, error) {
+	switch strings.ToLower(name) {
+	case "", EmbedderProvider:
+		return nil, nil
+	case EmbedderHashing:
+		return &HashingEmbedder{Dimensions: hashingDimensions}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown embedder %q, expected provider or hashing", ErrUsage, name)
+}
+
+// Words too common to tell texts apart. The keyword search does not need
+// them removed since BM25 weighs words by how rare they are, vectors of
+// the hashing embedder do not know that.
+var hashingStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "has": true, "have": true, "how": true,
+	"i": true, "if": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true, "was": true,
+	"what": true, "when": true, "which": true, "who": true, "with": true, "you": true,
+}
+
+// Embeds texts without a model and without network, by hashing their
+// words and pairs of words into a fixed number of dimensions. Texts that
+// share words are close, but unlike a model it does not know synonyms.
+// The vectors only depend on the text, so they never change once embedded.
+type HashingEmbedder struct {
+	Dimensions int
+}
+
+// Name of the model, it changes with the dimensions so vectors of different lengths are not mixed
+func (e *HashingEmbedder) Model() string {
+	return fmt.Sprintf("hashing-%v", e.Dimensions)
+}
+
+func (e *HashingEmbedder) Embed(inputs []string) (EmbeddingResponse, error) {
+	response := EmbeddingResponse{Model: e.Model()}
+	for i, input := range inputs {
+		response.Data = append(response.Data, EmbeddingData{Index: i, Embedding: e.vector(input)})
+	}
+	return response, nil
+}
+
+// Normalised vector of the words and word pairs of text. Every feature adds
+// 1+log(count) to the dimension of its hash, with a sign from the hash so
+// collisions cancel out instead of adding up.
+func (e *HashingEmbedder) vector(text string) []float64 {
+	counts := map[string]int{}
+	previous := ""
+	for _, term := range Tokenize(text) {
+		if hashingStopWords[term] {
+			previous = ""
+			continue
+		}
+		term = stemPlural(term)
+		counts[term]++
+		if previous != "" {
+			counts[previous+" "+term]++
+		}
+		previous = term
+	}
+	vector := make([]float64, e.Dimensions)
+	for feature, count := range counts {
+		hash := fnv.New64a()
+		hash.Write([]byte(feature))
+		sum := hash.Sum64()
+		weight := 1 + math.Log(float64(count))
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(e.Dimensions)] += weight
+	}
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
+
+// Plural and singular forms of a word share a feature
+func stemPlural(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us"):
+		return word[:len(word)-1]
+	}
+	return word
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func dot(a []float64, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func TestHashingEmbedderPutsSimilarTextsClose(t *testing.T) {
+	e, err := NewEmbedder(EmbedderHashing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := e.Embed([]string{
+		"How do I rotate the api keys of the billing service?",
+		"The billing service reads its api key from the vault, rotate it monthly",
+		"Bake the bread for forty minutes until the crust is golden",
+		"How do I rotate the api keys of the billing service?",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "hashing-1024" || len(response.Data) != 4 {
+		t.Fatalf("unexpected response %v with %v vectors", response.Model, len(response.Data))
+	}
+	question, related, unrelated, again := response.Data[0].Embedding, response.Data[1].Embedding, response.Data[2].Embedding, response.Data[3].Embedding
+	if len(question) != hashingDimensions || math.Abs(dot(question, question)-1) > 1e-9 {
+		t.Fatalf("expected a normalised vector of %v dimensions", hashingDimensions)
+	}
+	if dot(question, again) < 1-1e-9 {
+		t.Fatal("expected the same text to get the same vector")
+	}
+	if dot(question, related) <= dot(question, unrelated) {
+		t.Fatalf("expected the related text to be closer, %v against %v", dot(question, related), dot(question, unrelated))
+	}
+	if _, err := NewEmbedder("words"); err == nil {
+		t.Fatal("expected error for unknown embedder")
+	}
+}
+
+func TestCollectionRefusesVectorsOfAnotherEmbedder(t *testing.T) {
+	dir := t.TempDir()
+	collection, err := OpenCollection("docs", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Searching an empty collection does not pin its embedder
+	if err := collection.CheckModel(EmbedderProvider, "text-embedding-3-small"); err != nil || collection.Settings.Embedder != "" {
+		t.Fatalf("expected nothing to be recorded, %+v, %v", collection.Settings, err)
+	}
+	if err := collection.RecordModel(EmbedderHashing, "hashing-1024"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.CheckModel(EmbedderProvider, "text-embedding-3-small"); err == nil {
+		t.Fatal("expected error when mixing embedders")
+	}
+	// Collections embedded before the embedder was recorded were embedded by the provider
+	collection, err = OpenCollection("older", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection.Settings.EmbeddingModel = "text-embedding-3-small"
+	if err := collection.RecordModel(EmbedderHashing, "hashing-1024"); err == nil {
+		t.Fatal("expected error when mixing embedders")
+	}
+	if err := collection.RecordModel(EmbedderProvider, "text-embedding-3-small"); err != nil || collection.Settings.Embedder != EmbedderProvider {
+		t.Fatalf("expected the provider to be recorded, %+v, %v", collection.Settings, err)
+	}
+}
+
+func TestRecordedEmbedderOfCollections(t *testing.T) {
+	useDataDir(t)
+	for name, embedder := range map[string]string{"notes": EmbedderHashing, "docs": EmbedderProvider, "empty": ""} {
+		collection, err := LoadOrCreateCollection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if embedder != "" {
+			if err := collection.RecordModel(embedder, embedder+"-model"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for names, expected := range map[string]string{"notes": EmbedderHashing, "notes,empty": EmbedderHashing, "empty": "", "new": ""} {
+		embedder, err := RecordedEmbedder(strings.Split(names, ","))
+		if err != nil || embedder != expected {
+			t.Fatalf("%v: expected %q, got %q, %v", names, expected, embedder, err)
+		}
+	}
+	if _, err := RecordedEmbedder([]string{"all"}); !errors.Is(err, ErrUsage) {
+		t.Fatalf("expected error for collections of different embedders, got %v", err)
+	}
+}
+
+func TestCallEmbeddingsUsesTheActiveEmbedder(t *testing.T) {
+	fake := &fakeProvider{}
+	useFakeProvider(t, fake)
+	previousEmbedder, previousCache := embedder, cache
+	embedder, cache = &HashingEmbedder{Dimensions: 8}, OpenCache(t.TempDir(), 1<<20, 0)
+	t.Cleanup(func() { embedder, cache = previousEmbedder, previousCache })
+	response, err := CallEmbeddings([]string{"offline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "hashing-8" || len(response.Data[0].Embedding) != 8 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if activeEmbedderName() != EmbedderHashing || embeddingCacheKey("offline") != "" {
+		t.Fatal("expected the hashing embedder not to be cached")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Kinds of errors. Functions wrap them so callers can check with errors.Is,
+// and main maps them to exit codes that scripts can react to.
+var (
+	ErrUsage      = errors.New("invalid usage")
+	ErrAuth       = errors.New("authentication failed")
+	ErrRateLimit  = errors.New("rate limit reached")
+	ErrQuota      = errors.New("quota exceeded")
+	ErrBadRequest = errors.New("bad request")
+	ErrNetwork    = errors.New("network error")
+	ErrParse      = errors.New("invalid response")
+	ErrServer     = errors.New("server error")
+	ErrCancelled  = errors.New("cancelled")
+	ErrBudget     = errors.New("monthly budget exceeded")
+)
+
+// Exit codes of the program, 1 is used for everything else
+const (
+	exitError      = 1
+	exitUsage      = 2
+	exitAuth       = 3
+	exitRateLimit  = 4
+	exitQuota      = 5
+	exitBadRequest = 6
+	exitNetwork    = 7
+	exitParse      = 8
+	exitServer     = 9
+	exitBudget     = 10
+	exitCancelled  = 130 // what shells use for Ctrl-C
+)
+
+// Error returned when the api answers with an error status.
+// Message, Type and Code are taken from the error body of the api.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Type       string
+	Code       string
+	RetryAfter time.Duration // how long the server asked us to wait, 0 if it did not say
+}
+
+func (e *APIError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = "no message"
+	}
+	return fmt.Sprintf("%v: %v (status %v)", e.Unwrap(), message, strconv.Itoa(e.StatusCode))
+}
+
+// The kind of error, decided by status code.
+// OpenAI answers 429 both when the rate limit is reached and when the
+// quota is used up, only the error code tells them apart.
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return ErrAuth
+	case e.StatusCode == 429 && (e.Code == "insufficient_quota" || e.Type == "insufficient_quota"):
+		return ErrQuota
+	case e.StatusCode == 429:
+		return ErrRateLimit
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return ErrBadRequest
+}
+
+// Exit code for the error
+func ExitCode(err error) int {
+	codes := []struct {
+		kind error
+		code int
+	}{
+		{ErrUsage, exitUsage},
+		{ErrAuth, exitAuth},
+		{ErrRateLimit, exitRateLimit},
+		{ErrQuota, exitQuota},
+		{ErrBadRequest, exitBadRequest},
+		{ErrNetwork, exitNetwork},
+		{ErrParse, exitParse},
+		{ErrServer, exitServer},
+		{ErrCancelled, exitCancelled},
+		{ErrBudget, exitBudget},
+		{context.Canceled, exitCancelled},
+	}
+	for _, c := range codes {
+		if errors.Is(err, c.kind) {
+			return c.code
+		}
+	}
+	return exitError
+}
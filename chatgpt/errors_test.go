@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIErrorsMapToExitCodes(t *testing.T) {
+	recordSleeps(t)
+	previous := provider
+	t.Cleanup(func() { provider = previous })
+	tests := []struct {
+		status  int
+		body    string
+		code    int
+		message string
+	}{
+		{401, `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`, exitAuth, "Incorrect API key"},
+		{429, `{"error": {"message": "You exceeded your current quota", "type": "insufficient_quota", "code": "insufficient_quota"}}`, exitQuota, "exceeded your current quota"},
+		{429, `{"error": {"message": "Rate limit reached"}}`, exitRateLimit, "Rate limit reached"},
+		{400, `{"error": {"message": "maximum context length is 8192 tokens"}}`, exitBadRequest, "maximum context length"},
+		{503, `overloaded`, exitServer, "overloaded"},
+		{200, `not json`, exitParse, ""},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		provider = &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+		_, err := CallChatgpt("question", "context")
+		server.Close()
+		if err == nil {
+			t.Fatalf("status %v: expected an error", test.status)
+		}
+		if code := ExitCode(err); code != test.code {
+			t.Fatalf("status %v: expected exit code %v, got %v for %v", test.status, test.code, code, err)
+		}
+		// The message of the api is shown to the user
+		if !strings.Contains(err.Error(), test.message) {
+			t.Fatalf("status %v: message missing from %q", test.status, err)
+		}
+	}
+}
+
+func TestQuotaErrorsAreNotRetried(t *testing.T) {
+	sleeps := recordSleeps(t)
+	err := withRetry(func() error {
+		return &APIError{StatusCode: 429, Code: "insufficient_quota"}
+	})
+	if !errors.Is(err, ErrQuota) || len(*sleeps) != 0 {
+		t.Fatalf("expected quota error without retries, got %v after %v waits", err, len(*sleeps))
+	}
+}
+
+func TestCallChatgptWithoutChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"model": "test", "created": 1700000000, "choices": []}`)
+	}))
+	defer server.Close()
+	previous := provider
+	provider = &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+	t.Cleanup(func() { provider = previous })
+	if _, err := CallChatgpt("question", "context"); !errors.Is(err, ErrParse) {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+}
+
+func TestMissingFilesAreErrors(t *testing.T) {
+	if _, err := ReadFile(t.TempDir() + "/missing.txt"); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	if ExitCode(fmt.Errorf("wrapped: %w", ErrUsage)) != exitUsage {
+		t.Fatal("wrapped usage errors must keep their exit code")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Stands in for the embedder during a dry run of --embed. Nothing is sent,
+// every input gets an empty vector and the requests are counted.
+type dryRunEmbedder struct {
+	model    string // model of the real embedder
+	mu       sync.Mutex
+	requests int
+}
+
+func (p *dryRunEmbedder) Embed(inputs []string) (EmbeddingResponse, error) {
+	p.mu.Lock()
+	p.requests++
+	p.mu.Unlock()
+	response := EmbeddingResponse{Model: p.model}
+	for i := range inputs {
+		response.Data = append(response.Data, EmbeddingData{Index: i})
+	}
+	return response, nil
+}
+
+// Model of the active embedder, empty if it does not say
+func embedModel() string {
+	switch e := activeEmbedder().(type) {
+	case *OpenAIProvider:
+		return e.EmbedModel
+	case *HashingEmbedder:
+		return e.Model()
+	case *dryRunEmbedder:
+		return e.model
+	}
+	return ""
+}
+
+// Chat model of the active provider, empty if it does not say
+func chatModel() string {
+	if p, ok := provider.(*OpenAIProvider); ok {
+		return p.ChatModel
+	}
+	return ""
+}
+
+// What embedding a file would send
+type FileEstimate struct {
+	Path   string
+	Status string
+	Chunks int
+	Tokens int
+	Err    error
+}
+
+// What a dry run of --embed found
+type EmbedEstimate struct {
+	Files    []FileEstimate // sorted by path
+	Summary  map[string]int // number of files by status
+	Chunks   int
+	Tokens   int
+	Requests int
+	Model    string
+	Removed  []string // sources that are gone or ignored and would be removed
+}
+
+// Sources of the collection if it exists. A dry run does not create it.
+func existingSources(collectionName string) (map[string]Source, error) {
+	sources := map[string]Source{}
+	names, err := ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if name != orDefault(collectionName, defaultCollection) {
+			continue
+		}
+		collection, err := LoadCollection(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range collection.Sources() {
+			sources[source.Path] = source
+		}
+	}
+	return sources, nil
+}
+
+// Read and chunk the files like StartEmbedding does, without calling the api.
+// Files that did not change since they were embedded into sources cost nothing.
+func EstimateEmbedding(paths []string, read func(path string) (Document, error), sources map[string]Source) EmbedEstimate {
+	dryRun := &dryRunEmbedder{model: embedModel()}
+	previous := embedder
+	embedder = dryRun
+	defer func() { embedder = previous }()
+	estimate := EmbedEstimate{Summary: map[string]int{}, Model: dryRun.model}
+	resultsChannel := make(chan EmbedResult)
+	go EmbedFiles(paths, read, sources, resultsChannel)
+	for result := range resultsChannel {
+		if _, known := sources[result.Source.Path]; known && result.Status == SourceSkipped {
+			// Binary files embedded by older versions would be removed
+			estimate.Removed = append(estimate.Removed, result.Source.Path)
+			continue
+		}
+		file := FileEstimate{Path: result.Source.Path, Status: result.Status, Err: result.Err}
+		for _, embedding := range result.Embeddings {
+			file.Chunks++
+			file.Tokens += EstimateTokens(embedding.Content)
+		}
+		estimate.Files = append(estimate.Files, file)
+		estimate.Summary[file.Status]++
+		estimate.Chunks += file.Chunks
+		estimate.Tokens += file.Tokens
+	}
+	sort.Slice(estimate.Files, func(i, j int) bool { return estimate.Files[i].Path < estimate.Files[j].Path })
+	sort.Strings(estimate.Removed)
+	estimate.Requests = dryRun.requests
+	return estimate
+}
+
+func (e EmbedEstimate) Print() {
+	fmt.Printf("\nDry run, nothing was embedded:\n")
+	for _, file := range e.Files {
+		switch file.Status {
+		case SourceAdded, SourceUpdated:
+			fmt.Printf("%v: %v, %v chunks, about %v tokens\n", file.Path, file.Status, file.Chunks, file.Tokens)
+		case SourceUnchanged:
+			fmt.Printf("%v: unchanged\n", file.Path)
+		default:
+			fmt.Printf("%v: %v, %v\n", file.Path, file.Status, file.Err)
+		}
+	}
+	for _, path := range e.Removed {
+		fmt.Printf("%v: would be removed, it is gone or ignored\n", path)
+	}
+	fmt.Printf("\nWould add %v, update %v, remove %v and leave %v files unchanged",
+		e.Summary[SourceAdded], e.Summary[SourceUpdated], len(e.Removed), e.Summary[SourceUnchanged])
+	if e.Summary[SourceSkipped] > 0 {
+		fmt.Printf(", %v skipped", e.Summary[SourceSkipped])
+	}
+	if e.Summary[SourceFailed] > 0 {
+		fmt.Printf(", %v failed", e.Summary[SourceFailed])
+	}
+	fmt.Println()
+	fmt.Printf("%v chunks in %v requests, about %v tokens\n", e.Chunks, e.Requests, e.Tokens)
+	if e.Model != "" {
+		fmt.Printf("Estimated cost with %v: %v\n", e.Model, formatCost(e.Model, e.Tokens, 0))
+	}
+}
+
+// Print what sending the messages with context to the chat model would cost.
+// Finding the context would embed the question, so it is counted as large as
+// the context budget. The answer is not known yet, its cost is given for max_tokens.
+func PrintChatEstimate(messages []Message) {
+	prompt := config.ContextBudget
+	for _, message := range messages {
+		prompt += EstimateTokens(message.Content)
+	}
+	fmt.Printf("\nDry run, the question was neither embedded nor sent:\n")
+	fmt.Printf("%v messages with up to %v tokens of context, at most %v tokens\n", len(messages), config.ContextBudget, prompt)
+	fmt.Printf("The answer has at most %v tokens\n", config.MaxTokens)
+	if model := chatModel(); model != "" {
+		fmt.Printf("Estimated cost with %v: at most %v for the question and %v with the answer\n",
+			model, formatCost(model, prompt, 0), formatCost(model, prompt, config.MaxTokens))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateEmbeddingSendsNothing(t *testing.T) {
+	// A provider without a server fails if anything is sent
+	real := &OpenAIProvider{EmbedModel: "text-embedding-3-small"}
+	previous, previousConfig := provider, config
+	provider = real
+	config.Chunker = "lines"
+	config.ChunkSize = 2
+	config.ChunkOverlap = 0
+	t.Cleanup(func() { provider, config = previous, previousConfig })
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"new.txt":       "one\ntwo\nthree\n",
+		"unchanged.txt": "same\n",
+		"image.bin":     "\x00\x01\x02binary",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unchanged := filepath.Join(dir, "unchanged.txt")
+	info, _ := os.Stat(unchanged)
+	sources := map[string]Source{unchanged: {Path: unchanged, Hash: hashContent("same\n"), Size: info.Size(), ModTime: info.ModTime()}}
+	paths := CollectFiles(dir, WalkOptions{})
+	estimate := EstimateEmbedding(paths, ReadFile, sources)
+	if provider != real {
+		t.Fatal("the provider was not restored")
+	}
+	if estimate.Summary[SourceAdded] != 1 || estimate.Summary[SourceUnchanged] != 1 || estimate.Summary[SourceSkipped] != 1 {
+		t.Fatalf("unexpected summary %v", estimate.Summary)
+	}
+	if estimate.Chunks != 2 || estimate.Requests != 1 || estimate.Tokens != EstimateTokens("one\ntwo\n")+EstimateTokens("three\n") {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+	if estimate.Model != "text-embedding-3-small" || formatCost(estimate.Model, 1e6, 0) != "$0.0200" {
+		t.Fatalf("unexpected model %v", estimate.Model)
+	}
+	// A binary embedded by an older version is only counted as removed
+	image := filepath.Join(dir, "image.bin")
+	sources[image] = Source{Path: image}
+	estimate = EstimateEmbedding(paths, ReadFile, sources)
+	if estimate.Summary[SourceSkipped] != 0 || len(estimate.Removed) != 1 || estimate.Removed[0] != image {
+		t.Fatalf("expected %v to be removed and not skipped, got %v, %v", image, estimate.Summary, estimate.Removed)
+	}
+}
+
+func TestAskQuestionDryRunDoesNotSendTheQuestion(t *testing.T) {
+	fake := &fakeProvider{vectors: map[string][]float64{"question": {1, 0}}, answer: "answer"}
+	useFakeProvider(t, fake)
+	collection, err := OpenCollection("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Add([]Embedding{{File: "notes.txt", Content: "the question is answered here", Vector: []float64{1, 0}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AskQuestion("question", []*Collection{collection}, nil, false, Filter{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if fake.messages != nil || fake.embedded != nil {
+		t.Fatalf("the question was sent: %+v, %v", fake.messages, fake.embedded)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Text of a file and where its pages start, for formats that have pages
+type Document struct {
+	Text  string
+	Pages []int // byte offset in Text of the start of every page, nil without pages
+}
+
+// An Extractor turns the bytes of a file into the text that is chunked and embedded
+type Extractor func(path string, content []byte) (Document, error)
+
+// Extractor of a format without pages
+func textExtractor(extract func(path string, content []byte) (string, error)) Extractor {
+	return func(path string, content []byte) (Document, error) {
+		text, err := extract(path, content)
+		return Document{Text: text}, err
+	}
+}
+
+// Returned for files that have no extractor and are not text, they are skipped
+var ErrBinaryFile = errors.New("binary file")
+
+// Extractors by lower case extension and by media type.
+// Extensions are tried first, because zip based formats all sniff as application/zip.
+var (
+	extensionExtractors = map[string]Extractor{}
+	typeExtractors      = map[string]Extractor{}
+)
+
+func init() {
+	RegisterExtractor(textExtractor(extractHTMLFile), ".html", ".htm", ".xhtml", "text/html", "application/xhtml+xml")
+	RegisterExtractor(extractPDF, ".pdf", "application/pdf")
+	RegisterExtractor(textExtractor(extractDocx), ".docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document")
+	RegisterExtractor(textExtractor(extractEpub), ".epub", "application/epub+zip")
+	RegisterExtractor(textExtractor(extractNotebook), ".ipynb", "application/x-ipynb+json")
+	RegisterExtractor(textExtractor(extractCSV), ".csv", ".tsv", "text/csv", "text/tab-separated-values")
+	RegisterExtractor(textExtractor(extractJSON), ".json", ".jsonl", ".ndjson", "application/json", "application/x-ndjson")
+	RegisterExtractor(textExtractor(extractText), "application/xml", "application/javascript", "application/x-yaml", "application/yaml")
+}
+
+// Use extractor for the extensions (starting with a dot) and media types in keys.
+// Later registrations replace earlier ones, so the built in extractors can be replaced.
+func RegisterExtractor(extractor Extractor, keys ...string) {
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, ".") {
+			extensionExtractors[key] = extractor
+		} else {
+			typeExtractors[key] = extractor
+		}
+	}
+}
+
+// Extract the text of a file. The extractor is picked by the extension of the path,
+// then by the media type, which is sniffed from the content when it is not known.
+// Text without an extractor is kept as it is, anything else fails with ErrBinaryFile.
+func Extract(path string, content []byte, mediaType string) (Document, error) {
+	if extractor, ok := extensionExtractors[extensionOf(path)]; ok {
+		return extractor(path, content)
+	}
+	mediaType, _, _ = mime.ParseMediaType(mediaType)
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(content))
+	}
+	if extractor, ok := typeExtractors[mediaType]; ok {
+		return extractor(path, content)
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return textExtractor(extractText)(path, content)
+	}
+	return Document{}, fmt.Errorf("%w: %v is %v", ErrBinaryFile, path, mediaType)
+}
+
+// Lower case extension of a file or of the path of a url
+func extensionOf(path string) string {
+	if isURL(path) {
+		if parsed, err := url.Parse(path); err == nil {
+			path = parsed.Path
+		}
+	}
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// Text with unix line endings that ends with a newline
+func extractText(path string, content []byte) (string, error) {
+	text := strings.ToValidUTF8(strings.ReplaceAll(string(content), "\r\n", "\n"), "�")
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text, nil
+}
+
+// An extractor that pipes the file through a command and uses what it prints,
+// like "pandoc --to plain" or "pdftotext - -"
+func CommandExtractor(command string) Extractor {
+	fields := strings.Fields(command)
+	return textExtractor(func(path string, content []byte) (string, error) {
+		if len(fields) == 0 {
+			return "", fmt.Errorf("%w: empty extractor command for %v", ErrUsage, path)
+		}
+		cmd := exec.Command(fields[0], fields[1:]...)
+		cmd.Stdin = bytes.NewReader(content)
+		output, err := cmd.Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%v failed for %v: %v", fields[0], path, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		if err != nil {
+			return "", fmt.Errorf("%v failed for %v: %w", fields[0], path, err)
+		}
+		return extractText(path, output)
+	})
+}
+
+func extractHTMLFile(path string, content []byte) (string, error) {
+	document, err := ExtractHTML(string(content), path)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	return document.Text, nil
+}
+
+func readZipFile(archive *zip.Reader, name string) ([]byte, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Paragraphs of word/document.xml. Headings get a # per level,
+// list items a dash and table rows separate their cells with |.
+func extractDocx(path string, content []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open docx %v: %w", path, err)
+	}
+	document, err := readZipFile(archive, "word/document.xml")
+	if err != nil {
+		return "", fmt.Errorf("failed to read docx %v: %w", path, err)
+	}
+	var text, paragraph, row, cell strings.Builder
+	heading, listItem, inRun, inText, tables, cells := 0, false, false, false, 0, 0
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse docx %v: %w", path, err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "p":
+				paragraph.Reset()
+				heading, listItem = 0, false
+			case "pStyle":
+				heading = headingLevel(xmlAttribute(token, "val"))
+			case "numPr":
+				listItem = true
+			case "r":
+				inRun = true
+			case "t":
+				inText = inRun
+			case "tab":
+				if inRun {
+					paragraph.WriteString("\t")
+				}
+			case "br", "cr":
+				if inRun {
+					paragraph.WriteString("\n")
+				}
+			case "tbl":
+				tables++
+			case "tr":
+				row.Reset()
+				cells = 0
+			case "tc":
+				cell.Reset()
+			}
+		case xml.CharData:
+			if inText {
+				paragraph.Write(token)
+			}
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "r":
+				inRun = false
+			case "t":
+				inText = false
+			case "p":
+				line := strings.TrimSpace(paragraph.String())
+				switch {
+				case line == "":
+				case tables > 0:
+					cell.WriteString(line + " ")
+				case heading > 0:
+					text.WriteString("\n" + strings.Repeat("#", heading) + " " + line + "\n\n")
+				case listItem:
+					text.WriteString("- " + line + "\n")
+				default:
+					text.WriteString("\n" + line + "\n\n")
+				}
+			case "tc":
+				if cells > 0 {
+					row.WriteString(" | ")
+				}
+				row.WriteString(strings.TrimSpace(cell.String()))
+				cells++
+			case "tr":
+				text.WriteString(strings.TrimSpace(row.String()) + "\n")
+			case "tbl":
+				tables--
+				text.WriteString("\n")
+			}
+		}
+	}
+	return cleanText(text.String()), nil
+}
+
+// Level of a Word paragraph style like Heading2 or Title, 0 for other styles
+func headingLevel(style string) int {
+	style = strings.ToLower(style)
+	if style == "title" {
+		return 1
+	}
+	level, err := strconv.Atoi(strings.TrimPrefix(style, "heading"))
+	if !strings.HasPrefix(style, "heading") || err != nil || level < 1 {
+		return 0
+	}
+	return min(level, 6)
+}
+
+func xmlAttribute(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// The chapters of an epub in reading order, as listed in the spine of its package
+func extractEpub(path string, content []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open epub %v: %w", path, err)
+	}
+	containerXML, err := readZipFile(archive, "META-INF/container.xml")
+	if err != nil {
+		return "", fmt.Errorf("failed to read epub %v: %w", path, err)
+	}
+	var container struct {
+		Rootfiles []struct {
+			Path string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(containerXML, &container); err != nil || len(container.Rootfiles) == 0 {
+		return "", fmt.Errorf("failed to read epub %v: no package in META-INF/container.xml", path)
+	}
+	packagePath := container.Rootfiles[0].Path
+	packageXML, err := readZipFile(archive, packagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read epub %v: %w", path, err)
+	}
+	var epubPackage struct {
+		Items []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := xml.Unmarshal(packageXML, &epubPackage); err != nil {
+		return "", fmt.Errorf("failed to parse epub %v: %w", path, err)
+	}
+	hrefs := map[string]string{}
+	for _, item := range epubPackage.Items {
+		hrefs[item.ID] = item.Href
+	}
+	var text strings.Builder
+	for _, itemRef := range epubPackage.Spine {
+		href, err := url.PathUnescape(hrefs[itemRef.IDRef])
+		if err != nil || href == "" {
+			continue
+		}
+		chapter, err := readZipFile(archive, pathpkg.Join(pathpkg.Dir(packagePath), href))
+		if err != nil {
+			return "", fmt.Errorf("failed to read epub %v: %w", path, err)
+		}
+		document, err := ExtractHTML(string(chapter), "")
+		if err != nil {
+			return "", fmt.Errorf("failed to parse epub %v: %w", path, err)
+		}
+		text.WriteString(document.Text + "\n")
+	}
+	return cleanText(text.String()), nil
+}
+
+// Source of a notebook cell, either one string or a list of lines
+type notebookSource string
+
+func (s *notebookSource) UnmarshalJSON(data []byte) error {
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err == nil {
+		*s = notebookSource(strings.Join(lines, ""))
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	*s = notebookSource(text)
+	return nil
+}
+
+// Markdown cells as they are and code cells fenced with the language of the
+// notebook. Outputs are left out, they are mostly numbers, tables and images.
+func extractNotebook(path string, content []byte) (string, error) {
+	var notebook struct {
+		Cells []struct {
+			Type   string         `json:"cell_type"`
+			Source notebookSource `json:"source"`
+		} `json:"cells"`
+		Metadata struct {
+			Kernel struct {
+				Language string `json:"language"`
+			} `json:"kernelspec"`
+			Language struct {
+				Name string `json:"name"`
+			} `json:"language_info"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(content, &notebook); err != nil {
+		return "", fmt.Errorf("failed to parse notebook %v: %w", path, err)
+	}
+	language := notebook.Metadata.Language.Name
+	if language == "" {
+		language = notebook.Metadata.Kernel.Language
+	}
+	var cells []string
+	for _, cell := range notebook.Cells {
+		source := strings.Trim(string(cell.Source), "\n")
+		if strings.TrimSpace(source) == "" {
+			continue
+		}
+		if cell.Type == "code" {
+			source = "```" + language + "\n" + source + "\n```"
+		}
+		cells = append(cells, source)
+	}
+	return extractText(path, []byte(strings.Join(cells, "\n\n")))
+}
+
+// One line per record that names every value with its column,
+// so a chunk of rows still says what the values are
+func extractCSV(path string, content []byte) (string, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	if extensionOf(path) == ".tsv" {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse csv %v: %w", path, err)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	header := records[0]
+	var text strings.Builder
+	for _, record := range records[1:] {
+		var values []string
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			column := "column " + strconv.Itoa(i+1)
+			if i < len(header) && strings.TrimSpace(header[i]) != "" {
+				column = strings.TrimSpace(header[i])
+			}
+			values = append(values, column+": "+value)
+		}
+		text.WriteString(strings.Join(values, ", ") + "\n")
+	}
+	return text.String(), nil
+}
+
+// One line per value with the keys that lead to it, like items[2].name: pen.
+// Files with more than one value, like json lines, get a paragraph per value.
+func extractJSON(path string, content []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var values []string
+	for decoder.More() {
+		var lines []string
+		if err := flattenJSON(decoder, "", &lines); err != nil {
+			return "", fmt.Errorf("failed to parse json %v: %w", path, err)
+		}
+		values = append(values, strings.Join(lines, "\n"))
+	}
+	return extractText(path, []byte(strings.Join(values, "\n\n")))
+}
+
+// Read the next value of the decoder, keeping the order of the keys
+func flattenJSON(decoder *json.Decoder, key string, lines *[]string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		if token == nil {
+			token = "null"
+		}
+		if key == "" {
+			*lines = append(*lines, fmt.Sprint(token))
+		} else {
+			*lines = append(*lines, fmt.Sprintf("%v: %v", key, token))
+		}
+		return nil
+	}
+	for i := 0; decoder.More(); i++ {
+		child := fmt.Sprintf("%v[%v]", key, i)
+		if delim == '{' {
+			name, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			child = fmt.Sprint(name)
+			if key != "" {
+				child = key + "." + child
+			}
+		}
+		if err := flattenJSON(decoder, child, lines); err != nil {
+			return err
+		}
+	}
+	// The closing } or ]
+	_, err = decoder.Token()
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A zip archive with the given files, for docx and epub
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range files {
+		file, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestExtractDocuments(t *testing.T) {
+	docx := zipFiles(t, map[string]string{"word/document.xml": `<w:document xmlns:w="w"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading2"/><w:tabs><w:tab w:val="left"/></w:tabs></w:pPr><w:r><w:t>Setup</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Run the </w:t></w:r><w:r><w:t>installer.</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr/></w:pPr><w:r><w:t>First</w:t></w:r></w:p>
+<w:tbl><w:tr><w:tc><w:p><w:r><w:t>Key</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Value</w:t></w:r></w:p></w:tc></w:tr></w:tbl>
+</w:body></w:document>`})
+	epub := zipFiles(t, map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="OEBPS/content.opf"/></rootfiles></container>`,
+		"OEBPS/content.opf": `<package><manifest><item id="b" href="two.xhtml"/><item id="a" href="text/one%20a.xhtml"/></manifest>
+<spine><itemref idref="a"/><itemref idref="b"/></spine></package>`,
+		"OEBPS/text/one a.xhtml": `<html><body><h1>One</h1><p>Start.</p></body></html>`,
+		"OEBPS/two.xhtml":        `<html><body><h1>Two</h1><script>x()</script></body></html>`,
+	})
+	notebook := `{"metadata": {"language_info": {"name": "python"}}, "cells": [
+{"cell_type": "markdown", "source": ["# Plot\n", "Draw it."]},
+{"cell_type": "code", "source": "plot(x)\n", "outputs": [{"text": "42"}]}]}`
+	for _, test := range []struct {
+		path     string
+		content  []byte
+		expected string
+	}{
+		{"report.docx", docx, "## Setup\n\nRun the installer.\n\n- First\nKey | Value\n"},
+		{"book.epub", epub, "# One\n\nStart.\n\n# Two\n"},
+		{"analysis.ipynb", []byte(notebook), "# Plot\nDraw it.\n\n```python\nplot(x)\n```\n"},
+		{"people.csv", []byte("name,team,\r\nAda,infra,x\nBob,,\n"), "name: Ada, team: infra, column 3: x\nname: Bob\n"},
+		{"config.json", []byte(`{"name": "api", "ports": [80, 443], "tls": {"on": true}, "note": null}`), "name: api\nports[0]: 80\nports[1]: 443\ntls.on: true\nnote: null\n"},
+		{"events.jsonl", []byte("{\"id\": 1}\n{\"id\": 2}\n"), "id: 1\n\nid: 2\n"},
+		{"page.htm", []byte("<p>Hello <b>world</b></p>"), "Hello world\n"},
+		{"notes", []byte("plain\r\ntext"), "plain\ntext\n"},
+	} {
+		document, err := Extract(test.path, test.content, "")
+		if err != nil {
+			t.Fatalf("%v: %v", test.path, err)
+		}
+		if document.Text != test.expected || document.Pages != nil {
+			t.Errorf("%v: unexpected text %q", test.path, document.Text)
+		}
+	}
+}
+
+func TestExtractSkipsBinaryFiles(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if _, err := Extract("logo.png", png, ""); !errors.Is(err, ErrBinaryFile) {
+		t.Fatalf("expected ErrBinaryFile, got %v", err)
+	}
+	// The media type of the server is used when the url has no known extension
+	if document, err := Extract("https://example.com/api", []byte(`{"ok": true}`), "application/json; charset=utf-8"); err != nil || document.Text != "ok: true\n" {
+		t.Fatalf("unexpected text %q: %v", document.Text, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	os.WriteFile(path, []byte{0, 1, 2, 3}, 0644)
+	result := CheckSource(path, Source{}, false, ReadFile)
+	if result.Status != SourceSkipped {
+		t.Fatalf("expected the binary file to be skipped, got %v: %v", result.Status, result.Err)
+	}
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	defer delete(extensionExtractors, ".shout")
+	RegisterExtractor(CommandExtractor("tr a-z A-Z"), ".SHOUT")
+	document, err := Extract("notes.shout", []byte("quiet"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Text != "QUIET\n" {
+		t.Fatalf("unexpected text %q", document.Text)
+	}
+}
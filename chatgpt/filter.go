@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Filter restricts a question to some of the sources of a collection.
+// Values of the same key are alternatives, different keys must all match.
+type Filter struct {
+	Paths []string            // globs, ** matches any number of folders
+	Types []string            // file extensions without the dot, like pdf
+	Tags  map[string][]string // tags given with --tag when the source was embedded
+	Since time.Time           // embedded at or after, ignored when zero
+	Until time.Time           // embedded before, ignored when zero
+}
+
+// Parse filters of the form key=value. The keys path and type are built in,
+// every other key is the name of a tag.
+func ParseFilter(expressions []string, since string, until string) (Filter, error) {
+	var filter Filter
+	for _, expression := range expressions {
+		key, value, ok := strings.Cut(expression, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return filter, fmt.Errorf("%w: invalid filter %q, expected key=value", ErrUsage, expression)
+		}
+		switch key {
+		case "path":
+			if _, err := globPattern(value); err != nil {
+				return filter, fmt.Errorf("%w: invalid path filter %q: %v", ErrUsage, value, err)
+			}
+			filter.Paths = append(filter.Paths, value)
+		case "type":
+			filter.Types = append(filter.Types, strings.ToLower(strings.TrimPrefix(value, ".")))
+		default:
+			if filter.Tags == nil {
+				filter.Tags = map[string][]string{}
+			}
+			filter.Tags[key] = append(filter.Tags[key], value)
+		}
+	}
+	var err error
+	if filter.Since, err = parseDate(since); err != nil {
+		return filter, fmt.Errorf("%w: invalid --since: %v", ErrUsage, err)
+	}
+	if filter.Until, err = parseDate(until); err != nil {
+		return filter, fmt.Errorf("%w: invalid --until: %v", ErrUsage, err)
+	}
+	return filter, nil
+}
+
+// Dates like 2024-01-01 or full RFC 3339 times, an empty date is zero
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// True if the filter lets every source through
+func (f Filter) Empty() bool {
+	return len(f.Paths) == 0 && len(f.Types) == 0 && len(f.Tags) == 0 && f.Since.IsZero() && f.Until.IsZero()
+}
+
+func (f Filter) Match(source Source) bool {
+	if len(f.Paths) > 0 && !matchAny(f.Paths, func(glob string) bool { return matchPath(glob, source.Path) }) {
+		return false
+	}
+	if len(f.Types) > 0 && !matchAny(f.Types, func(fileType string) bool { return fileType == sourceType(source.Path) }) {
+		return false
+	}
+	for key, values := range f.Tags {
+		if !matchAny(values, func(value string) bool { return source.Tags[key] == value }) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && source.Embedded.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !source.Embedded.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func matchAny(values []string, match func(value string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extension of the file without the dot. Websites without one are html.
+func sourceType(file string) string {
+	if isURL(file) {
+		if parsed, err := url.Parse(file); err == nil {
+			file = parsed.Path
+		}
+		if path.Ext(file) == "" {
+			return "html"
+		}
+	}
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(file), "."))
+}
+
+// Sources are saved with absolute paths, so a relative glob matches the end
+// of the path: docs/** matches every file below any folder named docs.
+// Absolute globs and urls have to match the whole path.
+func matchPath(glob string, file string) bool {
+	pattern, err := globPattern(glob)
+	if err != nil {
+		return false
+	}
+	if isURL(glob) || filepath.IsAbs(glob) || isURL(file) {
+		return pattern.MatchString(filepath.ToSlash(file))
+	}
+	parts := strings.Split(filepath.ToSlash(file), "/")
+	for i := range parts {
+		if pattern.MatchString(strings.Join(parts[i:], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Translate a glob into a regular expression. * and ? stay within a folder,
+// ** also crosses folders and [a-z] matches one of the characters.
+func globPattern(glob string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	glob = filepath.ToSlash(glob)
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			pattern.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		case glob[i] == '[' && strings.Contains(glob[i+1:], "]"):
+			// A class like [abc], [a-z] or [!0-9]
+			end := i + 1 + strings.Index(glob[i+1:], "]")
+			class := strings.ReplaceAll(glob[i+1:end], `\`, `\\`)
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			pattern.WriteString("[" + class + "]")
+			i = end
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+// Ids of the records whose source matches the filter, nil if the filter is empty.
+// Records without a source never match a filter.
+func (ix *VectorIndex) FilterIds(filter Filter) map[int]bool {
+	if filter.Empty() {
+		return nil
+	}
+	allowed := map[int]bool{}
+	for _, source := range ix.sources {
+		if filter.Match(source) {
+			for _, id := range source.Ids {
+				allowed[id] = true
+			}
+		}
+	}
+	return allowed
+}
+
+// Parse tags of the form key=value given with --tag
+func ParseTags(expressions []string) (map[string]string, error) {
+	if len(expressions) == 0 {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	for _, expression := range expressions {
+		key, value, ok := strings.Cut(expression, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%w: invalid tag %q, expected key=value", ErrUsage, expression)
+		}
+		if key == "path" || key == "type" {
+			return nil, fmt.Errorf("%w: tag %q is reserved for the filter of the same name", ErrUsage, key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// Tags in the key=value form, sorted by key
+func FormatTags(tags map[string]string) string {
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
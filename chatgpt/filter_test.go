@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestMatchPathGlobs(t *testing.T) {
+	for _, test := range []struct {
+		glob  string
+		file  string
+		match bool
+	}{
+		{"docs/**", "/home/me/project/docs/setup/install.md", true},
+		{"docs/*.md", "/home/me/project/docs/setup/install.md", false},
+		{"**/*.go", "/home/me/project/chatgpt/main.go", true},
+		{"*.go", "/home/me/project/chatgpt/main.go", true},
+		{"/home/me/project/*", "/home/me/project/chatgpt/main.go", false},
+		{"https://go.dev/doc/**", "https://go.dev/doc/effective_go", true},
+	} {
+		if matchPath(test.glob, test.file) != test.match {
+			t.Errorf("matchPath(%q, %q) should be %v", test.glob, test.file, test.match)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter([]string{"path=docs/**", "type=.PDF", "team=infra", "team=web"}, "2024-01-01", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter.Paths) != 1 || filter.Types[0] != "pdf" || len(filter.Tags["team"]) != 2 || filter.Since.Year() != 2024 {
+		t.Fatalf("unexpected filter %+v", filter)
+	}
+	source := Source{Path: "/p/docs/manual.pdf", Embedded: time.Now(), Tags: map[string]string{"team": "web"}}
+	if !filter.Match(source) {
+		t.Fatal("expected the source to match")
+	}
+	source.Tags["team"] = "sales"
+	if filter.Match(source) {
+		t.Fatal("expected the tag to exclude the source")
+	}
+	if _, err := ParseFilter([]string{"docs"}, "", ""); err == nil {
+		t.Fatal("expected an error for a filter without value")
+	}
+	if _, err := ParseFilter(nil, "last week", ""); err == nil {
+		t.Fatal("expected an error for an invalid date")
+	}
+}
+
+func TestSearchOnlyRanksMatchingSources(t *testing.T) {
+	collection, err := OpenCollection("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = collection.ReplaceSource(Source{Path: "/p/notes.txt", Embedded: time.Now()}, []Embedding{
+		{File: "/p/notes.txt", Content: "deploy the service", Vector: []float64{1, 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = collection.ReplaceSource(Source{Path: "/p/docs/deploy.md", Embedded: time.Now(), Tags: map[string]string{"team": "infra"}}, []Embedding{
+		{File: "/p/docs/deploy.md", Content: "how to deploy", Vector: []float64{0, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collections := []*Collection{collection}
+	for _, filter := range []Filter{{Paths: []string{"docs/**"}}, {Types: []string{"md"}}, {Tags: map[string][]string{"team": {"infra"}}}} {
+		results, err := SearchCollections(collections, []float64{1, 0}, 2, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Embedding.File != "/p/docs/deploy.md" {
+			t.Fatalf("unexpected vector results for %+v: %+v", filter, results)
+		}
+		results, err = SearchKeywords(collections, "deploy", 2, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Embedding.File != "/p/docs/deploy.md" {
+			t.Fatalf("unexpected keyword results for %+v: %+v", filter, results)
+		}
+	}
+	results, err := SearchCollections(collections, []float64{1, 0}, 2, Filter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("expected no results embedded in the future, got %+v", results)
+	}
+}
+
+func TestFilterFlagsAreNotSplitOnCommas(t *testing.T) {
+	var filters, tags repeatedList
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&filters, "filter", "")
+	flags.Var(&tags, "tag", "")
+	if err := flags.Parse([]string{"--filter", "path=docs/[ab],c/*", "--filter", "team=infra", "--tag", "owners=ann,bob"}); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := ParseFilter(filters, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter.Paths) != 1 || filter.Paths[0] != "docs/[ab],c/*" || filter.Tags["team"][0] != "infra" {
+		t.Fatalf("unexpected filter %+v", filter)
+	}
+	if parsed, err := ParseTags(tags); err != nil || parsed["owners"] != "ann,bob" {
+		t.Fatalf("unexpected tags %v, %v", parsed, err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Text of a web page with the parts a crawler needs
+type HTMLDocument struct {
+	Text      string   // markdown-like text, headings start with # and code is fenced
+	Links     []string // absolute urls of the links, without fragments
+	Canonical string   // url of <link rel="canonical">, empty if the page has none
+}
+
+// Elements that hold no text worth embedding
+var skippedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Iframe:   true,
+	atom.Nav:      true,
+	atom.Footer:   true,
+	atom.Form:     true,
+	atom.Button:   true,
+}
+
+// Elements that start on a new line
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.Header: true, atom.Aside: true, atom.Blockquote: true, atom.Ul: true, atom.Ol: true,
+	atom.Table: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Figure: true, atom.Figcaption: true, atom.Hr: true, atom.Br: true,
+}
+
+var headingLevels = map[atom.Atom]int{atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6}
+
+var (
+	spacePattern      = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// Extract the readable text of a page. Scripts, styles and navigation are
+// dropped, headings and code blocks are kept so the chunkers can use them.
+// Relative links are resolved against pageURL.
+func ExtractHTML(content string, pageURL string) (HTMLDocument, error) {
+	var document HTMLDocument
+	root, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return document, err
+	}
+	base, _ := url.Parse(pageURL)
+	// Remember the base, canonical and links of the element
+	visitLinks := func(node *html.Node) {
+		switch node.DataAtom {
+		case atom.Base:
+			if href := attribute(node, "href"); href != "" && base != nil {
+				if resolved, err := base.Parse(href); err == nil {
+					base = resolved
+				}
+			}
+		case atom.Link:
+			if strings.EqualFold(attribute(node, "rel"), "canonical") {
+				document.Canonical = resolveLink(base, attribute(node, "href"))
+			}
+		case atom.A:
+			if link := resolveLink(base, attribute(node, "href")); link != "" {
+				document.Links = append(document.Links, link)
+			}
+		}
+	}
+	var onlyLinks func(node *html.Node)
+	onlyLinks = func(node *html.Node) {
+		visitLinks(node)
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			onlyLinks(child)
+		}
+	}
+	var text strings.Builder
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			text.WriteString(spacePattern.ReplaceAllString(node.Data, " "))
+			return
+		}
+		if node.Type != html.ElementNode && node.Type != html.DocumentNode {
+			return
+		}
+		visitLinks(node)
+		switch node.DataAtom {
+		case atom.Pre:
+			text.WriteString("\n\n```\n" + strings.Trim(nodeText(node), "\n") + "\n```\n\n")
+			return
+		case atom.Code:
+			text.WriteString("`" + strings.TrimSpace(nodeText(node)) + "`")
+			return
+		}
+		// The head holds the canonical link and base, and the navigation
+		// links to the other pages, so only their text is skipped
+		if skippedElements[node.DataAtom] {
+			switch node.DataAtom {
+			case atom.Head, atom.Nav, atom.Footer:
+				onlyLinks(node)
+			}
+			return
+		}
+		if level, ok := headingLevels[node.DataAtom]; ok {
+			heading := strings.TrimSpace(spacePattern.ReplaceAllString(nodeText(node), " "))
+			text.WriteString("\n\n" + strings.Repeat("#", level) + " " + heading + "\n\n")
+			return
+		}
+		block := blockElements[node.DataAtom]
+		if block {
+			text.WriteString("\n")
+		}
+		// Items and rows only start a line, so lists and tables stay together
+		switch node.DataAtom {
+		case atom.Li:
+			text.WriteString("\n- ")
+		case atom.Tr:
+			text.WriteString("\n")
+		case atom.Td, atom.Th:
+			text.WriteString(" | ")
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if block {
+			text.WriteString("\n")
+		}
+	}
+	walk(root)
+	document.Text = cleanText(text.String())
+	return document, nil
+}
+
+// Trim the spaces around every line and leave at most one blank line
+func cleanText(text string) string {
+	lines := strings.Split(text, "\n")
+	inCode := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			lines[i] = strings.TrimSpace(line)
+			continue
+		}
+		if !inCode {
+			lines[i] = strings.TrimSpace(line)
+		}
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")) + "\n"
+}
+
+// All text below the node as it is written, for code blocks
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var text strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.DataAtom == atom.Br {
+			text.WriteString("\n")
+			continue
+		}
+		text.WriteString(nodeText(child))
+	}
+	return text.String()
+}
+
+func attribute(node *html.Node, name string) string {
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, name) {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+// Absolute http or https url of a link, empty for mailto, javascript and broken links
+func resolveLink(base *url.URL, href string) string {
+	if href == "" || base == nil {
+		return ""
+	}
+	link, err := base.Parse(href)
+	if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+		return ""
+	}
+	link.Fragment = ""
+	return link.String()
+}
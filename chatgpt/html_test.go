@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtractHTMLKeepsHeadingsAndCode(t *testing.T) {
+	page := `<html><head><title>Docs</title><link rel="canonical" href="/docs/"><script>var x = 1;</script></head>
+<body><nav><a href="/">Home</a></nav>
+<h1>Setup</h1><p>Install   the <code>chatgpt</code> tool.</p>
+<pre>go build
+  ./chatgpt --embed docs</pre>
+<ul><li>First</li><li>Second <a href="next.html#part">next</a></li></ul>
+<a href="mailto:me@example.com">mail</a>
+<footer>Copyright</footer></body></html>`
+	document, err := ExtractHTML(page, "https://example.com/docs/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Setup\n\nInstall the `chatgpt` tool.\n\n```\ngo build\n  ./chatgpt --embed docs\n```\n\n- First\n- Second next\nmail\n"
+	if document.Text != expected {
+		t.Fatalf("unexpected text %q", document.Text)
+	}
+	if document.Canonical != "https://example.com/docs/" {
+		t.Fatalf("unexpected canonical %q", document.Canonical)
+	}
+	links := strings.Join(document.Links, " ")
+	if links != "https://example.com/ https://example.com/docs/next.html" {
+		t.Fatalf("unexpected links %q", links)
+	}
+}
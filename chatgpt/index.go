@@ -0,0 +1,891 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The index is a folder with these files:
+//
+//	vectors.f32    header followed by one little endian float32 vector per record
+//	meta.jsonl     one json line per record with everything but the vector
+//	meta.idx       int64 offset of every record in meta.jsonl
+//	manifest.json  dimensions, metric and deleted records
+//	ivf.bin        centroids of the IVF clustering and the list of every record,
+//	               only once the index is large enough
+//
+// Records are only ever appended. Deleting marks the record in the manifest
+// and Compact rewrites the files without the deleted records. The manifest is
+// saved last, so whatever an interrupted Add wrote past its Count is cut off.
+const (
+	indexVersion     = 1
+	vectorsFileName  = "vectors.f32"
+	metaFileName     = "meta.jsonl"
+	metaIdxFileName  = "meta.idx"
+	manifestFileName = "manifest.json"
+	ivfFileName      = "ivf.bin"
+	vectorsMagic     = "VEC1"
+	vectorsHeaderLen = 8 // magic + uint32 dimensions
+	ivfMagic         = "IVF1"
+	ivfHeaderLen     = 16 // magic + uint32 lists, dimensions and trained at
+	// Below this many vectors a flat scan is fast enough
+	ivfMinVectors = 2048
+	ivfIterations = 10
+	ivfProbes     = 8
+)
+
+// Clustering of the vectors for approximate nearest neighbour search.
+// Every list holds the ids of the records closest to its centroid.
+type ivf struct {
+	Centroids [][]float32
+	Lists     [][]int
+	TrainedAt int // number of live records when the clustering was trained
+}
+
+type indexManifest struct {
+	Version int
+	Dim     int
+	Metric  Metric `json:",omitempty"`
+	Count   int    // records written, including deleted ones
+	Deleted []int  // sorted ids of deleted records
+	IVF     *ivf   `json:",omitempty"` // only in manifests of older versions, it moved to ivf.bin
+}
+
+// One record of the index: the embedding without its vector
+type indexRecord struct {
+	Id int
+	Embedding
+}
+
+// A VectorIndex stores embeddings on disk and searches them
+// without loading all vectors into memory.
+type VectorIndex struct {
+	dir      string
+	manifest indexManifest
+	deleted  map[int]bool
+	sources  map[string]Source
+	ivf      *ivf // nil until the index is large enough, lists leave out deleted records
+}
+
+// Folder next to the index for compacting it. The leading dot keeps it
+// from being taken for a collection.
+func siblingDir(dir string, suffix string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+"."+suffix)
+}
+
+// Open the index in dir, creating the folder if it does not exist yet
+func OpenIndex(dir string) (*VectorIndex, error) {
+	// A Compact that was interrupted while swapping the folders left the old index behind
+	previous := siblingDir(dir, "old")
+	if _, err := os.Stat(previous); err == nil {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if err := os.Rename(previous, dir); err != nil {
+				return nil, fmt.Errorf("failed to restore index: %w", err)
+			}
+		} else {
+			os.RemoveAll(previous)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index folder: %w", err)
+	}
+	ix := &VectorIndex{dir: dir, deleted: map[int]bool{}}
+	if err := ix.loadSources(); err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(ix.path(manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		ix.manifest.Version = indexVersion
+		ix.manifest.Metric = defaultMetric
+		return ix, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index manifest: %w", err)
+	}
+	if err := json.Unmarshal(content, &ix.manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse index manifest: %w", err)
+	}
+	if ix.manifest.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %v", ix.manifest.Version)
+	}
+	// Indexes written before metrics existed hold raw vectors compared with L2
+	if ix.manifest.Metric == "" {
+		ix.manifest.Metric = MetricL2
+	}
+	for _, id := range ix.manifest.Deleted {
+		ix.deleted[id] = true
+	}
+	if ix.manifest.IVF != nil {
+		ix.ivf = ix.manifest.IVF
+		ix.manifest.IVF = nil
+		if err := ix.saveIVF(); err != nil {
+			return nil, err
+		}
+		if err := ix.saveManifest(); err != nil {
+			return nil, err
+		}
+	} else if err := ix.loadIVF(); err != nil {
+		return nil, err
+	}
+	return ix, ix.truncate()
+}
+
+// Where the list of the first record is stored in ivf.bin
+func (ix *VectorIndex) ivfListsOffset() int64 {
+	return ivfHeaderLen + int64(len(ix.ivf.Centroids))*ix.recordSize()
+}
+
+// Read the clustering and build the lists of the records that are not deleted
+func (ix *VectorIndex) loadIVF() error {
+	content, err := os.ReadFile(ix.path(ivfFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read clustering: %w", err)
+	}
+	if len(content) < ivfHeaderLen || string(content[:4]) != ivfMagic ||
+		int(binary.LittleEndian.Uint32(content[8:])) != ix.manifest.Dim {
+		return fmt.Errorf("failed to read clustering: invalid %v", ivfFileName)
+	}
+	lists := int(binary.LittleEndian.Uint32(content[4:]))
+	ix.ivf = &ivf{
+		Centroids: make([][]float32, lists),
+		Lists:     make([][]int, lists),
+		TrainedAt: int(binary.LittleEndian.Uint32(content[12:])),
+	}
+	if int64(len(content)) < ix.ivfListsOffset()+int64(ix.manifest.Count)*4 {
+		return fmt.Errorf("failed to read clustering: %v is too short", ivfFileName)
+	}
+	for i := range ix.ivf.Centroids {
+		ix.ivf.Centroids[i] = make([]float32, ix.manifest.Dim)
+		decodeVector(content[ivfHeaderLen+int64(i)*ix.recordSize():], ix.ivf.Centroids[i])
+	}
+	for id := 0; id < ix.manifest.Count; id++ {
+		list := int(binary.LittleEndian.Uint32(content[ix.ivfListsOffset()+int64(id)*4:]))
+		if !ix.deleted[id] && list < lists {
+			ix.ivf.Lists[list] = append(ix.ivf.Lists[list], id)
+		}
+	}
+	return nil
+}
+
+// Write the whole clustering after it was trained. Add only writes the
+// lists of new records, so the manifest stays small.
+func (ix *VectorIndex) saveIVF() error {
+	content := make([]byte, ix.ivfListsOffset()+int64(ix.manifest.Count)*4)
+	copy(content, ivfMagic)
+	binary.LittleEndian.PutUint32(content[4:], uint32(len(ix.ivf.Centroids)))
+	binary.LittleEndian.PutUint32(content[8:], uint32(ix.manifest.Dim))
+	binary.LittleEndian.PutUint32(content[12:], uint32(ix.ivf.TrainedAt))
+	for i, centroid := range ix.ivf.Centroids {
+		encodeVector(centroid, content[ivfHeaderLen+int64(i)*ix.recordSize():])
+	}
+	for list, ids := range ix.ivf.Lists {
+		for _, id := range ids {
+			binary.LittleEndian.PutUint32(content[ix.ivfListsOffset()+int64(id)*4:], uint32(list))
+		}
+	}
+	tmp := ix.path(ivfFileName + ".tmp")
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write clustering: %w", err)
+	}
+	return os.Rename(tmp, ix.path(ivfFileName))
+}
+
+func (ix *VectorIndex) path(name string) string {
+	return filepath.Join(ix.dir, name)
+}
+
+// Number of records that are not deleted
+func (ix *VectorIndex) Len() int {
+	return ix.manifest.Count - len(ix.deleted)
+}
+
+// Dimensions of the stored vectors, 0 while the index is empty
+func (ix *VectorIndex) Dim() int {
+	return ix.manifest.Dim
+}
+
+// Metric used to compare the vectors of the index
+func (ix *VectorIndex) Metric() Metric {
+	return ix.manifest.Metric
+}
+
+// Change the metric of the index. The stored vectors are prepared for
+// their metric, so this is only possible while the index is empty.
+func (ix *VectorIndex) SetMetric(metric Metric) error {
+	if metric == ix.manifest.Metric {
+		return nil
+	}
+	if ix.manifest.Count > 0 {
+		return fmt.Errorf("index uses the %v metric and cannot be changed to %v", ix.manifest.Metric, metric)
+	}
+	ix.manifest.Metric = metric
+	return nil
+}
+
+func (ix *VectorIndex) saveManifest() error {
+	ix.manifest.Deleted = ix.manifest.Deleted[:0]
+	for id := range ix.deleted {
+		ix.manifest.Deleted = append(ix.manifest.Deleted, id)
+	}
+	sort.Ints(ix.manifest.Deleted)
+	content, err := json.Marshal(ix.manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index manifest: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves half a manifest
+	tmp := ix.path(manifestFileName + ".tmp")
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write index manifest: %w", err)
+	}
+	return os.Rename(tmp, ix.path(manifestFileName))
+}
+
+// Cut the files back to the records of the manifest. Vectors, lines and
+// offsets past Count were written by an Add that never saved the manifest,
+// the next Add would otherwise give their ids to other records.
+func (ix *VectorIndex) truncate() error {
+	metaEnd := int64(0)
+	if ix.manifest.Count > 0 {
+		offset, line, err := ix.metaLine(ix.manifest.Count - 1)
+		if err != nil {
+			return err
+		}
+		metaEnd = offset + int64(len(line))
+	}
+	sizes := map[string]int64{
+		vectorsFileName: ix.vectorOffset(ix.manifest.Count),
+		metaFileName:    metaEnd,
+		metaIdxFileName: int64(ix.manifest.Count) * 8,
+	}
+	if ix.ivf != nil {
+		sizes[ivfFileName] = ix.ivfListsOffset() + int64(ix.manifest.Count)*4
+	}
+	for name, size := range sizes {
+		info, err := os.Stat(ix.path(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check %v: %w", name, err)
+		}
+		if info.Size() <= size {
+			continue
+		}
+		if err := os.Truncate(ix.path(name), size); err != nil {
+			return fmt.Errorf("failed to cut off interrupted records of %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (ix *VectorIndex) recordSize() int64 {
+	return int64(ix.manifest.Dim) * 4
+}
+
+func (ix *VectorIndex) vectorOffset(id int) int64 {
+	return vectorsHeaderLen + int64(id)*ix.recordSize()
+}
+
+func toFloat32(vector []float64) []float32 {
+	result := make([]float32, len(vector))
+	for i, v := range vector {
+		result[i] = float32(v)
+	}
+	return result
+}
+
+func toFloat64(vector []float32) []float64 {
+	result := make([]float64, len(vector))
+	for i, v := range vector {
+		result[i] = float64(v)
+	}
+	return result
+}
+
+func encodeVector(vector []float32, buffer []byte) {
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buffer[i*4:], math.Float32bits(v))
+	}
+}
+
+func decodeVector(buffer []byte, vector []float32) {
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buffer[i*4:]))
+	}
+}
+
+// Append embeddings to the index and return the ids they were stored under
+func (ix *VectorIndex) Add(embeddings []Embedding) ([]int, error) {
+	if len(embeddings) == 0 {
+		return nil, nil
+	}
+	if err := ix.truncate(); err != nil {
+		return nil, err
+	}
+	dim := ix.manifest.Dim
+	if dim == 0 {
+		dim = len(embeddings[0].Vector)
+	}
+	for _, embedding := range embeddings {
+		if len(embedding.Vector) == 0 {
+			return nil, fmt.Errorf("embedding of %v has no vector", embedding.File)
+		}
+		if len(embedding.Vector) != dim {
+			return nil, fmt.Errorf("embedding of %v has %v dimensions, index has %v",
+				embedding.File, len(embedding.Vector), dim)
+		}
+	}
+	ix.manifest.Dim = dim
+	vectors, err := os.OpenFile(ix.path(vectorsFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vectors: %w", err)
+	}
+	defer vectors.Close()
+	header := make([]byte, vectorsHeaderLen)
+	copy(header, vectorsMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(ix.manifest.Dim))
+	if _, err := vectors.WriteAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to write vectors: %w", err)
+	}
+	meta, err := os.OpenFile(ix.path(metaFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata: %w", err)
+	}
+	defer meta.Close()
+	metaInfo, err := meta.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata: %w", err)
+	}
+	metaOffset := metaInfo.Size()
+	metaIdx, err := os.OpenFile(ix.path(metaIdxFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata offsets: %w", err)
+	}
+	defer metaIdx.Close()
+	var lists *os.File
+	if ix.ivf != nil {
+		lists, err = os.OpenFile(ix.path(ivfFileName), os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open clustering: %w", err)
+		}
+		defer lists.Close()
+	}
+
+	var ids []int
+	buffer := make([]byte, ix.recordSize())
+	offset := make([]byte, 8)
+	for _, embedding := range embeddings {
+		id := ix.manifest.Count
+		vector := ix.manifest.Metric.Prepare(toFloat32(embedding.Vector))
+		encodeVector(vector, buffer)
+		if _, err := vectors.WriteAt(buffer, ix.vectorOffset(id)); err != nil {
+			return nil, fmt.Errorf("failed to write vector: %w", err)
+		}
+		record := indexRecord{Id: id, Embedding: embedding}
+		record.Vector = nil
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		line = append(line, '\n')
+		if _, err := meta.Write(line); err != nil {
+			return nil, fmt.Errorf("failed to write metadata: %w", err)
+		}
+		binary.LittleEndian.PutUint64(offset, uint64(metaOffset))
+		if _, err := metaIdx.WriteAt(offset, int64(id)*8); err != nil {
+			return nil, fmt.Errorf("failed to write metadata offset: %w", err)
+		}
+		metaOffset += int64(len(line))
+		if ix.ivf != nil {
+			nearest := nearestCentroid(ix.manifest.Metric, ix.ivf.Centroids, vector)
+			ix.ivf.Lists[nearest] = append(ix.ivf.Lists[nearest], id)
+			binary.LittleEndian.PutUint32(offset, uint32(nearest))
+			if _, err := lists.WriteAt(offset[:4], ix.ivfListsOffset()+int64(id)*4); err != nil {
+				return nil, fmt.Errorf("failed to write clustering: %w", err)
+			}
+		}
+		ix.manifest.Count++
+		ids = append(ids, id)
+	}
+	if ix.needsTraining() {
+		if err := ix.train(); err != nil {
+			return nil, err
+		}
+		if err := ix.saveIVF(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, ix.saveManifest()
+}
+
+// Mark records as deleted. They are skipped by every read from now on.
+func (ix *VectorIndex) Delete(ids []int) error {
+	removed := map[int]bool{}
+	for _, id := range ids {
+		if id < 0 || id >= ix.manifest.Count {
+			return fmt.Errorf("record %v does not exist", id)
+		}
+		ix.deleted[id] = true
+		removed[id] = true
+	}
+	if ix.ivf != nil {
+		for i, list := range ix.ivf.Lists {
+			kept := list[:0]
+			for _, id := range list {
+				if !removed[id] {
+					kept = append(kept, id)
+				}
+			}
+			ix.ivf.Lists[i] = kept
+		}
+	}
+	return ix.saveManifest()
+}
+
+// Offset and json line of a record in meta.jsonl
+func (ix *VectorIndex) metaLine(id int) (int64, []byte, error) {
+	metaIdx, err := os.Open(ix.path(metaIdxFileName))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open metadata offsets: %w", err)
+	}
+	defer metaIdx.Close()
+	buffer := make([]byte, 8)
+	if _, err := metaIdx.ReadAt(buffer, int64(id)*8); err != nil {
+		return 0, nil, fmt.Errorf("failed to read metadata offset: %w", err)
+	}
+	offset := int64(binary.LittleEndian.Uint64(buffer))
+	meta, err := os.Open(ix.path(metaFileName))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open metadata: %w", err)
+	}
+	defer meta.Close()
+	if _, err := meta.Seek(offset, io.SeekStart); err != nil {
+		return 0, nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	line, err := bufio.NewReader(meta).ReadBytes('\n')
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return offset, line, nil
+}
+
+// Read the metadata of a single record
+func (ix *VectorIndex) Get(id int) (Embedding, error) {
+	if id < 0 || id >= ix.manifest.Count || ix.deleted[id] {
+		return Embedding{}, fmt.Errorf("record %v does not exist", id)
+	}
+	_, line, err := ix.metaLine(id)
+	if err != nil {
+		return Embedding{}, err
+	}
+	var record indexRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Embedding{}, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return record.Embedding, nil
+}
+
+// Read the stored vector of a single record. Vectors of the cosine metric
+// were normalised when they were added.
+func (ix *VectorIndex) Vector(id int) ([]float64, error) {
+	if id < 0 || id >= ix.manifest.Count || ix.deleted[id] {
+		return nil, fmt.Errorf("record %v does not exist", id)
+	}
+	vectors, err := os.Open(ix.path(vectorsFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vectors: %w", err)
+	}
+	defer vectors.Close()
+	buffer := make([]byte, ix.recordSize())
+	if _, err := vectors.ReadAt(buffer, ix.vectorOffset(id)); err != nil {
+		return nil, fmt.Errorf("failed to read vector %v: %w", id, err)
+	}
+	vector := make([]float32, ix.manifest.Dim)
+	decodeVector(buffer, vector)
+	result := make([]float64, len(vector))
+	for i, v := range vector {
+		result[i] = float64(v)
+	}
+	return result, nil
+}
+
+// Call fn with the metadata of every record that is not deleted.
+// The vectors are not loaded.
+func (ix *VectorIndex) Records(fn func(id int, embedding Embedding) error) error {
+	meta, err := os.Open(ix.path(metaFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open metadata: %w", err)
+	}
+	defer meta.Close()
+	reader := bufio.NewReader(meta)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read metadata: %w", err)
+		}
+		var record indexRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("failed to parse metadata: %w", err)
+		}
+		// Lines past Count are left over from an interrupted Add
+		if record.Id >= ix.manifest.Count || ix.deleted[record.Id] {
+			continue
+		}
+		if err := fn(record.Id, record.Embedding); err != nil {
+			return err
+		}
+	}
+}
+
+// Call fn with every vector that is not deleted, streaming through the file
+func (ix *VectorIndex) scanVectors(fn func(id int, vector []float32)) error {
+	if ix.manifest.Count == 0 {
+		return nil
+	}
+	vectors, err := os.Open(ix.path(vectorsFileName))
+	if err != nil {
+		return fmt.Errorf("failed to open vectors: %w", err)
+	}
+	defer vectors.Close()
+	reader := bufio.NewReaderSize(vectors, 1<<20)
+	if _, err := reader.Discard(vectorsHeaderLen); err != nil {
+		return fmt.Errorf("failed to read vectors: %w", err)
+	}
+	buffer := make([]byte, ix.recordSize())
+	vector := make([]float32, ix.manifest.Dim)
+	for id := 0; id < ix.manifest.Count; id++ {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return fmt.Errorf("failed to read vector %v: %w", id, err)
+		}
+		if ix.deleted[id] {
+			continue
+		}
+		decodeVector(buffer, vector)
+		fn(id, vector)
+	}
+	return nil
+}
+
+// Keeps the k closest records seen so far, sorted by distance
+type topK struct {
+	k       int
+	results []EmbeddingDistance
+}
+
+func (t *topK) add(id int, distance float64) {
+	if len(t.results) == t.k && distance >= t.results[len(t.results)-1].Distance {
+		return
+	}
+	i := sort.Search(len(t.results), func(i int) bool { return t.results[i].Distance > distance })
+	t.results = append(t.results, EmbeddingDistance{})
+	copy(t.results[i+1:], t.results[i:])
+	t.results[i] = EmbeddingDistance{Id: id, Distance: distance}
+	if len(t.results) > t.k {
+		t.results = t.results[:t.k]
+	}
+}
+
+// Return the k records closest to the query vector, closest first,
+// with their score under the metric of the index.
+// Small indexes are scanned completely, larger ones only look at the
+// IVF lists whose centroids are closest to the query.
+func (ix *VectorIndex) Search(query []float64, k int) ([]EmbeddingDistance, error) {
+	return ix.SearchAllowed(query, k, nil)
+}
+
+// Like Search, but only records in allowed are ranked, all of them if allowed is nil.
+// Filtered searches scan every vector, so few allowed records are not missed
+// by the IVF lists.
+func (ix *VectorIndex) SearchAllowed(query []float64, k int, allowed map[int]bool) ([]EmbeddingDistance, error) {
+	if ix.Len() == 0 || k <= 0 || (allowed != nil && len(allowed) == 0) {
+		return nil, nil
+	}
+	if len(query) != ix.manifest.Dim {
+		return nil, fmt.Errorf("query has %v dimensions, index has %v", len(query), ix.manifest.Dim)
+	}
+	metric := ix.manifest.Metric
+	q := metric.Prepare(toFloat32(query))
+	best := &topK{k: k}
+	var err error
+	if ix.ivf == nil || allowed != nil {
+		err = ix.scanVectors(func(id int, vector []float32) {
+			if allowed == nil || allowed[id] {
+				best.add(id, float64(metric.Distance(q, vector)))
+			}
+		})
+	} else {
+		err = ix.searchIVF(q, best)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range best.results {
+		best.results[i].Score = metric.Score(best.results[i].Distance)
+		best.results[i].Metric = metric
+		best.results[i].Embedding, err = ix.Get(best.results[i].Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return best.results, nil
+}
+
+func (ix *VectorIndex) searchIVF(query []float32, best *topK) error {
+	metric := ix.manifest.Metric
+	centroids := ix.ivf.Centroids
+	order := make([]int, len(centroids))
+	distances := make([]float32, len(centroids))
+	for i, centroid := range centroids {
+		order[i] = i
+		distances[i] = metric.Distance(query, centroid)
+	}
+	sort.Slice(order, func(a, b int) bool { return distances[order[a]] < distances[order[b]] })
+	var candidates []int
+	for _, list := range order[:min(ivfProbes, len(order))] {
+		candidates = append(candidates, ix.ivf.Lists[list]...)
+	}
+	// Reading in id order keeps the disk access mostly sequential
+	sort.Ints(candidates)
+	vectors, err := os.Open(ix.path(vectorsFileName))
+	if err != nil {
+		return fmt.Errorf("failed to open vectors: %w", err)
+	}
+	defer vectors.Close()
+	buffer := make([]byte, ix.recordSize())
+	vector := make([]float32, ix.manifest.Dim)
+	for _, id := range candidates {
+		if _, err := vectors.ReadAt(buffer, ix.vectorOffset(id)); err != nil {
+			return fmt.Errorf("failed to read vector %v: %w", id, err)
+		}
+		decodeVector(buffer, vector)
+		best.add(id, float64(metric.Distance(query, vector)))
+	}
+	return nil
+}
+
+func nearestCentroid(metric Metric, centroids [][]float32, vector []float32) int {
+	nearest := 0
+	nearestDistance := float32(math.MaxFloat32)
+	for i, centroid := range centroids {
+		if d := metric.Distance(vector, centroid); d < nearestDistance {
+			nearest, nearestDistance = i, d
+		}
+	}
+	return nearest
+}
+
+// The clustering is trained once the index is big enough
+// and retrained every time the index has doubled since.
+func (ix *VectorIndex) needsTraining() bool {
+	if ix.Len() < ivfMinVectors {
+		return false
+	}
+	return ix.ivf == nil || ix.Len() >= 2*ix.ivf.TrainedAt
+}
+
+// Cluster the vectors with k-means on a sample and assign every record to a list
+func (ix *VectorIndex) train() error {
+	live := ix.Len()
+	lists := int(math.Sqrt(float64(live)))
+	lists = max(16, min(lists, 1024))
+	sampleSize := min(live, lists*40)
+	step := max(1, live/sampleSize)
+	var sample [][]float32
+	n := 0
+	err := ix.scanVectors(func(id int, vector []float32) {
+		if n%step == 0 && len(sample) < sampleSize {
+			sample = append(sample, append([]float32(nil), vector...))
+		}
+		n++
+	})
+	if err != nil {
+		return err
+	}
+	centroids := make([][]float32, lists)
+	for i := range centroids {
+		centroids[i] = append([]float32(nil), sample[i*len(sample)/lists]...)
+	}
+	assignment := make([]int, len(sample))
+	for iteration := 0; iteration < ivfIterations; iteration++ {
+		for i, vector := range sample {
+			assignment[i] = nearestCentroid(ix.manifest.Metric, centroids, vector)
+		}
+		sums := make([][]float32, lists)
+		counts := make([]int, lists)
+		for i, vector := range sample {
+			c := assignment[i]
+			if sums[c] == nil {
+				sums[c] = make([]float32, ix.manifest.Dim)
+			}
+			for d, v := range vector {
+				sums[c][d] += v
+			}
+			counts[c]++
+		}
+		for c := range centroids {
+			// Empty clusters keep their old centroid
+			if counts[c] == 0 {
+				continue
+			}
+			for d := range sums[c] {
+				centroids[c][d] = sums[c][d] / float32(counts[c])
+			}
+			ix.manifest.Metric.Prepare(centroids[c])
+		}
+	}
+	trained := &ivf{Centroids: centroids, Lists: make([][]int, lists), TrainedAt: live}
+	err = ix.scanVectors(func(id int, vector []float32) {
+		nearest := nearestCentroid(ix.manifest.Metric, centroids, vector)
+		trained.Lists[nearest] = append(trained.Lists[nearest], id)
+	})
+	if err != nil {
+		return err
+	}
+	ix.ivf = trained
+	return nil
+}
+
+// Rewrite the index without the deleted records into a new folder and swap it
+// in, so an interrupted Compact leaves either the old or the new index behind.
+// Records get new ids, so ids from before must not be used afterwards.
+// The sources are updated to the new ids.
+func (ix *VectorIndex) Compact() error {
+	tmpDir := siblingDir(ix.dir, "compact")
+	os.RemoveAll(tmpDir)
+	compacted, err := OpenIndex(tmpDir)
+	if err != nil {
+		return err
+	}
+	compacted.manifest.Metric = ix.manifest.Metric
+	newIds := map[int]int{}
+	if ix.manifest.Count > 0 {
+		err = ix.copyRecords(compacted, newIds)
+	}
+	if err == nil {
+		err = compacted.saveManifest()
+	}
+	if err == nil {
+		for path, source := range ix.sources {
+			compacted.sources[path] = source
+		}
+		compacted.remapSources(newIds)
+		err = compacted.saveSources()
+	}
+	if err == nil {
+		err = ix.copyOtherFiles(tmpDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	previous := siblingDir(ix.dir, "old")
+	if err := os.Rename(ix.dir, previous); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to replace index: %w", err)
+	}
+	if err := os.Rename(tmpDir, ix.dir); err != nil {
+		os.Rename(previous, ix.dir)
+		return fmt.Errorf("failed to replace index: %w", err)
+	}
+	os.RemoveAll(previous)
+	compacted.dir = ix.dir
+	*ix = *compacted
+	return nil
+}
+
+// Add the records that are not deleted to compacted, in batches.
+// newIds maps the old ids to the ids in compacted.
+func (ix *VectorIndex) copyRecords(compacted *VectorIndex, newIds map[int]int) error {
+	vectors, err := os.Open(ix.path(vectorsFileName))
+	if err != nil {
+		return fmt.Errorf("failed to open vectors: %w", err)
+	}
+	defer vectors.Close()
+	var batch []Embedding
+	flush := func() error {
+		_, err := compacted.Add(batch)
+		batch = batch[:0]
+		return err
+	}
+	buffer := make([]byte, ix.recordSize())
+	vector := make([]float32, ix.manifest.Dim)
+	err = ix.Records(func(id int, embedding Embedding) error {
+		newIds[id] = len(newIds)
+		if _, err := vectors.ReadAt(buffer, ix.vectorOffset(id)); err != nil {
+			return fmt.Errorf("failed to read vector %v: %w", id, err)
+		}
+		decodeVector(buffer, vector)
+		embedding.Vector = toFloat64(vector)
+		batch = append(batch, embedding)
+		if len(batch) == 1000 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Copy the files the index does not write itself, like the settings of the
+// collection, into dir. The keyword index is left out, it is built again.
+func (ix *VectorIndex) copyOtherFiles(dir string) error {
+	written := map[string]bool{
+		vectorsFileName: true, metaFileName: true, metaIdxFileName: true, manifestFileName: true,
+		ivfFileName: true, sourcesFileName: true, keywordsFileName: true,
+	}
+	entries, err := os.ReadDir(ix.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read index folder: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || written[entry.Name()] || filepath.Ext(entry.Name()) == ".tmp" {
+			continue
+		}
+		content, err := os.ReadFile(ix.path(entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to copy %v: %w", entry.Name(), err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, entry.Name()), content, 0644); err != nil {
+			return fmt.Errorf("failed to copy %v: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Import the embeddings of the old single json file into the index.
+// The json file is renamed afterwards so it is only imported once.
+func MigrateJSONEmbeddings(jsonPath string, ix *VectorIndex) (int, error) {
+	embeddings, err := LoadEmbeddings(jsonPath)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := ix.Add(embeddings.Embeddings); err != nil {
+		return 0, err
+	}
+	if err := ix.adoptUntrackedRecords(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(jsonPath, jsonPath+".migrated"); err != nil {
+		return 0, fmt.Errorf("failed to rename %v: %w", jsonPath, err)
+	}
+	return len(embeddings.Embeddings), nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const indexUsage = `Usage:
+  chatgpt [--collection name] index <command>
+
+Commands:
+  chatgpt index collections          all collections with their embedding model and chunking
+  chatgpt index list                 sources with their chunk count, tags and when they were embedded
+  chatgpt index rm <path|glob>...    remove sources, a folder removes everything below it
+  chatgpt index stats                number of vectors, dimensions, disk size and models
+  chatgpt index prune [--older-than 30d]
+                                     remove sources whose file is gone or that are older
+                                     than the given age, then reclaim the disk space`
+
+// Starting point for the index subcommands.
+// They work on the given collection, or the default collection if it is empty.
+func StartIndexCommand(args []string, collectionName string) error {
+	if len(args) == 0 {
+		fmt.Println(indexUsage)
+		return fmt.Errorf("%w: missing index command", ErrUsage)
+	}
+	if args[0] == "collections" {
+		if err := ListCollectionSettings(); err != nil {
+			return fmt.Errorf("failed to list collections: %w", err)
+		}
+		return nil
+	}
+	collection, err := LoadCollection(collectionName)
+	if err != nil {
+		return err
+	}
+	index := collection.VectorIndex
+	switch args[0] {
+	case "list", "ls":
+		err = ListIndex(index)
+	case "rm", "remove":
+		err = RemoveFromIndex(index, args[1:])
+	case "stats":
+		err = PrintIndexStats(index)
+	case "prune":
+		err = PruneIndex(index, args[1:])
+	default:
+		fmt.Println(indexUsage)
+		return fmt.Errorf("%w: unknown index command %q", ErrUsage, args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run index %v: %w", args[0], err)
+	}
+	return nil
+}
+
+// Print every collection with the settings that produced it
+func ListCollectionSettings() error {
+	names, err := ListCollections()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "COLLECTION\tSOURCES\tVECTORS\tMODEL\tCHUNKING\tCREATED")
+	for _, name := range names {
+		collectionPath, err := getCollectionPath(name)
+		if err != nil {
+			return err
+		}
+		collection, err := OpenCollection(name, collectionPath)
+		if err != nil {
+			return err
+		}
+		chunking := fmt.Sprintf("%v, %v tokens", collection.Settings.Chunker, collection.Settings.ChunkTokens)
+		if collection.Settings.Chunker == "lines" || collection.Settings.Chunker == "" {
+			chunking = fmt.Sprintf("lines, %v lines, %v overlap", collection.Settings.ChunkSize, collection.Settings.ChunkOverlap)
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			name,
+			len(collection.sources),
+			collection.Len(),
+			collection.Settings.EmbeddingModel,
+			chunking,
+			collection.Settings.Created.Format("2006-01-02 15:04"),
+		)
+	}
+	return writer.Flush()
+}
+
+// Print every source with its number of chunks
+func ListIndex(index *VectorIndex) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "CHUNKS\tCREATED\tTAGS\tSOURCE")
+	for _, source := range index.Sources() {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", len(source.Ids), source.Embedded.Format("2006-01-02 15:04"), FormatTags(source.Tags), source.Path)
+	}
+	return writer.Flush()
+}
+
+// Remove all sources matching one of the patterns.
+// A pattern is a glob, a file or a folder.
+func RemoveFromIndex(index *VectorIndex, patterns []string) error {
+	if len(patterns) == 0 {
+		return fmt.Errorf("%w: expected a path or glob to remove", ErrUsage)
+	}
+	var removed []string
+	for _, source := range index.Sources() {
+		for _, pattern := range patterns {
+			if matchSource(source.Path, pattern) {
+				removed = append(removed, source.Path)
+				break
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("no source matches %v", strings.Join(patterns, " "))
+	}
+	for _, path := range removed {
+		if err := index.RemoveSource(path); err != nil {
+			return err
+		}
+		fmt.Println("Removed", path)
+	}
+	fmt.Printf("Removed %v sources, run `chatgpt index prune` to reclaim the disk space\n", len(removed))
+	return nil
+}
+
+func matchSource(path string, pattern string) bool {
+	for _, p := range []string{pattern, sourcePath(pattern)} {
+		if matched, _ := filepath.Match(p, path); matched {
+			return true
+		}
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Print size and content of the index
+func PrintIndexStats(index *VectorIndex) error {
+	models := map[string]int{}
+	err := index.Records(func(id int, embedding Embedding) error {
+		model := embedding.Model
+		if model == "" {
+			model = "unknown"
+		}
+		models[model]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var diskSize int64
+	err = filepath.WalkDir(index.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			diskSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var modelNames []string
+	for model, count := range models {
+		modelNames = append(modelNames, fmt.Sprintf("%v (%v)", model, count))
+	}
+	sort.Strings(modelNames)
+	clustering := "none, flat search"
+	if index.ivf != nil {
+		clustering = fmt.Sprintf("IVF with %v lists", len(index.ivf.Lists))
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Path:\t%v\n", index.dir)
+	fmt.Fprintf(writer, "Sources:\t%v\n", len(index.sources))
+	fmt.Fprintf(writer, "Vectors:\t%v\n", index.Len())
+	fmt.Fprintf(writer, "Deleted:\t%v\n", len(index.deleted))
+	fmt.Fprintf(writer, "Dimensions:\t%v\n", index.Dim())
+	fmt.Fprintf(writer, "Metric:\t%v\n", index.Metric())
+	fmt.Fprintf(writer, "Clustering:\t%v\n", clustering)
+	fmt.Fprintf(writer, "Models:\t%v\n", strings.Join(modelNames, ", "))
+	fmt.Fprintf(writer, "Disk size:\t%v\n", formatBytes(diskSize))
+	return writer.Flush()
+}
+
+func formatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
+
+// Parse an age like 90m, 12h, 30d or 2w
+func parseAge(age string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if number, found := strings.CutSuffix(age, suffix); found {
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age %q", age)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(age)
+}
+
+// Remove sources whose local file no longer exists or that were embedded
+// before --older-than, then compact the index to free the disk space
+func PruneIndex(index *VectorIndex, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	olderThan := flags.String("older-than", "", "Remove sources embedded longer ago than this, for example 30d or 2w")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	var cutoff time.Time
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUsage, err)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	removed := 0
+	for _, source := range index.Sources() {
+		reason := ""
+		if !cutoff.IsZero() && source.Embedded.Before(cutoff) {
+			reason = "older than " + *olderThan
+		} else if !isURL(source.Path) {
+			if _, err := os.Stat(source.Path); os.IsNotExist(err) {
+				reason = "file no longer exists"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		if err := index.RemoveSource(source.Path); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %v (%v)\n", source.Path, reason)
+		removed++
+	}
+	deleted := len(index.deleted)
+	if err := index.Compact(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %v sources and reclaimed %v deleted vectors\n", removed, deleted)
+	return nil
+}
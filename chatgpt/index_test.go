@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomEmbeddings(n int, dim int, seed int64) []Embedding {
+	random := rand.New(rand.NewSource(seed))
+	embeddings := make([]Embedding, n)
+	for i := range embeddings {
+		vector := make([]float64, dim)
+		for d := range vector {
+			vector[d] = random.Float64()*2 - 1
+		}
+		embeddings[i] = Embedding{File: fmt.Sprintf("file%v.txt", i), RowEnd: i, Vector: vector}
+	}
+	return embeddings
+}
+
+func TestIndexAddSearchDelete(t *testing.T) {
+	dir := t.TempDir()
+	index, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(50, 8, 1)
+	if _, err := index.Add(embeddings); err != nil {
+		t.Fatal(err)
+	}
+	results, err := index.Search(embeddings[7].Vector, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Id != 7 || results[0].Embedding.File != "file7.txt" {
+		t.Fatalf("expected record 7 first, got %+v", results[0])
+	}
+	if err := index.Delete([]int{7}); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen to make sure everything was persisted
+	index, err = OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 49 {
+		t.Fatalf("expected 49 records, got %v", index.Len())
+	}
+	results, err = index.Search(embeddings[7].Vector, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Id == 7 {
+		t.Fatal("deleted record was returned")
+	}
+	if _, err := index.Add(randomEmbeddings(1, 4, 2)); err == nil {
+		t.Fatal("expected error for wrong dimensions")
+	}
+	// Empty vectors would leave a new index without dimensions
+	empty, err := OpenIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Add([]Embedding{{File: "empty.txt"}}); err == nil || empty.Dim() != 0 || empty.Len() != 0 {
+		t.Fatalf("expected error for an empty vector, got %v", err)
+	}
+}
+
+// An Add that wrote its records but crashed before saving the manifest
+// must not leave lines behind that the next Add's ids run into
+func TestIndexCutsOffInterruptedAdd(t *testing.T) {
+	dir := t.TempDir()
+	index, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(6, 4, 6)
+	if _, err := index.Add(embeddings[:2]); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Add(embeddings[2:4]); err != nil {
+		t.Fatal(err)
+	}
+	// The crash: the records of the second Add are on disk, its manifest is not
+	if err := os.WriteFile(filepath.Join(dir, manifestFileName), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+	index, err = OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := index.Add(embeddings[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 2 {
+		t.Fatalf("expected the ids after the last saved record, got %v", ids)
+	}
+	index, err = OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	err = index.Records(func(id int, embedding Embedding) error {
+		files = append(files, embedding.File)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(files) != "[file0.txt file1.txt file4.txt file5.txt]" {
+		t.Fatalf("unexpected records %v", files)
+	}
+	results, err := index.Search(embeddings[5].Vector, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Id != 3 || results[0].Embedding.File != "file5.txt" {
+		t.Fatalf("expected file5.txt as record 3, got %+v", results[0])
+	}
+}
+
+func TestIndexIVFFindsNearest(t *testing.T) {
+	index, err := OpenIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(ivfMinVectors+100, 8, 3)
+	if _, err := index.Add(embeddings); err != nil {
+		t.Fatal(err)
+	}
+	if index.ivf == nil {
+		t.Fatal("expected the index to be clustered")
+	}
+	// The clustering is kept out of the manifest and read back on open
+	manifest, err := os.ReadFile(filepath.Join(index.dir, manifestFileName))
+	if err != nil || bytes.Contains(manifest, []byte("Centroids")) {
+		t.Fatalf("expected the clustering outside of the manifest, %v", err)
+	}
+	if err := index.Delete([]int{500}); err != nil {
+		t.Fatal(err)
+	}
+	index, err = OpenIndex(index.dir)
+	if err != nil || index.ivf == nil {
+		t.Fatalf("expected the clustering to be loaded, %v", err)
+	}
+	for _, id := range []int{0, 501, ivfMinVectors + 50} {
+		results, err := index.Search(embeddings[id].Vector, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Id != id {
+			t.Fatalf("expected record %v, got %v", id, results[0].Id)
+		}
+	}
+}
+
+func TestIndexCompact(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "docs")
+	index, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, collectionSettingsFile), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(10, 4, 4)
+	index.Add(embeddings)
+	index.Delete([]int{0, 1, 2})
+	if err := index.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 7 || index.manifest.Count != 7 {
+		t.Fatalf("expected 7 records after compacting, got %v", index.manifest.Count)
+	}
+	results, err := index.Search(embeddings[5].Vector, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Embedding.File != "file5.txt" {
+		t.Fatalf("expected file5.txt, got %v", results[0].Embedding.File)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dir))
+	if len(entries) != 1 {
+		t.Fatalf("expected only the index folder to be left, got %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(dir, collectionSettingsFile)); err != nil {
+		t.Fatal("expected the collection settings to be kept")
+	}
+	// A crash between the renames leaves the old index, it is put back on open
+	if err := os.Rename(dir, siblingDir(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if collectionNamePattern.MatchString(filepath.Base(siblingDir(dir, "compact"))) {
+		t.Fatal("expected the folders of a compaction not to look like collections")
+	}
+	index, err = OpenIndex(dir)
+	if err != nil || index.Len() != 7 {
+		t.Fatalf("expected the old index to be restored, %v", err)
+	}
+}
+
+func TestIndexCompactKeepsMetricOfEmptyIndex(t *testing.T) {
+	dir := t.TempDir()
+	index, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetMetric(MetricDot); err != nil {
+		t.Fatal(err)
+	}
+	index.Add(randomEmbeddings(3, 4, 7))
+	index.Delete([]int{0, 1, 2})
+	if err := index.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 0 || index.Metric() != MetricDot {
+		t.Fatalf("expected an empty dot index, got %v records and %v", index.Len(), index.Metric())
+	}
+}
+
+func TestMigrateJSONEmbeddings(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "embeddings.json")
+	content, _ := json.Marshal(Embeddings{Embeddings: randomEmbeddings(3, 4, 5)})
+	if err := os.WriteFile(jsonPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := MigrateJSONEmbeddings(jsonPath, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || index.Len() != 3 {
+		t.Fatalf("expected 3 migrated embeddings, got %v", n)
+	}
+	if _, err := os.Stat(jsonPath); !os.IsNotExist(err) {
+		t.Fatal("expected the json file to be renamed")
+	}
+}
+
+func TestIndexMetrics(t *testing.T) {
+	for _, metric := range []Metric{MetricCosine, MetricDot, MetricL2} {
+		index, err := OpenIndex(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.SetMetric(metric); err != nil {
+			t.Fatal(err)
+		}
+		index.Add([]Embedding{
+			{File: "same direction", Vector: []float64{10, 0}},
+			{File: "close", Vector: []float64{0.8, 0.6}},
+		})
+		results, err := index.Search([]float64{1, 0}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[Metric]string{MetricCosine: "same direction", MetricDot: "same direction", MetricL2: "close"}
+		if results[0].Embedding.File != expected[metric] {
+			t.Fatalf("%v: expected %v first, got %v", metric, expected[metric], results[0].Embedding.File)
+		}
+		if metric == MetricCosine && (results[0].Score < 0.999 || results[1].Score > 0.801) {
+			t.Fatalf("unexpected cosine scores %v and %v", results[0].Score, results[1].Score)
+		}
+		if err := index.SetMetric(MetricDot); metric != MetricDot && err == nil {
+			t.Fatal("expected error when changing the metric of a filled index")
+		}
+	}
+}
+
+func TestGetVectorDistanceChecksDimensions(t *testing.T) {
+	if _, err := GetVectorDistance(MetricCosine, []float64{1, 2}, []float64{1}); err == nil {
+		t.Fatal("expected error for vectors of different length")
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultKeyName = "default"
+	keysFileName   = "keys.enc"
+	// Random secret the keys file is sealed with when there is no passphrase.
+	// It lies next to the keys file, so it does not protect the keys
+	keysSecretFileName = "keys.secret"
+	// Environment variable with the passphrase the keys file is encrypted with
+	keysPassphraseEnv = "CHATGPT_KEYS_PASSPHRASE"
+	// PBKDF2 iterations that turn the passphrase into the AES key
+	keysPassphraseIterations = 600000
+)
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+// A KeyStore keeps api keys by id, an id is "<provider>/<name>"
+type KeyStore interface {
+	Get(id string) (string, error)
+	Set(id string, key string) error
+	Remove(id string) error
+	List() ([]string, error)
+}
+
+// Keys in a file that only the user can read, encrypted with AES-GCM.
+// With a passphrase the AES key is derived from it and the keys are encrypted
+// at rest. Without one the file is sealed with a random secret in the same
+// folder, created on the first Set, so only the file permissions protect the keys.
+type FileKeyStore struct {
+	Path       string
+	SecretPath string
+	Passphrase string
+}
+
+// Encrypted content of the keys file. Salt is set when the
+// AES key was derived from a passphrase.
+type keysFile struct {
+	Salt  []byte `json:",omitempty"`
+	Nonce []byte
+	Data  []byte
+}
+
+// The key store in the data directory
+func getKeyStore() (KeyStore, error) {
+	path, err := getDataPath(keysFileName)
+	if err != nil {
+		return nil, err
+	}
+	secretPath, err := getDataPath(keysSecretFileName)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeyStore{Path: path, SecretPath: secretPath, Passphrase: os.Getenv(keysPassphraseEnv)}, nil
+}
+
+// Id of the key with the given name for the provider.
+// A name that already contains a provider is returned as it is.
+func keyID(providerName string, name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	if name == "" {
+		name = defaultKeyName
+	}
+	if providerName == "" {
+		providerName = "openai"
+	}
+	return strings.ToLower(providerName) + "/" + name
+}
+
+// Warn about files with secrets that others can read
+func checkPermissions(path string) {
+	info, err := os.Stat(path)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %v can be read by other users (mode %v), run chmod 600 %v\n", path, info.Mode().Perm(), path)
+	}
+}
+
+func (s *FileKeyStore) secret(create bool) ([]byte, error) {
+	checkPermissions(s.SecretPath)
+	secret, err := os.ReadFile(s.SecretPath)
+	if errors.Is(err, os.ErrNotExist) && create {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to create key secret: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(s.SecretPath), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create key folder: %w", err)
+		}
+		return secret, os.WriteFile(s.SecretPath, secret, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key secret: %w", err)
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("key secret %v is damaged", s.SecretPath)
+	}
+	return secret, nil
+}
+
+func (s *FileKeyStore) load() (map[string]string, error) {
+	keys := map[string]string{}
+	checkPermissions(s.Path)
+	content, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	var file keysFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keys: %w", err)
+	}
+	var secret []byte
+	if len(file.Salt) > 0 {
+		if s.Passphrase == "" {
+			return nil, fmt.Errorf("%w: the keys in %v are encrypted, set %v to their passphrase", ErrAuth, s.Path, keysPassphraseEnv)
+		}
+		secret = passphraseKey(s.Passphrase, file.Salt)
+	} else if secret, err = s.secret(false); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil && len(file.Salt) > 0 {
+		return nil, fmt.Errorf("%w: failed to decrypt keys, %v is not their passphrase", ErrAuth, keysPassphraseEnv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keys, %v does not belong to %v", s.SecretPath, s.Path)
+	}
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Save the keys, encrypted with the passphrase if there is one. Keys sealed
+// with the secret of the folder before are encrypted with the passphrase
+// the next time they are saved, and the secret is removed.
+func (s *FileKeyStore) save(keys map[string]string) error {
+	var file keysFile
+	var secret []byte
+	var err error
+	if s.Passphrase != "" {
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return fmt.Errorf("failed to create salt: %w", err)
+		}
+		secret = passphraseKey(s.Passphrase, file.Salt)
+		if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+			return fmt.Errorf("failed to create key folder: %w", err)
+		}
+	} else if secret, err = s.secret(true); err != nil {
+		return err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	content, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("failed to write keys: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("failed to write keys: %w", err)
+	}
+	if s.Passphrase != "" {
+		if err := os.Remove(s.SecretPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %v: %w", s.SecretPath, err)
+		}
+	}
+	return nil
+}
+
+// AES key derived from the passphrase with PBKDF2 and HMAC-SHA256
+func passphraseKey(passphrase string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	// One block of 32 bytes is the whole key
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < keysPassphraseIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *FileKeyStore) Get(id string) (string, error) {
+	keys, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	key, ok := keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+func (s *FileKeyStore) Set(id string, key string) error {
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+	keys[id] = key
+	return s.save(keys)
+}
+
+func (s *FileKeyStore) Remove(id string) error {
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[id]; !ok {
+		return fmt.Errorf("%w: %v", ErrKeyNotFound, id)
+	}
+	delete(keys, id)
+	return s.save(keys)
+}
+
+func (s *FileKeyStore) List() ([]string, error) {
+	keys, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Environment variables checked for the key of a provider, in order
+func keyEnvNames(providerName string) []string {
+	if providerName == "" || providerName == "openai" {
+		return []string{"CHATGPT_API_KEY", "OPENAI_API_KEY"}
+	}
+	return []string{"CHATGPT_API_KEY"}
+}
+
+// Find the api key with the given name for the provider.
+// Environment variables come first, then the key store. The plain text key
+// file of older versions is moved into the key store when it is found.
+func getAPIKey(providerName string, name string) (string, error) {
+	for _, env := range keyEnvNames(providerName) {
+		if key := strings.TrimSpace(os.Getenv(env)); key != "" {
+			return key, nil
+		}
+	}
+	store, err := getKeyStore()
+	if err != nil {
+		return "", err
+	}
+	id := keyID(providerName, name)
+	key, err := store.Get(id)
+	if errors.Is(err, ErrKeyNotFound) && id == keyID("openai", defaultKeyName) {
+		key, err = migrateAPIKeyFile(store, id)
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", fmt.Errorf("%w: no api key %v, save one with --key or chatgpt key set", ErrAuth, id)
+	}
+	return key, err
+}
+
+// Move ~/.api_key.txt of older versions into the key store
+func migrateAPIKeyFile(store KeyStore, id string) (string, error) {
+	filePath, err := getHomePath(".api_key.txt")
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %v", ErrKeyNotFound, id)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read api key: %w", err)
+	}
+	checkPermissions(filePath)
+	key := strings.TrimSpace(string(content))
+	if err := store.Set(id, key); err != nil {
+		return "", err
+	}
+	if err := os.Remove(filePath); err != nil {
+		return "", fmt.Errorf("failed to remove %v: %w", filePath, err)
+	}
+	fmt.Println("Moved the api key from", filePath, "to the key store as", id)
+	return key, nil
+}
+
+// Save the API key for the provider in the key store
+func WriteAPIKey(providerName string, name string, apiKey string) error {
+	apiKey = strings.TrimSpace(apiKey)
+	if apiKey == "" {
+		return fmt.Errorf("%w: the api key is empty", ErrUsage)
+	}
+	store, err := getKeyStore()
+	if err != nil {
+		return err
+	}
+	id := keyID(providerName, name)
+	if err := store.Set(id, apiKey); err != nil {
+		return fmt.Errorf("failed to save api key: %w", err)
+	}
+	fmt.Println("Saved api key", id)
+	if os.Getenv(keysPassphraseEnv) == "" {
+		fmt.Fprintf(os.Stderr, "Warning: the key store is only protected by its file permissions, set %v to encrypt it\n", keysPassphraseEnv)
+	}
+	return nil
+}
+
+// Read a key from the first line of stdin, so it stays out of the shell history
+func readAPIKey(id string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Api key for %v: ", id)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read api key: %w", err)
+	}
+	return line, nil
+}
+
+// Show only the end of a key, at most a quarter of it and never more than 4 characters
+func maskKey(key string) string {
+	visible := min(len(key)/4, 4)
+	return "****" + key[len(key)-visible:]
+}
+
+const keyUsage = `Usage:
+  chatgpt key list            names of the saved keys
+  chatgpt key set [name]      save a key read from stdin
+  chatgpt key show [name]     show a saved key, masked
+  chatgpt key rm <name>       remove a saved key
+
+Names are <provider>/<name>, a name without provider belongs to the
+provider of the config. The default name is "default".`
+
+// Starting point for the key subcommands
+func StartKeyCommand(args []string, providerName string, keyName string) error {
+	if len(args) == 0 {
+		fmt.Println(keyUsage)
+		return fmt.Errorf("%w: missing key command", ErrUsage)
+	}
+	store, err := getKeyStore()
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		keyName = args[1]
+	}
+	id := keyID(providerName, keyName)
+	switch args[0] {
+	case "list", "ls":
+		ids, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	case "set":
+		key, err := readAPIKey(id)
+		if err != nil {
+			return err
+		}
+		return WriteAPIKey(providerName, id, key)
+	case "show":
+		key, err := store.Get(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v %v\n", id, maskKey(key))
+		return nil
+	case "rm", "remove":
+		if len(args) < 2 {
+			return fmt.Errorf("%w: name the key to remove", ErrUsage)
+		}
+		if err := store.Remove(id); err != nil {
+			return err
+		}
+		fmt.Println("Removed api key", id)
+		return nil
+	}
+	fmt.Println(keyUsage)
+	return fmt.Errorf("%w: unknown key command %q", ErrUsage, args[0])
+}
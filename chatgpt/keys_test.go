@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Keep collections, sessions and keys of the test in a temporary folder
+func useDataDir(t *testing.T) string {
+	previous := config
+	config.DataDir = t.TempDir()
+	t.Cleanup(func() { config = previous })
+	return config.DataDir
+}
+
+func TestFileKeyStoreSealsKeys(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileKeyStore{Path: filepath.Join(dir, keysFileName), SecretPath: filepath.Join(dir, keysSecretFileName)}
+	if err := store.Set("openai/work", "sk-secret-work-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("openai/default", "sk-secret-default-key"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{store.Path, store.SecretPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("%v has mode %v", path, info.Mode().Perm())
+		}
+	}
+	content, _ := os.ReadFile(store.Path)
+	if strings.Contains(string(content), "sk-secret") {
+		t.Fatal("keys are saved in plain text")
+	}
+	key, err := store.Get("openai/work")
+	if err != nil || key != "sk-secret-work-key" {
+		t.Fatalf("unexpected key %q, %v", key, err)
+	}
+	ids, _ := store.List()
+	if len(ids) != 2 || ids[0] != "openai/default" {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+	if err := store.Remove("openai/work"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("openai/work"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected removed key to be gone, got %v", err)
+	}
+}
+
+func TestFileKeyStoreEncryptsKeysWithPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	sealed := &FileKeyStore{Path: filepath.Join(dir, keysFileName), SecretPath: filepath.Join(dir, keysSecretFileName)}
+	if err := sealed.Set("openai/default", "sk-secret-key"); err != nil {
+		t.Fatal(err)
+	}
+	// Keys sealed with the secret of the folder are encrypted with the passphrase when saved again
+	store := &FileKeyStore{Path: sealed.Path, SecretPath: sealed.SecretPath, Passphrase: "correct horse"}
+	if err := store.Set("openai/work", "sk-work-key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.SecretPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the secret to be removed, got %v", err)
+	}
+	if key, err := store.Get("openai/default"); err != nil || key != "sk-secret-key" {
+		t.Fatalf("unexpected key %q, %v", key, err)
+	}
+	for _, passphrase := range []string{"", "wrong"} {
+		other := &FileKeyStore{Path: store.Path, SecretPath: store.SecretPath, Passphrase: passphrase}
+		if _, err := other.Get("openai/work"); !errors.Is(err, ErrAuth) {
+			t.Fatalf("expected auth error with passphrase %q, got %v", passphrase, err)
+		}
+	}
+}
+
+func TestGetAPIKeyPrefersEnvironment(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("CHATGPT_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	if _, err := getAPIKey("openai", "missing"); !errors.Is(err, ErrAuth) {
+		t.Fatalf("expected auth error without key, got %v", err)
+	}
+	if err := WriteAPIKey("openai", "work", "sk-stored\n"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := getAPIKey("openai", "work")
+	if err != nil || key != "sk-stored" {
+		t.Fatalf("expected trimmed stored key, got %q, %v", key, err)
+	}
+	t.Setenv("OPENAI_API_KEY", "sk-from-env\n")
+	if key, _ := getAPIKey("openai", "work"); key != "sk-from-env" {
+		t.Fatalf("expected key from environment, got %q", key)
+	}
+}
+
+func TestKeyIDAndMask(t *testing.T) {
+	if id := keyID("local", ""); id != "local/default" {
+		t.Fatalf("unexpected id %v", id)
+	}
+	if id := keyID("local", "openai/work"); id != "openai/work" {
+		t.Fatalf("unexpected id %v", id)
+	}
+	for key, expected := range map[string]string{"sk-1234567890abcdef": "****cdef", "sk-abcdef": "****ef", "short": "****t", "abc": "****"} {
+		if masked := maskKey(key); masked != expected {
+			t.Fatalf("unexpected mask %v of %v", masked, key)
+		}
+	}
+}
+
+func TestKeySetReadsTheKeyFromStdin(t *testing.T) {
+	useDataDir(t)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() { os.Stdin = previous })
+	writer.WriteString("sk-from-stdin\n")
+	writer.Close()
+	if err := StartKeyCommand([]string{"set", "work"}, "openai", ""); err != nil {
+		t.Fatal(err)
+	}
+	store, err := getKeyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := store.Get("openai/work"); err != nil || key != "sk-from-stdin" {
+		t.Fatalf("expected the key from stdin, got %q, %v", key, err)
+	}
+}
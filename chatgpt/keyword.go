@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	keywordsFileName = "keywords.json"
+	// BM25 parameters, the usual defaults
+	bm25K1 = 1.2
+	bm25B  = 0.75
+	// Rank constant of reciprocal-rank fusion, larger values flatten the ranks
+	rrfK = 60
+	// Candidates taken from each search before they are fused
+	hybridCandidates = 20
+)
+
+// Scores of keyword and hybrid results are not distances of the vectors
+const (
+	MetricBM25   Metric = "bm25"
+	MetricHybrid Metric = "hybrid"
+)
+
+// Retrieval modes of --mode
+const (
+	ModeVector  = "vector"
+	ModeKeyword = "keyword"
+	ModeHybrid  = "hybrid"
+)
+
+// Inverted index over the content of the records of an index.
+// It is saved next to the index and rebuilt when the metadata changed.
+type KeywordIndex struct {
+	MetaSize    int64
+	MetaModTime time.Time
+	Deleted     int
+	Lengths     map[int]int            // number of terms of every record
+	Postings    map[string]map[int]int // term, record id, times the term appears
+	TotalLength int
+}
+
+// Identifiers, error codes and words. Dotted, snake_case and camelCase names are
+// kept whole and also split into their parts, so both forms are found.
+var termPattern = regexp.MustCompile(`[\p{L}\p{N}_]+(?:[.\-][\p{L}\p{N}_]+)*`)
+
+func Tokenize(text string) []string {
+	var terms []string
+	for _, word := range termPattern.FindAllString(text, -1) {
+		terms = append(terms, strings.ToLower(word))
+		parts := strings.FieldsFunc(word, func(r rune) bool { return r == '.' || r == '-' || r == '_' })
+		var split []string
+		for _, part := range parts {
+			split = append(split, splitCamelCase(part)...)
+		}
+		if len(split) > 1 {
+			for _, part := range split {
+				terms = append(terms, strings.ToLower(part))
+			}
+		}
+	}
+	return terms
+}
+
+// Split camelCase words, GetEmbeddingDistances becomes Get, Embedding and Distances
+func splitCamelCase(word string) []string {
+	var parts []string
+	runes := []rune(word)
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		lowerToUpper := unicode.IsLower(runes[i-1]) && unicode.IsUpper(runes[i])
+		acronymEnd := i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i+1])
+		if lowerToUpper || acronymEnd {
+			parts = append(parts, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(parts, string(runes[start:]))
+}
+
+// The keyword index of the index, built again if records were added, deleted or compacted
+func (ix *VectorIndex) KeywordIndex() (*KeywordIndex, error) {
+	var size int64
+	var modTime time.Time
+	if info, err := os.Stat(ix.path(metaFileName)); err == nil {
+		size, modTime = info.Size(), info.ModTime()
+	}
+	var keywords KeywordIndex
+	content, err := os.ReadFile(ix.path(keywordsFileName))
+	if err == nil && json.Unmarshal(content, &keywords) == nil &&
+		keywords.MetaSize == size && keywords.MetaModTime.Equal(modTime) && keywords.Deleted == len(ix.deleted) {
+		return &keywords, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read keyword index: %w", err)
+	}
+	keywords = KeywordIndex{
+		MetaSize:    size,
+		MetaModTime: modTime,
+		Deleted:     len(ix.deleted),
+		Lengths:     map[int]int{},
+		Postings:    map[string]map[int]int{},
+	}
+	err = ix.Records(func(id int, embedding Embedding) error {
+		terms := Tokenize(embedding.Content)
+		keywords.Lengths[id] = len(terms)
+		keywords.TotalLength += len(terms)
+		for _, term := range terms {
+			if keywords.Postings[term] == nil {
+				keywords.Postings[term] = map[int]int{}
+			}
+			keywords.Postings[term][id]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	content, err = json.Marshal(keywords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keyword index: %w", err)
+	}
+	tmp := ix.path(keywordsFileName + ".tmp")
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write keyword index: %w", err)
+	}
+	return &keywords, os.Rename(tmp, ix.path(keywordsFileName))
+}
+
+// Rank the records by BM25 score of the query terms, best first.
+// Only records in allowed are ranked, all of them if allowed is nil.
+func (k *KeywordIndex) Search(query string, n int, allowed map[int]bool) []EmbeddingDistance {
+	if len(k.Lengths) == 0 || n <= 0 {
+		return nil
+	}
+	documents := float64(len(k.Lengths))
+	averageLength := float64(k.TotalLength) / documents
+	scores := map[int]float64{}
+	seen := map[string]bool{}
+	for _, term := range Tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := k.Postings[term]
+		frequency := float64(len(postings))
+		idf := math.Log(1 + (documents-frequency+0.5)/(frequency+0.5))
+		for id, count := range postings {
+			if allowed != nil && !allowed[id] {
+				continue
+			}
+			tf := float64(count)
+			length := float64(k.Lengths[id])
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/averageLength))
+		}
+	}
+	var results []EmbeddingDistance
+	for id, score := range scores {
+		results = append(results, EmbeddingDistance{Id: id, Distance: -score, Score: score, Metric: MetricBM25})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+	return results[:min(n, len(results))]
+}
+
+// Keyword search over several collections, best n over all of them
+// whose source matches the filter
+func SearchKeywords(collections []*Collection, query string, n int, filter Filter) ([]EmbeddingDistance, error) {
+	var merged []EmbeddingDistance
+	for _, collection := range collections {
+		keywords, err := collection.KeywordIndex()
+		if err != nil {
+			return nil, fmt.Errorf("collection %v: %w", collection.Name, err)
+		}
+		results := keywords.Search(query, n, collection.FilterIds(filter))
+		for i := range results {
+			results[i].Collection = collection.Name
+			results[i].Embedding, err = collection.Get(results[i].Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		merged = append(merged, results...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Score > merged[j].Score })
+	return merged[:min(n, len(merged))], nil
+}
+
+// Combine ranked lists with reciprocal-rank fusion: every list adds
+// weight / (rrfK + rank) to the score of its results.
+func FuseRankings(rankings [][]EmbeddingDistance, weights []float64, n int) []EmbeddingDistance {
+	type key struct {
+		collection string
+		id         int
+	}
+	fused := map[key]*EmbeddingDistance{}
+	var order []key
+	for i, ranking := range rankings {
+		for rank, result := range ranking {
+			k := key{result.Collection, result.Id}
+			if fused[k] == nil {
+				copied := result
+				copied.Score = 0
+				fused[k] = &copied
+				order = append(order, k)
+			}
+			fused[k].Score += weights[i] / float64(rrfK+rank+1)
+		}
+	}
+	var results []EmbeddingDistance
+	for _, k := range order {
+		result := *fused[k]
+		result.Metric = MetricHybrid
+		result.Distance = -result.Score
+		results = append(results, result)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results[:min(n, len(results))]
+}
+
+// Find the n chunks of the collections that best match the query with the given mode.
+// Chunks whose source does not match the filter are left out before ranking.
+func Retrieve(query string, collections []*Collection, n int, mode string, filter Filter) ([]EmbeddingDistance, error) {
+	switch mode {
+	case ModeVector:
+		return GetEmbeddingDistances(query, collections, n, filter)
+	case ModeKeyword:
+		return SearchKeywords(collections, query, n, filter)
+	case "", ModeHybrid:
+		candidates := max(n, hybridCandidates)
+		vector, err := GetEmbeddingDistances(query, collections, candidates, filter)
+		if err != nil {
+			return nil, err
+		}
+		keyword, err := SearchKeywords(collections, query, candidates, filter)
+		if err != nil {
+			return nil, err
+		}
+		return FuseRankings([][]EmbeddingDistance{vector, keyword}, []float64{config.VectorWeight, config.KeywordWeight}, n), nil
+	}
+	return nil, fmt.Errorf("%w: unknown mode %q, expected keyword, vector or hybrid", ErrUsage, mode)
+}
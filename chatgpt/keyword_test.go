@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenizeSplitsIdentifiers(t *testing.T) {
+	terms := strings.Join(Tokenize("Call GetEmbeddingDistances, max_tokens and ERR-42 in HTTPServer."), " ")
+	expected := "call getembeddingdistances get embedding distances max_tokens max tokens and err-42 err 42 in httpserver http server"
+	if terms != expected {
+		t.Fatalf("unexpected terms %q", terms)
+	}
+}
+
+func TestKeywordSearchFindsExactIdentifier(t *testing.T) {
+	collection, err := OpenCollection("docs", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = collection.Add([]Embedding{
+		{File: "a.md", Content: "Errors of the api are shown to the user.", Vector: []float64{1, 0}},
+		{File: "b.md", Content: "The request fails with ERR_QUOTA_EXCEEDED when the budget is spent.", Vector: []float64{0, 1}},
+		{File: "c.md", Content: "The budget of the month can be changed in the settings.", Vector: []float64{1, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := SearchKeywords([]*Collection{collection}, "what does ERR_QUOTA_EXCEEDED mean", 2, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].Embedding.File != "b.md" || results[0].Metric != MetricBM25 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	// The keyword index follows deletes and new records
+	ids, err := collection.Add([]Embedding{{File: "d.md", Content: "Retry after ERR_QUOTA_EXCEEDED twice.", Vector: []float64{0, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.Delete([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	results, err = SearchKeywords([]*Collection{collection}, "ERR_QUOTA_EXCEEDED", 2, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Id != ids[0] {
+		t.Fatalf("keyword index was not rebuilt: %+v", results)
+	}
+}
+
+func TestFuseRankingsUsesWeights(t *testing.T) {
+	vector := []EmbeddingDistance{{Id: 1}, {Id: 2}}
+	keyword := []EmbeddingDistance{{Id: 2}, {Id: 3}}
+	results := FuseRankings([][]EmbeddingDistance{vector, keyword}, []float64{1, 1}, 3)
+	if len(results) != 3 || results[0].Id != 2 || results[0].Metric != MetricHybrid {
+		t.Fatalf("expected the result of both lists first, got %+v", results)
+	}
+	results = FuseRankings([][]EmbeddingDistance{vector, keyword}, []float64{0, 1}, 3)
+	if results[0].Id != 2 || results[1].Id != 3 {
+		t.Fatalf("expected the keyword order, got %+v", results)
+	}
+}
+
+func TestRetrieveHybrid(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{vectors: map[string][]float64{"parseRetryAfter": {1, 0}}})
+	collection, err := OpenCollection("docs", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection.Add([]Embedding{
+		{File: "near.go", Content: "func wait(seconds int)", Vector: []float64{1, 0}},
+		{File: "exact.go", Content: "func parseRetryAfter(header string)", Vector: []float64{0, 1}},
+	})
+	results, err := Retrieve("parseRetryAfter", []*Collection{collection}, 2, ModeHybrid, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Embedding.File != "exact.go" && results[1].Embedding.File != "exact.go" {
+		t.Fatalf("hybrid search missed the keyword match: %+v", results)
+	}
+	if _, err := Retrieve("x", nil, 2, "fuzzy", Filter{}); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
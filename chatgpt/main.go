@@ -2,15 +2,14 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,62 +17,61 @@ import (
 	"encoding/base64"
 	"encoding/json"
 
-	"github.com/dslipak/pdf"
 	"github.com/go-resty/resty/v2"
 )
 
 const (
-	apiEndpointChat  = "https://api.openai.com/v1/chat/completions"
-	apiEndpointEmbed = "https://api.openai.com/v1/embeddings"
 	modelChat        = "gpt-3.5-turbo"
 	modelEmbed       = "text-embedding-ada-002"
 	modelVision      = "gpt-4-vision-preview"
+	localModelChat   = "llama3"
+	localModelEmbed  = "nomic-embed-text"
+	localModelVision = "llava"
+	// By default the lines chunker splits files into chunks of chunkSize lines
+	// that overlap the previous chunk by chunkOverlap lines
+	chunkSize    = 200
+	chunkOverlap = 50
+	// Default number of chunks given to the model as context at most,
+	// 0 leaves it to the context budget
+	retrievalK = 0
+	// Chunks are sent to the embedding api in batches of at most
+	// embedBatchSize inputs and embedBatchTokens tokens
+	embedBatchSize   = 64
+	embedBatchTokens = 50000
+	// Number of files embedded at the same time
+	embedWorkers = 4
 )
 
-// The api key should be saved in a text file in the user's home directory
-func getAPIKey() string {
+// Path of a file in the user's home directory
+func getHomePath(name ...string) (string, error) {
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatalf("Error getting user's home directory: %v", err)
+		return "", fmt.Errorf("failed to get user's home directory: %w", err)
 	}
-	filePath := filepath.Join(usr.HomeDir, ".api_key.txt")
-	apiKeyBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Fatalf("Failed to read api key %v\n", err)
-	}
-	return string(apiKeyBytes)
+	return filepath.Join(append([]string{usr.HomeDir}, name...)...), nil
 }
 
-// The embeddings are saved in a json file in the user's home directory
-func getEmbeddingsPath() string {
-	usr, err := user.Current()
-	if err != nil {
-		log.Fatalf("Error getting user's home directory: %v", err)
-	}
-	filePath := filepath.Join(usr.HomeDir, "embeddings.json")
-	return filePath
+// Older versions saved all embeddings in one json file in the user's home directory
+func getEmbeddingsPath() (string, error) {
+	return getHomePath("embeddings.json")
 }
 
 // The chatgpt answer is saved in a markdown file in the user's home directory
-func getAnswerPath() string {
-	usr, err := user.Current()
-	if err != nil {
-		log.Fatalf("Error getting user's home directory: %v", err)
+// unless answer_path is configured
+func getAnswerPath() (string, error) {
+	if config.AnswerPath != "" {
+		return expandHome(config.AnswerPath)
 	}
-	filePath := filepath.Join(usr.HomeDir, "answer.md")
-	return filePath
-}
-
-type Config struct {
-	Key string `yaml:"openai_api_key"`
+	return getHomePath("answer.md")
 }
 
 // Response of OpenAI text completion API
 type GptResponse struct {
 	Id      string   `json:"id"`
 	Object  string   `json:"object"`
-	Created string   `json:"created"`
+	Created int64    `json:"created"` // unix time
 	Model   string   `json:"model"`
+	Usage   Usage    `json:"usage"`
 	Choices []Choice `json:"choices"` // list of answers/choices
 }
 
@@ -89,11 +87,14 @@ type Message struct {
 
 // Response of OpenAI text embedding API
 type EmbeddingResponse struct {
-	Data []struct {
-		Embedding []float64 `json:"embedding"`
-	} `json:"data"`
-	Model string         `json:"model"`
-	Usage map[string]int `json:"usage"`
+	Data  []EmbeddingData `json:"data"` // one entry per input
+	Model string          `json:"model"`
+	Usage map[string]int  `json:"usage"`
+}
+
+type EmbeddingData struct {
+	Index     int       `json:"index"` // position of the input
+	Embedding []float64 `json:"embedding"`
 }
 
 type Embedding struct {
@@ -101,8 +102,12 @@ type Embedding struct {
 	Created  time.Time
 	RowStart int
 	RowEnd   int
-	Vector   []float64
-	Content  string
+	// Pages of a pdf the chunk came from, counting from 1, 0 for files without pages
+	PageStart int       `json:",omitempty"`
+	PageEnd   int       `json:",omitempty"`
+	Vector    []float64 `json:",omitempty"`
+	Content   string
+	Model     string `json:",omitempty"` // embedding model that created the vector
 }
 
 type Embeddings struct {
@@ -110,350 +115,748 @@ type Embeddings struct {
 	Embeddings []Embedding
 }
 
-// Call embedding from OpenAI API
-func CallEmbedding(message string) EmbeddingResponse {
+// Call embedding from the active embedder
+func CallEmbedding(message string) (EmbeddingResponse, error) {
 	fmt.Println("Calling Embedding API")
-	client := resty.New()
-	response, err := client.R().
-		SetAuthToken(getAPIKey()).
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
-			"model": modelEmbed,
-			"input": message,
-		}).
-		Post(apiEndpointEmbed)
+	parsedResponse, err := CallEmbeddings([]string{message})
+	if err != nil {
+		return parsedResponse, fmt.Errorf("failed to call embedding api: %w", err)
+	}
+	return parsedResponse, nil
+}
+
+// Embed several inputs with one request to the active embedder.
+// Inputs that were embedded with the same model before are taken from the
+// cache, only the others are sent.
+func CallEmbeddings(inputs []string) (EmbeddingResponse, error) {
+	response := EmbeddingResponse{Data: make([]EmbeddingData, len(inputs))}
+	keys := make([]string, len(inputs))
+	var missing []string
+	var missingAt []int
+	for i, input := range inputs {
+		keys[i] = embeddingCacheKey(input)
+		var entry cachedEmbedding
+		// Empty vectors were cached by dry runs of older versions
+		if keys[i] != "" && cache.Get("embedding", keys[i], &entry) && len(entry.Vector) > 0 {
+			response.Data[i] = EmbeddingData{Index: i, Embedding: toFloat64(entry.Vector)}
+			response.Model = entry.Model
+			continue
+		}
+		missing = append(missing, input)
+		missingAt = append(missingAt, i)
+	}
+	if len(missing) == 0 {
+		return response, nil
+	}
+	parsedResponse, err := sendEmbeddings(missing)
 	if err != nil {
-		log.Fatalf("Failed to send request %v\n", err)
+		return parsedResponse, err
 	}
+	for j, data := range parsedResponse.Data {
+		i := missingAt[j]
+		response.Data[i] = EmbeddingData{Index: i, Embedding: data.Embedding}
+		if keys[i] == "" || len(data.Embedding) == 0 {
+			continue
+		}
+		if err := cache.Put("embedding", keys[i], cachedEmbedding{parsedResponse.Model, toFloat32(data.Embedding)}); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+	response.Model = parsedResponse.Model
+	response.Usage = parsedResponse.Usage
+	return response, nil
+}
+
+// Send the inputs to the active embedder.
+// Rate limits and server errors are retried with exponential backoff.
+func sendEmbeddings(inputs []string) (EmbeddingResponse, error) {
 	var parsedResponse EmbeddingResponse
-	json.Unmarshal(response.Body(), &parsedResponse)
-	return parsedResponse
+	active := activeEmbedder()
+	switch active.(type) {
+	case *HashingEmbedder, *dryRunEmbedder:
+		// Nothing is sent, so nothing is paid for
+	default:
+		if err := checkBudget(); err != nil {
+			return parsedResponse, err
+		}
+	}
+	err := withRetry(func() error {
+		var err error
+		parsedResponse, err = active.Embed(inputs)
+		return err
+	})
+	if err != nil {
+		return parsedResponse, err
+	}
+	recordUsage(UsageEmbedding, parsedResponse.Model, embeddingUsage(parsedResponse))
+	if len(parsedResponse.Data) != len(inputs) {
+		return parsedResponse, fmt.Errorf("%w: got %v embeddings for %v inputs", ErrParse, len(parsedResponse.Data), len(inputs))
+	}
+	return parsedResponse, nil
 }
 
-// Call text completion from OpenAI API
+// Call text completion from the active provider
 // The system_content is the context of the question
 // for example, the content of the file where the question is found
 // or instructions on how ChatGPT should answer the question
-func CallChatgpt(message string, system_content string) GptResponse {
+// An answer without choices is returned as ErrParse.
+func CallChatgpt(message string, system_content string) (GptResponse, error) {
+	return CallChatgptMessages([]Message{
+		{Role: "system", Content: system_content},
+		{Role: "user", Content: message},
+	})
+}
+
+// Send a whole conversation, for example the history of a session.
+// If chat_cache_ttl is set, the same request is answered from the cache.
+// Rate limits and server errors are retried with exponential backoff.
+func CallChatgptMessages(messages []Message) (GptResponse, error) {
+	key := chatCacheKey(messages)
+	if response, ok := cachedChat(key); ok {
+		fmt.Println("Answered from the cache")
+		return response, nil
+	}
+	if err := checkBudget(); err != nil {
+		return GptResponse{}, err
+	}
 	fmt.Println("Calling ChatGpt API")
-	client := resty.New()
-	response, err := client.R().
-		SetAuthToken(getAPIKey()).
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
-			"model": modelChat,
-			"messages": []interface{}{
-				map[string]interface{}{"role": "system", "content": system_content},
-				map[string]interface{}{"role": "user", "content": message},
-			},
-			"max_tokens": 1000,
-		}).
-		Post(apiEndpointChat)
+	var parsed_response GptResponse
+	err := withRetry(func() error {
+		var err error
+		parsed_response, err = provider.Chat(messages)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to send request %v\n", err)
+		return parsed_response, fmt.Errorf("failed to call chat api: %w", err)
+	}
+	recordUsage(UsageChat, parsed_response.Model, chatUsage(messages, parsed_response))
+	if len(parsed_response.Choices) == 0 {
+		return parsed_response, fmt.Errorf("%w: chat api returned no answer", ErrParse)
 	}
+	saveChat(key, parsed_response)
+	return parsed_response, nil
+}
+
+// Like CallChatgptMessages, but the answer is streamed to onToken as it arrives.
+// Failures are only retried until the first token was received,
+// after that a retry would repeat what was already shown.
+// A cached answer is passed to onToken at once.
+func CallChatgptStream(ctx context.Context, messages []Message, onToken func(token string)) (GptResponse, error) {
+	key := chatCacheKey(messages)
+	if response, ok := cachedChat(key); ok {
+		onToken(response.Choices[0].Message.Content)
+		return response, nil
+	}
+	if err := checkBudget(); err != nil {
+		return GptResponse{}, err
+	}
+	fmt.Println("Calling ChatGpt API")
 	var parsed_response GptResponse
-	json.Unmarshal(response.Body(), &parsed_response)
-	return parsed_response
+	var streamErr error
+	started := false
+	err := withRetry(func() error {
+		var err error
+		parsed_response, err = provider.ChatStream(ctx, messages, func(token string) {
+			started = true
+			onToken(token)
+		})
+		if err != nil && started {
+			streamErr = err
+			return nil
+		}
+		return err
+	})
+	if streamErr != nil {
+		err = streamErr
+	}
+	if started {
+		// A stream that broke off after the answer started is paid for as well
+		recordUsage(UsageChat, parsed_response.Model, chatUsage(messages, parsed_response))
+	}
+	if err != nil {
+		return parsed_response, fmt.Errorf("failed to call chat api: %w", err)
+	}
+	if len(parsed_response.Choices) == 0 {
+		return parsed_response, fmt.Errorf("%w: chat api returned no answer", ErrParse)
+	}
+	saveChat(key, parsed_response)
+	return parsed_response, nil
+}
+
+// Instructions that tell ChatGPT to answer a question based on a context
+func getSystemContent(context string) string {
+	return "Based on the context provided, your job is to first cite the relevant " +
+		"answer found in context. Explicitly state in which file the answer is found. Then summarize " +
+		"the answer in your own words. Formulate yourself using mark down sytaxt so that your answer can " +
+		"be copy pasted to a md file. The context consists of numbered sources, refer to them by their " +
+		"number in square brackets like [1] and do not cite anything else. Your context is:\n\n" + context
 }
 
 // Helper function that tells ChatGPT to answer a question based on a context
-func CallChatgptWithContext(message string, context string) GptResponse {
-	system_content := "Based on the context provided, your job is to first cite the relevant" +
-		"answer found in context. Explicitly state in which file the answer is found. Then summarize" +
-		"the answer in your own words. Formulate yourself using mark down sytaxt so that your answer can" +
-		"be copy pasted to a md file. Your context is:" + context
-	return CallChatgpt(message, system_content)
-}
-
-// Load embeddings from embeddings.json file in the user's home directory
-func LoadEmbeddings() Embeddings {
-	jsonFile, _ := os.Open(getEmbeddingsPath())
-	defer jsonFile.Close()
-	byteContent, _ := io.ReadAll(jsonFile)
+func CallChatgptWithContext(message string, context string) (GptResponse, error) {
+	return CallChatgpt(message, getSystemContent(context))
+}
+
+// Load embeddings from the json file written by older versions
+func LoadEmbeddings(path string) (Embeddings, error) {
 	var parsedResponse Embeddings
-	json.Unmarshal(byteContent, &parsedResponse)
-	return parsedResponse
+	byteContent, err := os.ReadFile(path)
+	if err != nil {
+		return parsedResponse, fmt.Errorf("failed to read embeddings: %w", err)
+	}
+	if err := json.Unmarshal(byteContent, &parsedResponse); err != nil {
+		return parsedResponse, fmt.Errorf("failed to parse embeddings: %w", err)
+	}
+	return parsedResponse, nil
 }
 
 type EmbeddingDistance struct {
-	Embedding Embedding
-	Distance  float64
+	Collection string
+	Id         int // id of the record in the index
+	Embedding  Embedding
+	Distance   float64 // lower is closer
+	Score      float64 // similarity or distance, depending on the metric of the index
+	Metric     Metric
 }
 
-// L2 norm
-func GetVectorDistance(vector1 []float64, vector2 []float64) float64 {
-	var distance float64
-	for i := 0; i < len(vector1); i++ {
-		distance += (vector1[i] - vector2[i]) * (vector1[i] - vector2[i])
+// Find the n embeddings in the collections closest to the question
+// among the sources that match the filter
+func GetEmbeddingDistances(question string, collections []*Collection, n int, filter Filter) ([]EmbeddingDistance, error) {
+	embeddingResponse, err := CallEmbedding(question)
+	if err != nil {
+		return nil, err
 	}
-	return distance
-}
-
-// Sort list of embeddings by distance to the question
-func GetEmbeddingDistances(question string, embeddings []Embedding) []EmbeddingDistance {
-	var embeddingResponse EmbeddingResponse = CallEmbedding(question)
 	var questionEmbedding []float64 = embeddingResponse.Data[0].Embedding
-	var distances []EmbeddingDistance
-	for _, embedding := range embeddings {
-		distances = append(distances, EmbeddingDistance{embedding, GetVectorDistance(embedding.Vector, questionEmbedding)})
+	for _, collection := range collections {
+		if err := collection.CheckModel(activeEmbedderName(), embeddingResponse.Model); err != nil {
+			return nil, fmt.Errorf("cannot search collection: %w", err)
+		}
 	}
-	sort.Slice(distances, func(i, j int) bool {
-		return distances[i].Distance < distances[j].Distance
-	})
-	return distances
+	distances, err := SearchCollections(collections, questionEmbedding, n, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search index: %w", err)
+	}
+	return distances, nil
 }
 
 // Turn list of embeddings into a context string
+// The chunks are numbered like their citations, so the model can refer to them.
 func GetContext(embeddingDistances []EmbeddingDistance, n int) string {
 	var context string
+	citations := GetCitations(embeddingDistances)
 	N := min(len(embeddingDistances), n)
 	for i := 0; i < N; i++ {
+		span := "lines " + citations[i].Lines()
+		if citations[i].PageStart > 0 {
+			span = "pages " + citations[i].Pages()
+		}
 		context += fmt.Sprintf(
-			"File: %s\nContent from row %v to row %v:\n%v",
-			embeddingDistances[i].Embedding.File,
-			embeddingDistances[i].Embedding.RowStart,
-			embeddingDistances[i].Embedding.RowEnd,
+			"[%v] File: %s\nContent of %v:\n%v\n\n",
+			citations[i].Number,
+			citations[i].File,
+			span,
 			embeddingDistances[i].Embedding.Content,
 		)
 	}
 	return context
 }
 
-func ReadPdf(path string) string {
-	r, err := pdf.Open(path)
-	if err != nil {
-		return ""
+// Read the text of a file or url with the extractor for its type.
+// Files that are neither text nor have an extractor fail with ErrBinaryFile.
+func ReadFile(path string) (Document, error) {
+	if isURL(path) {
+		client := resty.New()
+		response, err := client.R().Get(path)
+		if err != nil {
+			return Document{}, fmt.Errorf("%w: failed to send request: %v", ErrNetwork, err)
+		}
+		if response.IsError() {
+			return Document{}, fmt.Errorf("failed to download %v: %v", path, response.Status())
+		}
+		return Extract(path, response.Body(), response.Header().Get("Content-Type"))
 	}
-	var buf bytes.Buffer
-	b, err := r.GetPlainText()
+	content, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Could not extract text from pdf: %v\n", err)
+		return Document{}, fmt.Errorf("failed to read file: %w", err)
 	}
-	buf.ReadFrom(b)
-	return buf.String()
+	return Extract(path, content, "")
 }
 
-func ReadText(path string) string {
-	file, err := os.Open(path)
+// Convert a file to embeddings by reading the file to string,
+// then splitting the text into chunks with the chunker for the file type
+// and then calling the text embedding API
+// The chunks are sent to the api in batches.
+// Chunks that still fail after retrying are returned separately.
+func ConvertFileToEmbeddings(path string) ([]Embedding, []FailedChunk, error) {
+	document, err := ReadFile(path)
 	if err != nil {
-		log.Fatalf("Failed to read file %v\n", err)
-		return ""
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	var content string
-	for scanner.Scan() {
-		content += scanner.Text() + "\n"
+		return nil, nil, err
 	}
-	return content
+	return ConvertContentToEmbeddings(path, document)
 }
 
-func ReadFile(path string) string {
-	if strings.Contains(path, "https:") {
-		// Read file from url
-		client := resty.New()
-		response, err := client.R().Get(path)
-		if err != nil {
-			log.Fatalf("Failed to send request %v\n", err)
+// A chunk that could not be embedded
+type FailedChunk struct {
+	File     string
+	RowStart int
+	RowEnd   int
+	Err      error
+}
+
+// Same as ConvertFileToEmbeddings for a document that was already read.
+// Chunks only get pages if the extractor of the document reported them.
+func ConvertContentToEmbeddings(path string, document Document) ([]Embedding, []FailedChunk, error) {
+	content := document.Text
+	if strings.Contains(content, "#protected") {
+		return nil, nil, fmt.Errorf("file is protected")
+	}
+	chunker, err := ChunkerFor(path, config.Chunker)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chunks []Chunk
+	for _, chunk := range chunker.Chunk(content) {
+		if strings.TrimSpace(chunk.Content) != "" {
+			chunks = append(chunks, chunk)
 		}
-		return response.String()
 	}
-	split := strings.Split(path, ".")
-	if len(split) > 1 {
-		ftype := split[len(split)-1]
-		if ftype == "pdf" {
-			content := ReadPdf(path)
-			return content
+	pages := linePages(content, document.Pages)
+	var embeddings []Embedding
+	var failed []FailedChunk
+	for _, batch := range batchChunks(chunks) {
+		var inputs []string
+		for _, chunk := range batch {
+			inputs = append(inputs, chunk.Content)
+		}
+		fmt.Printf("Calling Embedding API with %v chunks of %v\n", len(inputs), path)
+		embeddingResponse, err := CallEmbeddings(inputs)
+		if err != nil {
+			for _, chunk := range batch {
+				failed = append(failed, FailedChunk{path, chunk.RowStart, chunk.RowEnd, err})
+			}
+			continue
+		}
+		for i, chunk := range batch {
+			embedding := Embedding{
+				File:     path,
+				Created:  time.Now(),
+				RowStart: chunk.RowStart,
+				RowEnd:   chunk.RowEnd,
+				Vector:   embeddingResponse.Data[i].Embedding,
+				Content:  chunk.Content,
+				Model:    embeddingResponse.Model,
+			}
+			if pages != nil {
+				embedding.PageStart = pages[min(chunk.RowStart, len(pages)-1)]
+				embedding.PageEnd = pages[min(max(chunk.RowEnd-1, chunk.RowStart), len(pages)-1)]
+			}
+			embeddings = append(embeddings, embedding)
 		}
 	}
-	return ReadText(path)
+	return embeddings, failed, nil
 }
 
-// Convert a file to embeddings by reading the file to string,
-// then splitting the text into chunks of 200 lines
-// and then calling the OpenAI text embedding API
-func ConvertFileToEmbeddings(path string) ([]Embedding, error) {
-	content := ReadFile(path)
-	if strings.Contains(content, "#protected") {
-		return nil, fmt.Errorf("file is protected")
-	}
-	var embeddings []Embedding
-	var rowStart int
-	var rowEnd int
-	var lines []string = strings.Split(content, "\n")
-	for i := 0; i < len(lines); i += 200 {
-		if i-50 >= 0 {
-			rowStart = i - 50
-		} else {
-			rowStart = i
+// Group chunks into batches of at most embedBatchSize chunks and embedBatchTokens tokens
+func batchChunks(chunks []Chunk) [][]Chunk {
+	var batches [][]Chunk
+	var batch []Chunk
+	tokens := 0
+	for _, chunk := range chunks {
+		chunkTokens := EstimateTokens(chunk.Content)
+		if len(batch) > 0 && (len(batch) == embedBatchSize || tokens+chunkTokens > embedBatchTokens) {
+			batches = append(batches, batch)
+			batch = nil
+			tokens = 0
 		}
-		if i+250 <= len(lines) {
-			rowEnd = i + 250
-		} else {
-			rowEnd = len(lines)
-		}
-		contentPart := strings.Join(lines[rowStart:rowEnd], "\n")
-		var embeddingResponse EmbeddingResponse = CallEmbedding(contentPart)
-		if len(embeddingResponse.Data) > 0 {
-			embeddings = append(
-				embeddings,
-				Embedding{
-					File:     path,
-					Created:  time.Now(),
-					RowStart: rowStart,
-					RowEnd:   rowEnd,
-					Vector:   embeddingResponse.Data[0].Embedding,
-					Content:  contentPart,
-				},
-			)
-		}
-	}
-	return embeddings, nil
-}
-
-// Save embeddings to embeddings.json file in the user's home directory
-func SaveEmbeddings(embeddings []Embedding) {
-	var embeddingsToSave Embeddings = Embeddings{
-		Created:    time.Now(),
-		Embeddings: embeddings,
-	}
-	embeddingsJson, err := json.Marshal(embeddingsToSave)
-	if err != nil {
-		log.Fatalf("Failed to marshal embeddings to json %v\n", err)
+		batch = append(batch, chunk)
+		tokens += chunkTokens
 	}
-	err = os.WriteFile(getEmbeddingsPath(), embeddingsJson, 0644)
-	if err != nil {
-		log.Fatalf("Failed to write embeddings to file %v\n", err)
+	if len(batch) > 0 {
+		batches = append(batches, batch)
 	}
+	return batches
 }
 
-func WriteAnswerToFile(response GptResponse, embedding Embedding) {
-	// Write answer to file
-	answer := "# Answer from " + modelChat + "\n\n" + response.Choices[0].Message.Content +
-		"\n\n# Matched Context: \nFile: " + embedding.File +
-		"\nRow Start: " + fmt.Sprintf("%v", embedding.RowStart) +
-		"\nRow End: " + fmt.Sprintf("%v", embedding.RowEnd) +
-		"\n\n" + embedding.Content
-	file, err := os.Create(getAnswerPath())
+// Write the answer with the numbered sources it was based on and their content
+func WriteAnswerToFile(response GptResponse, embeddingDistances []EmbeddingDistance) error {
+	content := response.Choices[0].Message.Content
+	citations := GetCitations(embeddingDistances)
+	answer := "# Answer from " + response.Model + "\n\n" + content + "\n\n## Sources\n\n"
+	for _, citation := range citations {
+		answer += citation.Markdown() + "\n\n"
+	}
+	if invented := CheckCitations(content, citations); len(invented) > 0 {
+		answer += "**Warning:** the answer cites " + strings.Join(invented, ", ") + " which are not among the sources.\n\n"
+	}
+	answer += "## Matched Context\n"
+	for i, embeddingDistance := range embeddingDistances {
+		answer += fmt.Sprintf("\n### [%v] %v\n\n%v\n", citations[i].Number, citations[i].Location(), embeddingDistance.Embedding.Content)
+	}
+	answerPath, err := getAnswerPath()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(answerPath)
 	if err != nil {
-		log.Fatalf("Failed to create file %v\n", err)
+		return fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
 	_, err = file.WriteString(answer)
 	if err != nil {
-		log.Fatalf("Failed to write to file %v\n", err)
+		return fmt.Errorf("failed to write to file: %w", err)
 	}
+	return nil
 }
 
-// Helper function that tries to convert file to embeddings
-// and sends the embeddings to the embeddings channel.
+// Helper function that checks if the file changed since it was embedded,
+// converts it to embeddings if it did and sends the result to the results channel.
 // It prints a success or fail message to the console.
-func EmbedFile(path string, embeddingsChannel chan []Embedding) {
-	fmt.Println("\nFound file: ", path)
-	fmt.Println("\nCreating new embedding: ", path)
-	newEmbeddings, err := ConvertFileToEmbeddings(path)
-	if err != nil {
-		fmt.Printf("\nFailed to create embedding: %v\n: %v\n", path, err)
-	} else {
-		fmt.Println("\nSuccessfully created embedding")
-		embeddingsChannel <- newEmbeddings
+func EmbedFile(path string, read func(path string) (Document, error), sources map[string]Source, resultsChannel chan EmbedResult) {
+	previous, known := sources[path]
+	result := CheckSource(path, previous, known, read)
+	switch result.Status {
+	case SourceFailed:
+		fmt.Printf("\nFailed to create embedding: %v\n: %v\n", path, result.Err)
+	case SourceUnchanged:
+		fmt.Println("\nUnchanged since last embedding: ", path)
+	case SourceSkipped:
+		fmt.Println("\nSkipped: ", result.Err)
+	default:
+		fmt.Println("\nSuccessfully created embedding: ", path)
 	}
+	result.Source.Path = path
+	resultsChannel <- result
 }
 
-// Checks if path is a website, file or folder. Then embedds its content.
-// If folder, we recursively embed all files in the folder.
-// Each file is embedded in a separate go routine.
-func EmbedAnything(path string, wg *sync.WaitGroup, embeddingsChannel chan []Embedding) {
-	// website
-	if strings.Contains(path, "https:") {
+// Embed the files with embedWorkers go routines, their content is read with read
+func EmbedFiles(paths []string, read func(path string) (Document, error), sources map[string]Source, resultsChannel chan EmbedResult) {
+	var wg sync.WaitGroup
+	pathsChannel := make(chan string)
+	for i := 0; i < embedWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			EmbedFile(path, embeddingsChannel)
+			for path := range pathsChannel {
+				EmbedFile(path, read, sources, resultsChannel)
+			}
 		}()
-		return
 	}
-	fileInfo, err := os.Stat(path)
+	for _, path := range paths {
+		pathsChannel <- path
+	}
+	close(pathsChannel)
+	wg.Wait()
+	close(resultsChannel)
+}
+
+// Sources found under a path
+type collectedSources struct {
+	paths    []string
+	filtered []string // files and folders the walk options left out
+	read     func(path string) (Document, error)
+	crawl    *CrawlResult // nil unless a website was crawled
+}
+
+// Paths to embed and the function that reads them. Folders are walked with
+// the options. Websites are crawled if crawl_depth is set, every page is its
+// own source and is read from what the crawl fetched.
+func collectSources(path string, options WalkOptions) (collectedSources, error) {
+	if !isURL(path) || config.CrawlDepth == 0 {
+		paths, filtered := collectFiles(path, options)
+		return collectedSources{paths: paths, filtered: filtered, read: ReadFile}, nil
+	}
+	result, err := NewCrawler(config.CrawlDepth, config.CrawlPages, config.CrawlDomains).Crawl(path)
 	if err != nil {
-		fmt.Println("Error:", err)
-	} else if fileInfo.Mode().IsRegular() {
-		// file
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			EmbedFile(path, embeddingsChannel)
-		}()
-	} else if fileInfo.Mode().IsDir() {
-		// folder
-		fmt.Println("Found folder")
-		fmt.Println(path, "is a directory.")
+		return collectedSources{}, err
+	}
+	pages := map[string]string{}
+	var paths []string
+	for _, page := range result.Pages {
+		paths = append(paths, page.URL)
+		pages[page.URL] = page.Content
+	}
+	read := func(path string) (Document, error) {
+		return Document{Text: pages[path]}, nil
+	}
+	fmt.Printf("\nCrawled %v pages, %v failed, %v gone\n", len(result.Pages), len(result.Failed), len(result.Gone))
+	for link, err := range result.Failed {
+		fmt.Printf("%v: %v\n", link, err)
+	}
+	return collectedSources{paths: paths, read: read, crawl: &result}, nil
+}
 
-		folder, err := os.Open(path)
+// Sources of the collection under root that are removed because their files are
+// gone or ignored. Pages a crawl did not reach may still exist, only pages that
+// are gone are removed.
+func (c collectedSources) missing(root string, sources map[string]Source) []string {
+	if c.crawl != nil {
+		var missing []string
+		for _, gone := range c.crawl.Gone {
+			if _, ok := sources[gone]; ok {
+				missing = append(missing, gone)
+			}
+		}
+		return missing
+	}
+	seen := map[string]bool{}
+	for _, path := range c.paths {
+		seen[path] = true
+	}
+	return missingSources(sources, root, seen, c.filtered)
+}
+
+// Starting point for creating embeddings from a path.
+// The embeddings are saved to the collection in the user's home directory.
+// Only files that changed since the last run are embedded again,
+// chunks of files that no longer exist or are now ignored are removed. Files
+// left out by the walk options keep their chunks.
+// A new index compares vectors with the given metric, an empty metric
+// keeps the metric of the existing index.
+// Tags are attached to the sources, without tags the sources keep the tags they had.
+// A dry run reads and chunks the files without calling the api or saving
+// anything, and prints how many chunks and tokens embedding them would send.
+func StartEmbedding(path string, metricName string, collectionName string, tags map[string]string, options WalkOptions, dryRun bool) error {
+	path = sourcePath(path)
+	setUsageCollection(orDefault(collectionName, defaultCollection))
+	collected, err := collectSources(path, options)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		sources, err := existingSources(collectionName)
 		if err != nil {
-			fmt.Printf("Error loading folder: %v\n%v\n", path, err)
+			return err
 		}
-		fileInfos, err := folder.Readdir(-1)
-		folder.Close()
+		estimate := EstimateEmbedding(collected.paths, collected.read, sources)
+		estimate.Removed = append(estimate.Removed, collected.missing(path, sources)...)
+		estimate.Print()
+		return nil
+	}
+	index, err := LoadOrCreateCollection(collectionName)
+	if err != nil {
+		return err
+	}
+	if err := index.SetChunker(config.Chunker); err != nil {
+		return fmt.Errorf("failed to save collection settings: %w", err)
+	}
+	if metricName != "" {
+		metric, err := ParseMetric(metricName)
 		if err != nil {
-			fmt.Printf("Error reading folder: %v\n%v\n", path, err)
+			return fmt.Errorf("%w: %v", ErrUsage, err)
 		}
-		for _, fileInfo := range fileInfos {
-			p := filepath.Join(path, fileInfo.Name())
-			EmbedAnything(p, wg, embeddingsChannel)
+		if err := index.SetMetric(metric); err != nil {
+			return fmt.Errorf("%w: %v", ErrUsage, err)
 		}
 	}
-}
-
-// Starting point for creating embeddings from a path.
-// The embeddings are saved to the user's home directory.
-func StartEmbedding(path string) {
-	var wg sync.WaitGroup
-	var embeddingsChannel chan []Embedding = make(chan []Embedding)
-	EmbedAnything(
-		path,
-		&wg,
-		embeddingsChannel,
-	)
-	var newEmbeddings []Embedding
-	go func() {
-		for r := range embeddingsChannel {
-			newEmbeddings = append(newEmbeddings, r...)
-		}
-	}()
-	wg.Wait()
-	close(embeddingsChannel)
-	// Get previous embeddings
-	fmt.Println("\nLoading previous embeddings: ", getEmbeddingsPath())
-	embeddings := LoadEmbeddings().Embeddings
-	embeddings = append(embeddings, newEmbeddings...)
-	fmt.Println("\nSaving embedddings")
-	SaveEmbeddings(embeddings)
+	sources := map[string]Source{}
+	for _, source := range index.Sources() {
+		sources[source.Path] = source
+	}
+	var resultsChannel chan EmbedResult = make(chan EmbedResult)
+	go EmbedFiles(collected.paths, collected.read, sources, resultsChannel)
+	var failedChunks []FailedChunk
+	summary := map[string]int{}
+	fmt.Println("\nSaving embedddings to collection", index.Name)
+	for result := range resultsChannel {
+		failedChunks = append(failedChunks, result.Failed...)
+		var err error
+		if len(result.Embeddings) > 0 {
+			if err := index.RecordModel(activeEmbedderName(), result.Embeddings[0].Model); err != nil {
+				result.Status = SourceFailed
+				fmt.Printf("\nFailed to save embedding: %v\n: %v\n", result.Source.Path, err)
+			}
+		}
+		previous, known := sources[result.Source.Path]
+		if result.Status == SourceSkipped && known {
+			// Binary files embedded by older versions are removed
+			result.Status = SourceRemoved
+		}
+		summary[result.Status]++
+		result.Source.Tags = previous.Tags
+		if tags != nil {
+			result.Source.Tags = tags
+		}
+		switch result.Status {
+		case SourceAdded, SourceUpdated:
+			err = index.ReplaceSource(result.Source, result.Embeddings)
+		case SourceUnchanged:
+			if !result.Source.ModTime.Equal(previous.ModTime) || FormatTags(result.Source.Tags) != FormatTags(previous.Tags) {
+				err = index.TouchSource(result.Source)
+			}
+		case SourceRemoved:
+			err = index.RemoveSource(result.Source.Path)
+		}
+		if err != nil {
+			// Drain the channel so the workers can finish
+			for range resultsChannel {
+			}
+			return fmt.Errorf("failed to save embeddings: %w", err)
+		}
+	}
+	for _, missing := range collected.missing(path, sources) {
+		if err := index.RemoveSource(missing); err != nil {
+			return fmt.Errorf("failed to remove embeddings: %w", err)
+		}
+		fmt.Printf("\nRemoved %v, it is gone or ignored", missing)
+		summary[SourceRemoved]++
+	}
+	fmt.Printf("\nAdded %v, updated %v, removed %v, unchanged %v files",
+		summary[SourceAdded], summary[SourceUpdated], summary[SourceRemoved], summary[SourceUnchanged])
+	if summary[SourceSkipped] > 0 {
+		fmt.Printf(", %v skipped", summary[SourceSkipped])
+	}
+	if summary[SourceFailed] > 0 {
+		fmt.Printf(", %v failed", summary[SourceFailed])
+	}
+	fmt.Println()
+	if len(failedChunks) > 0 {
+		fmt.Printf("\n%v chunks could not be embedded, their files will be tried again on the next --embed:\n", len(failedChunks))
+		for _, chunk := range failedChunks {
+			fmt.Printf("%v rows %v-%v: %v\n", chunk.File, chunk.RowStart, chunk.RowEnd, chunk.Err)
+		}
+	}
+	return nil
 }
 
 // Starting point for asking ChatGPT a question based
-// on the best matching context from embeddings
+// on the best matching context from the collections
 // saved in the user's home directory.
-func StartChat(question string) {
-	var embeddings []Embedding = LoadEmbeddings().Embeddings
-	var embeddingDistances []EmbeddingDistance = GetEmbeddingDistances(question, embeddings)
-	var context string = GetContext(embeddingDistances, 2)
-	var response GptResponse = CallChatgptWithContext(question, context)
-	fmt.Printf("Answer from %v \n\n%v", modelChat, response.Choices[0].Message.Content)
-	WriteAnswerToFile(response, embeddingDistances[0].Embedding)
+// With stream the answer is printed while it is written, Ctrl-C stops it.
+// With a session name the question continues that conversation.
+// Only chunks of sources matching the filter are used as context.
+// A dry run only prints what asking would cost.
+func StartChat(question string, collectionNames []string, stream bool, sessionName string, filter Filter, dryRun bool) error {
+	collections, err := LoadCollections(collectionNames)
+	if err != nil {
+		return err
+	}
+	var session *Session
+	if sessionName != "" {
+		session, err = LoadSession(sessionName)
+		if err != nil {
+			return err
+		}
+	}
+	return AskQuestion(question, collections, session, stream, filter, dryRun)
 }
 
-// Save the API key to a text file in the user's home directory
-func WriteAPIKey(apiKey string) {
-	usr, err := user.Current()
+// Starting point for the interactive mode. Every line is a question of the session,
+// which is new unless a name is given. Ctrl-C stops the current answer, exit quits.
+func StartRepl(collectionNames []string, stream bool, sessionName string, filter Filter) error {
+	collections, err := LoadCollections(collectionNames)
+	if err != nil {
+		return err
+	}
+	if sessionName == "" {
+		sessionName = time.Now().Format("2006-01-02-150405")
+	}
+	session, err := LoadSession(sessionName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Session %v, type exit to quit. Continue it later with --session %v\n", session.Name, session.Name)
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("\n> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		question := strings.TrimSpace(scanner.Text())
+		if question == "" {
+			continue
+		}
+		if question == "exit" || question == "quit" {
+			return nil
+		}
+		err := AskQuestion(question, collections, session, stream, filter, false)
+		switch {
+		case err == nil, errors.Is(err, ErrCancelled):
+		case errors.Is(err, ErrAuth), errors.Is(err, ErrQuota), errors.Is(err, ErrBudget):
+			// Asking again will not help
+			return err
+		default:
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+	}
+}
+
+// Answer a question with context from the collections and write it to answer.md.
+// The best candidates of the retrieval are selected to fit the context budget.
+// If session is not nil its history is sent along, and the question and answer are added to it.
+// A dry run neither embeds nor sends the question, it prints what asking would
+// cost with a context as large as the context budget.
+func AskQuestion(question string, collections []*Collection, session *Session, stream bool, filter Filter, dryRun bool) error {
+	var names []string
+	for _, collection := range collections {
+		names = append(names, collection.Name)
+	}
+	setUsageCollection(strings.Join(names, ","))
+	if dryRun {
+		// Compacting the session would ask the chat model for a summary
+		PrintChatEstimate(session.ChatMessages(getSystemContent(""), question))
+		return nil
+	}
+	query := session.RetrievalQuery(question)
+	candidates, err := Retrieve(query, collections, max(config.RetrievalK, contextCandidates), config.RetrievalMode, filter)
 	if err != nil {
-		log.Fatalf("Error getting user's home directory: %v", err)
+		return err
+	}
+	if len(candidates) == 0 && !filter.Empty() {
+		return fmt.Errorf("no embeddings match the filter")
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no embeddings found, add some with --embed first")
 	}
-	filePath := filepath.Join(usr.HomeDir, ".api_key.txt")
-	err = os.WriteFile(filePath, []byte(apiKey), 0644)
+	embeddingDistances, err := SelectContext(query, candidates, collections)
 	if err != nil {
-		log.Fatalf("Failed to write api key %v\n", err)
+		return err
+	}
+	var system_content string = getSystemContent(GetContext(embeddingDistances, len(embeddingDistances)))
+	if session != nil {
+		budget := config.ContextTokens - config.MaxTokens - EstimateTokens(system_content) - EstimateTokens(question)
+		if err := session.Compact(budget); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+	messages := session.ChatMessages(system_content, question)
+	var response GptResponse
+	if stream {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		fmt.Printf("Answer:\n\n")
+		response, err = CallChatgptStream(ctx, messages, func(token string) {
+			fmt.Print(token)
+		})
+		if errors.Is(err, context.Canceled) {
+			fmt.Println()
+			return fmt.Errorf("%w: stopped with Ctrl-C", ErrCancelled)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		response, err = CallChatgptMessages(messages)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Answer from %v \n\n%v", response.Model, response.Choices[0].Message.Content)
+	}
+	fmt.Printf("\n\nSources:\n")
+	citations := GetCitations(embeddingDistances)
+	for _, citation := range citations {
+		fmt.Println(citation)
+	}
+	if invented := CheckCitations(response.Choices[0].Message.Content, citations); len(invented) > 0 {
+		fmt.Printf("\nWarning: the answer cites %v which are not among the sources\n", strings.Join(invented, ", "))
 	}
+	if session != nil {
+		session.Add(question, response.Choices[0].Message.Content)
+		if err := session.Save(); err != nil {
+			return err
+		}
+	}
+	return WriteAnswerToFile(response, embeddingDistances)
 }
 
 // Response of OpenAI vision API
@@ -465,85 +868,303 @@ type Usage struct {
 type VisionResponse struct {
 	Id      string   `json:"id"`
 	Object  string   `json:"object"`
-	Created string   `json:"created"`
+	Created int64    `json:"created"` // unix time
 	Model   string   `json:"model"`
 	Usage   Usage    `json:"usage"`
 	Choices []Choice `json:"choices"`
 }
 
 // Encode image to base64
-func encodeImage(image_path string) string {
-	file, err := os.Open(image_path)
+func encodeImage(image_path string) (string, error) {
+	buffer, err := os.ReadFile(image_path)
 	if err != nil {
-		log.Fatalf("Failed to open file %v\n", err)
+		return "", fmt.Errorf("failed to open image: %w", err)
 	}
-	defer file.Close()
-	fs, _ := file.Stat()
-	size := fs.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
 	str := base64.StdEncoding.EncodeToString(buffer)
-	return str
+	return str, nil
 }
 
-// Ask a question about an image by calling the vision API
-func CallVisionApi(question string, image_path string) VisionResponse {
+// Ask a question about an image by calling the vision API.
+// Rate limits and server errors are retried with exponential backoff.
+func CallVisionApi(question string, image_path string) (VisionResponse, error) {
+	if err := checkBudget(); err != nil {
+		return VisionResponse{}, err
+	}
 	fmt.Println("Calling vision API")
-	client := resty.New()
-	response, err := client.R().
-		SetAuthToken(getAPIKey()).
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
-			"model": modelVision,
-			"messages": []map[string]interface{}{
-				{
-					"role": "user",
-					"content": []map[string]interface{}{
-						{"type": "text", "text": question},
-						{"type": "image_url", "image_url": map[string]string{
-							// "url": "data:image/jpeg;base64," + encodeImage(image_path),
-							"url": "data:image/png;base64," + encodeImage(image_path),
-						}},
-					},
-				},
-			},
-			"max_tokens": 1000,
-		}).
-		Post(apiEndpointChat)
+	var parsed_response VisionResponse
+	err := withRetry(func() error {
+		var err error
+		parsed_response, err = provider.Vision(question, image_path)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to send request %v\n", err)
+		return parsed_response, fmt.Errorf("failed to call vision api: %w", err)
 	}
-	var parsed_response VisionResponse
-	json.Unmarshal(response.Body(), &parsed_response)
-	return parsed_response
+	recordUsage(UsageVision, parsed_response.Model, parsed_response.Usage)
+	return parsed_response, nil
 }
 
-func StartVision(image_path string) {
+func StartVision(image_path string) error {
 	var question string = "Read the text in the image. Extract the word being defined and its definition. If possible also a example of how its used."
-	var response VisionResponse = CallVisionApi(question, image_path)
+	response, err := CallVisionApi(question, image_path)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%#v\n", response)
+	return nil
+}
+
+// Flag that can be repeated or given as a comma separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+// Flag that can be repeated, every value is taken as it is. Used where
+// a value may contain commas, like a glob or a tag.
+type repeatedList []string
+
+func (l *repeatedList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// First value or an empty string if the flag was not given
+func (l stringList) First() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
 }
 
 // Parse user input and either:
-// 1. Add an api key to the system with flag --key
+// 1. Add an api key to the system with flag --key, or manage keys with the key subcommand
 // 2. Embedd a file or folder with flag --embed
-// 3. Ask ChatGPT a question
+// 3. Manage the index with the index subcommand
+// 4. Ask ChatGPT a question, optionally as part of a session
+// 5. Chat interactively with flag --interactive
+// 6. Show what the api calls cost with the usage subcommand
+// The --provider flag selects which backend answers the requests.
+// Errors are printed and the exit code tells scripts what went wrong.
 func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(ExitCode(err))
+	}
+}
+
+func run() error {
 	var embedPath string
 	var visionPath string
 	var apiKey string
+	var providerName string
+	var metricName string
+	var collectionNames stringList
+	var stream bool
+	var sessionName string
+	var interactive bool
+	var configPath string
+	var profile string
+	var chunker string
+	var chunkTokens int
+	var chunkTokenOverlap int
+	var chunkSize int
+	var chunkOverlap int
+	var embedderName string
+	var temperature float64
+	var maxTokens int
+	var contextTokens int
+	var retrievalK int
+	var keyName string
+	var mode string
+	var rerank string
+	var crawlDepth int
+	var crawlPages int
+	var crawlDomains stringList
+	var filters repeatedList
+	var since string
+	var until string
+	var tags repeatedList
+	var include stringList
+	var exclude stringList
+	var maxFileSize string
+	var dryRun bool
+	var noCache bool
+	// The locals shadow the default constants, the defaults are shown in the help
+	defaults := defaultConfig()
 	flag.StringVar(&embedPath, "embed", "", "Embedd a file or folder")
 	flag.StringVar(&visionPath, "vision", "", "Extract text from picture")
-	flag.StringVar(&apiKey, "key", "", "Add an api key to the system")
+	flag.StringVar(&apiKey, "key", "", "Save an api key for the provider, - reads it from stdin so it stays out of the shell history")
+	flag.StringVar(&keyName, "key-name", "", "Name of the api key to use or save (default \"default\")")
+	flag.StringVar(&providerName, "provider", "", "Backend to use: openai or local (default from the config, $CHATGPT_PROVIDER or openai)")
+	flag.StringVar(&metricName, "metric", "", "Distance metric of a new index: cosine, dot or l2 (default cosine)")
+	flag.Var(&collectionNames, "collection", "Collection to embed into or ask, can be repeated or comma separated when asking, \"all\" asks every collection (default \"default\")")
+	flag.StringVar(&chunker, "chunker", "auto", "How files are split: auto (by file type), lines, tokens, markdown, paragraph or code")
+	flag.IntVar(&chunkTokens, "chunk-tokens", defaults.ChunkTokens, "Tokens per chunk of the tokens, markdown, paragraph and code chunkers")
+	flag.IntVar(&chunkTokenOverlap, "chunk-token-overlap", defaults.ChunkTokenOverlap, "Tokens shared by neighbouring chunks of the tokens chunker")
+	flag.IntVar(&chunkSize, "chunk-size", defaults.ChunkSize, "Lines per chunk of the lines chunker")
+	flag.IntVar(&chunkOverlap, "chunk-overlap", defaults.ChunkOverlap, "Lines shared by neighbouring chunks of the lines chunker")
+	flag.StringVar(&embedderName, "embedder", "", "What embeds chunks and questions: provider (its embedding api) or hashing (built in, works offline) (default the embedder of the collection, provider for new ones)")
+	flag.BoolVar(&stream, "stream", true, "Print the answer while it is written, use --stream=false to wait for the whole answer")
+	flag.StringVar(&sessionName, "session", "", "Continue the conversation with this name, it is created if it does not exist")
+	flag.BoolVar(&interactive, "interactive", false, "Ask questions one after another in the same session")
+	flag.StringVar(&configPath, "config", "", "Config file (default $CHATGPT_CONFIG or $XDG_CONFIG_HOME/chatgpt/config.yaml)")
+	flag.StringVar(&profile, "profile", "", "Profile of the config file to use (default $CHATGPT_PROFILE or the profile set in the config)")
+	flag.Float64Var(&temperature, "temperature", 0, "Sampling temperature of the chat model between 0 and 2")
+	flag.IntVar(&maxTokens, "max-tokens", defaults.MaxTokens, "Maximum number of tokens of an answer")
+	flag.IntVar(&contextTokens, "context-tokens", defaults.ContextTokens, "Tokens the chat model can read and write in one request")
+	flag.IntVar(&retrievalK, "k", defaults.RetrievalK, "Most chunks given to the model as context, 0 only stops at context_budget")
+	flag.StringVar(&mode, "mode", ModeHybrid, "How chunks are found: vector (meaning), keyword (exact words and names) or hybrid (both)")
+	flag.Var(&filters, "filter", "Only ask sources matching key=value, can be repeated: path=docs/**, type=pdf or a tag like team=infra")
+	flag.StringVar(&since, "since", "", "Only ask sources embedded on or after this date, like 2024-01-01")
+	flag.StringVar(&until, "until", "", "Only ask sources embedded before this date")
+	flag.Var(&tags, "tag", "Tag the embedded sources with key=value for --filter, can be repeated")
+	flag.Var(&include, "include", "Only embed the files of a folder matching this glob, can be repeated")
+	flag.Var(&exclude, "exclude", "Leave out files and folders matching this glob when embedding a folder, can be repeated")
+	flag.StringVar(&maxFileSize, "max-file-size", defaults.MaxFileSize, "Skip files of a folder larger than this, 0 for no limit")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the files, chunks, tokens and estimated cost of --embed or a question without sending them")
+	flag.BoolVar(&noCache, "no-cache", false, "Call the api even for embeddings and answers that are cached, and do not cache the responses")
+	flag.IntVar(&crawlDepth, "crawl-depth", 0, "Follow links of an --embed url this many clicks deep, 0 only embeds the page itself")
+	flag.IntVar(&crawlPages, "crawl-pages", defaults.CrawlPages, "Most pages fetched by a crawl")
+	flag.Var(&crawlDomains, "crawl-domain", "Host the crawl may visit besides the host of the url, can be repeated")
+	flag.StringVar(&rerank, "rerank", RerankNone, "Rerank the found chunks before they are selected: none, llm (asks the chat model) or cross-encoder (rerank api of the provider)")
 	flag.Parse()
 	args := flag.Args()
+	var err error
+	config, err = LoadConfig(configPath, profile)
+	if err != nil {
+		return err
+	}
+	// Flags that were given replace the config
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "provider":
+			config.Provider = providerName
+		case "chunker":
+			config.Chunker = chunker
+		case "chunk-tokens":
+			config.ChunkTokens = chunkTokens
+		case "chunk-token-overlap":
+			config.ChunkTokenOverlap = chunkTokenOverlap
+		case "chunk-size":
+			config.ChunkSize = chunkSize
+		case "chunk-overlap":
+			config.ChunkOverlap = chunkOverlap
+		case "embedder":
+			config.Embedder = embedderName
+		case "temperature":
+			config.Temperature = &temperature
+		case "max-tokens":
+			config.MaxTokens = maxTokens
+		case "context-tokens":
+			config.ContextTokens = contextTokens
+		case "k":
+			config.RetrievalK = retrievalK
+		case "key-name":
+			config.KeyName = keyName
+		case "mode":
+			config.RetrievalMode = mode
+		case "rerank":
+			config.Rerank = rerank
+		case "crawl-depth":
+			config.CrawlDepth = crawlDepth
+		case "crawl-pages":
+			config.CrawlPages = crawlPages
+		case "crawl-domain":
+			config.CrawlDomains = crawlDomains
+		case "max-file-size":
+			config.MaxFileSize = maxFileSize
+		}
+	})
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for key, command := range config.Extractors {
+		RegisterExtractor(CommandExtractor(command), key)
+	}
+	filter, err := ParseFilter(filters, since, until)
+	if err != nil {
+		return err
+	}
+	sourceTags, err := ParseTags(tags)
+	if err != nil {
+		return err
+	}
+	if embedPath == "" && visionPath == "" && apiKey == "" && !interactive && len(args) == 0 {
+		flag.Usage()
+		return fmt.Errorf("%w: ask a question, or use --embed, --vision, --key, index or usage", ErrUsage)
+	}
+	if dryRun && embedPath == "" && (visionPath != "" || apiKey != "" || interactive || args[0] == "index" || args[0] == "key" || args[0] == "usage") {
+		return fmt.Errorf("%w: --dry-run only works with --embed and questions", ErrUsage)
+	}
+	if apiKey == "" && (len(args) == 0 || (args[0] != "index" && args[0] != "key" && args[0] != "usage")) {
+		// Without --embedder collections are embedded and searched by the embedder that built them
+		if config.Embedder == "" {
+			if config.Embedder, err = RecordedEmbedder(collectionNames); err != nil {
+				return err
+			}
+		}
+		if embedder, err = NewEmbedder(config.Embedder); err != nil {
+			return err
+		}
+		// Dry runs and embedding with the hashing embedder send nothing to the provider
+		if dryRun || (embedPath != "" && embedder != nil) {
+			provider, err = NewOfflineProvider(config)
+		} else {
+			provider, err = NewProvider(config)
+		}
+		if err != nil {
+			return err
+		}
+		if err := OpenUsageLedger(); err != nil {
+			return err
+		}
+		defer PrintUsage()
+		if !noCache {
+			if cache, err = openConfiguredCache(); err != nil {
+				return err
+			}
+		}
+	}
 	if embedPath != "" {
-		StartEmbedding(embedPath)
+		if len(collectionNames) > 1 {
+			return fmt.Errorf("%w: can only embed into one collection at a time", ErrUsage)
+		}
+		// Checked by validate
+		size, _ := parseSize(config.MaxFileSize)
+		options := WalkOptions{Include: include, Exclude: exclude, MaxFileSize: size}
+		return StartEmbedding(embedPath, metricName, collectionNames.First(), sourceTags, options, dryRun)
 	} else if visionPath != "" {
-		StartVision(visionPath)
+		return StartVision(visionPath)
 	} else if apiKey != "" {
-		WriteAPIKey(apiKey)
-	} else {
-		StartChat(args[0])
+		if apiKey == "-" {
+			if apiKey, err = readAPIKey(keyID(config.Provider, config.KeyName)); err != nil {
+				return err
+			}
+		}
+		return WriteAPIKey(config.Provider, config.KeyName, apiKey)
+	} else if interactive {
+		return StartRepl(collectionNames, stream, sessionName, filter)
+	} else if args[0] == "index" {
+		return StartIndexCommand(args[1:], collectionNames.First())
+	} else if args[0] == "key" {
+		return StartKeyCommand(args[1:], config.Provider, config.KeyName)
+	} else if args[0] == "usage" {
+		return StartUsageCommand(args[1:])
 	}
+	return StartChat(args[0], collectionNames, stream, sessionName, filter, dryRun)
 }
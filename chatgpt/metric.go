@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A Metric decides how close two vectors are.
+// OpenAI embeddings are normalised and meant to be compared with cosine
+// similarity, other embedding models may expect the dot product or L2.
+type Metric string
+
+const (
+	MetricCosine Metric = "cosine"
+	MetricDot    Metric = "dot"
+	MetricL2     Metric = "l2"
+)
+
+// Metric of new indexes
+const defaultMetric = MetricCosine
+
+func ParseMetric(name string) (Metric, error) {
+	switch metric := Metric(strings.ToLower(name)); metric {
+	case MetricCosine, MetricDot, MetricL2:
+		return metric, nil
+	}
+	return "", fmt.Errorf("unknown metric %q, expected cosine, dot or l2", name)
+}
+
+// Vectors are prepared once before they are stored or searched for.
+// For cosine they are normalised, so the cosine is just the dot product.
+func (m Metric) Prepare(vector []float32) []float32 {
+	if m != MetricCosine {
+		return vector
+	}
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
+
+// Distance between two prepared vectors of the same length, lower is closer
+func (m Metric) Distance(vector1 []float32, vector2 []float32) float32 {
+	switch m {
+	case MetricCosine:
+		return 1 - dotProduct(vector1, vector2)
+	case MetricDot:
+		return -dotProduct(vector1, vector2)
+	}
+	return squaredDistance(vector1, vector2)
+}
+
+// Turn a distance back into the score users know for the metric:
+// cosine similarity, dot product or squared L2 distance
+func (m Metric) Score(distance float64) float64 {
+	switch m {
+	case MetricCosine:
+		return 1 - distance
+	case MetricDot:
+		return -distance
+	}
+	return distance
+}
+
+func dotProduct(vector1 []float32, vector2 []float32) float32 {
+	var product float32
+	for i := range vector1 {
+		product += vector1[i] * vector2[i]
+	}
+	return product
+}
+
+// Squared L2 distance between two vectors of the same length
+func squaredDistance(vector1 []float32, vector2 []float32) float32 {
+	var distance float32
+	for i := range vector1 {
+		d := vector1[i] - vector2[i]
+		distance += d * d
+	}
+	return distance
+}
+
+// Distance between two vectors with the given metric, lower is closer.
+// Vectors of different length cannot be compared.
+func GetVectorDistance(metric Metric, vector1 []float64, vector2 []float64) (float64, error) {
+	if len(vector1) != len(vector2) {
+		return 0, fmt.Errorf("cannot compare vectors with %v and %v dimensions", len(vector1), len(vector2))
+	}
+	return float64(metric.Distance(metric.Prepare(toFloat32(vector1)), metric.Prepare(toFloat32(vector2)))), nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dslipak/pdf"
+)
+
+// Returned for pdfs that cannot be read without a password
+var ErrEncryptedPDF = errors.New("encrypted pdf")
+
+// Text of every page of a pdf with the offsets where the pages start,
+// so chunks can be given the pages they came from.
+func extractPDF(path string, content []byte) (Document, error) {
+	reader, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		if errors.Is(err, pdf.ErrInvalidPassword) || strings.Contains(err.Error(), "encryption") {
+			return Document{}, fmt.Errorf("%w: %v needs a password, decrypt it first, for example with qpdf --decrypt", ErrEncryptedPDF, path)
+		}
+		return Document{}, fmt.Errorf("failed to open pdf %v: %w", path, err)
+	}
+	numPages := reader.NumPage()
+	if numPages < 1 {
+		return Document{}, fmt.Errorf("failed to read pdf %v: it has no pages", path)
+	}
+	pages := make([]string, numPages)
+	var failed []string
+	empty := true
+	for i := range pages {
+		text, err := pdfPageText(reader.Page(i + 1))
+		if err != nil {
+			failed = append(failed, strconv.Itoa(i+1))
+			continue
+		}
+		pages[i] = text
+		empty = empty && strings.TrimSpace(text) == ""
+	}
+	if empty && len(failed) > 0 {
+		return Document{}, fmt.Errorf("could not extract text from pdf %v", path)
+	}
+	if empty {
+		return Document{}, fmt.Errorf("no text in pdf %v, it may only contain scanned images", path)
+	}
+	if len(failed) > 0 {
+		fmt.Printf("\nCould not read pages %v of %v, they are left out\n", strings.Join(failed, ", "), path)
+	}
+	var document Document
+	for _, page := range pages {
+		document.Pages = append(document.Pages, len(document.Text))
+		document.Text += page
+	}
+	return document, nil
+}
+
+// Page of every line of text, counting from 1, from the offsets where the
+// pages start. Text without pages gets nil.
+func linePages(text string, pageStarts []int) []int {
+	if len(pageStarts) == 0 {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	pages := make([]int, len(lines))
+	offset := 0
+	for i, line := range lines {
+		pages[i] = sort.SearchInts(pageStarts, offset+1)
+		offset += len(line) + 1
+	}
+	return pages
+}
+
+// A line of text on a page, with its glyphs from left to right
+type pdfLine struct {
+	y      float64
+	size   float64
+	glyphs []pdf.Text
+}
+
+func (l pdfLine) left() float64 {
+	return l.glyphs[0].X
+}
+
+func (l pdfLine) right() float64 {
+	last := l.glyphs[len(l.glyphs)-1]
+	return last.X + last.W
+}
+
+// Text of the line with a space where glyphs are apart
+func (l pdfLine) text() string {
+	var text strings.Builder
+	for i, glyph := range l.glyphs {
+		if i > 0 {
+			previous := l.glyphs[i-1]
+			gap := glyph.X - (previous.X + previous.W)
+			if gap > previous.FontSize*0.2 && previous.S != " " && glyph.S != " " {
+				text.WriteString(" ")
+			}
+		}
+		text.WriteString(glyph.S)
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// Text of a page in reading order. Glyphs are grouped into lines by their
+// baseline and pages with two columns are read one column after the other.
+// A blank line is left where lines are further apart than usual.
+func pdfPageText(page pdf.Page) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	lines := pdfLines(page.Content().Text)
+	var result strings.Builder
+	write := func(lines []pdfLine) {
+		for i, line := range lines {
+			if i > 0 && lines[i-1].y-line.y > 1.8*max(line.size, 1) {
+				result.WriteString("\n")
+			}
+			result.WriteString(line.text() + "\n")
+		}
+	}
+	gutterStart, gutterEnd, ok := findGutter(lines)
+	if !ok {
+		write(lines)
+		return result.String(), nil
+	}
+	// Lines that cross the gutter, like titles, end the columns above them
+	var left, right []pdfLine
+	for _, line := range lines {
+		var leftGlyphs, rightGlyphs []pdf.Text
+		crosses := false
+		for _, glyph := range line.glyphs {
+			switch {
+			case glyph.X+glyph.W <= gutterStart:
+				leftGlyphs = append(leftGlyphs, glyph)
+			case glyph.X >= gutterEnd:
+				rightGlyphs = append(rightGlyphs, glyph)
+			case glyph.S != " ":
+				crosses = true
+			}
+		}
+		if crosses {
+			write(left)
+			write(right)
+			left, right = nil, nil
+			if result.Len() > 0 {
+				result.WriteString("\n")
+			}
+			write([]pdfLine{line})
+			result.WriteString("\n")
+			continue
+		}
+		if len(leftGlyphs) > 0 {
+			left = append(left, pdfLine{line.y, line.size, leftGlyphs})
+		}
+		if len(rightGlyphs) > 0 {
+			right = append(right, pdfLine{line.y, line.size, rightGlyphs})
+		}
+	}
+	write(left)
+	if len(left) > 0 && len(right) > 0 {
+		result.WriteString("\n")
+	}
+	write(right)
+	return result.String(), nil
+}
+
+// Group the glyphs into lines from the top of the page to the bottom
+func pdfLines(glyphs []pdf.Text) []pdfLine {
+	sort.SliceStable(glyphs, func(i, j int) bool { return glyphs[i].Y > glyphs[j].Y })
+	var lines []pdfLine
+	for _, glyph := range glyphs {
+		if len(lines) > 0 {
+			line := &lines[len(lines)-1]
+			if math.Abs(line.y-glyph.Y) <= max(line.size, glyph.FontSize)*0.3 {
+				line.glyphs = append(line.glyphs, glyph)
+				line.size = max(line.size, glyph.FontSize)
+				continue
+			}
+		}
+		lines = append(lines, pdfLine{glyph.Y, glyph.FontSize, []pdf.Text{glyph}})
+	}
+	var result []pdfLine
+	for _, line := range lines {
+		sort.SliceStable(line.glyphs, func(i, j int) bool { return line.glyphs[i].X < line.glyphs[j].X })
+		if line.text() != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// Find the empty strip between two columns of text. It lies in the middle
+// half of the page, at most a tenth of the lines cross it and most lines on
+// both sides are long, which tells columns of text apart from tables.
+func findGutter(lines []pdfLine) (float64, float64, bool) {
+	const minLines = 6
+	if len(lines) < minLines {
+		return 0, 0, false
+	}
+	left, right := math.Inf(1), math.Inf(-1)
+	glyphs, measured := 0, 0
+	for _, line := range lines {
+		left = min(left, line.left())
+		right = max(right, line.right())
+		for _, glyph := range line.glyphs {
+			glyphs++
+			if glyph.W > 0 {
+				measured++
+			}
+		}
+	}
+	// Without the widths of the font nothing is known about empty space
+	if measured*2 < glyphs {
+		return 0, 0, false
+	}
+	width := int(right - left)
+	if width < 100 {
+		return 0, 0, false
+	}
+	// Number of lines that have a glyph on every point of the page
+	covered := make([]int, width+1)
+	lineAt := make([]int, width+1)
+	for i, line := range lines {
+		for _, glyph := range line.glyphs {
+			if glyph.S == " " {
+				continue
+			}
+			for x := max(int(glyph.X-left), 0); x <= min(int(glyph.X+glyph.W-left), width); x++ {
+				// Neighbouring glyphs share a point, a line counts once
+				if lineAt[x] != i+1 {
+					lineAt[x] = i + 1
+					covered[x]++
+				}
+			}
+		}
+	}
+	// The widest strip of the middle half that few lines cross
+	start, bestStart, bestEnd := -1, 0, 0
+	for x := width / 4; x <= 3*width/4; x++ {
+		if covered[x]*10 <= len(lines) {
+			if start < 0 {
+				start = x
+			}
+			if x-start > bestEnd-bestStart {
+				bestStart, bestEnd = start, x
+			}
+		} else {
+			start = -1
+		}
+	}
+	if bestEnd-bestStart < 6 {
+		return 0, 0, false
+	}
+	gutterStart, gutterEnd := left+float64(bestStart), left+float64(bestEnd)
+	var leftLines, leftLong, rightLines, rightLong int
+	for _, line := range lines {
+		leftEnd, rightStart := math.Inf(-1), math.Inf(1)
+		for _, glyph := range line.glyphs {
+			if glyph.X+glyph.W <= gutterStart {
+				leftEnd = max(leftEnd, glyph.X+glyph.W)
+			} else if glyph.X >= gutterEnd {
+				rightStart = min(rightStart, glyph.X)
+			}
+		}
+		if !math.IsInf(leftEnd, -1) {
+			leftLines++
+			if leftEnd-line.left() >= 0.6*(gutterStart-left) {
+				leftLong++
+			}
+		}
+		if !math.IsInf(rightStart, 1) {
+			rightLines++
+			if line.right()-rightStart >= 0.6*(right-gutterEnd) {
+				rightLong++
+			}
+		}
+	}
+	if leftLines*10 < len(lines)*3 || rightLines*10 < len(lines)*3 || leftLong*2 < leftLines || rightLong*2 < rightLines {
+		return 0, 0, false
+	}
+	return gutterStart, gutterEnd, true
+}
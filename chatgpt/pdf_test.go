@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A pdf with a page per content stream, drawn in a font where every glyph is 5 points wide at size 10
+func buildPDF(pages []string, trailer string) []byte {
+	widths := strings.TrimSpace(strings.Repeat("500 ", 95))
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /FirstChar 32 /LastChar 126 /Widths [" + widths + "] >>",
+	}
+	var kids []string
+	for _, content := range pages {
+		page := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%v 0 R", page))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %v 0 R >>", page+1),
+			fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", len(content), content))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %v >>", strings.Join(kids, " "), len(pages))
+	var file strings.Builder
+	file.WriteString("%PDF-1.4\n")
+	var offsets []int
+	for i, object := range objects {
+		offsets = append(offsets, file.Len())
+		fmt.Fprintf(&file, "%v 0 obj\n%v\nendobj\n", i+1, object)
+	}
+	xref := file.Len()
+	fmt.Fprintf(&file, "xref\n0 %v\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&file, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&file, "trailer\n<< /Size %v /Root 1 0 R %v >>\nstartxref\n%v\n%%%%EOF\n", len(objects)+1, trailer, xref)
+	return []byte(file.String())
+}
+
+// Content stream that draws each text at its x and y
+func drawText(texts ...any) string {
+	var content strings.Builder
+	for i := 0; i < len(texts); i += 3 {
+		fmt.Fprintf(&content, "BT /F1 10 Tf 1 0 0 1 %v %v Tm (%v) Tj ET\n", texts[i], texts[i+1], texts[i+2])
+	}
+	return content.String()
+}
+
+func TestExtractPDFReadsColumnsAndPages(t *testing.T) {
+	title := "A title that runs across both columns of the page, from the left margin to the right"
+	texts := []any{50, 740, title}
+	var left, right []string
+	for i := 1; i <= 12; i++ {
+		left = append(left, fmt.Sprintf("Left %02d of the first story", i))
+		right = append(right, fmt.Sprintf("Right %02d of the second one", i))
+		y := 720 - 12*i
+		texts = append(texts, 50, y, left[i-1], 320, y, right[i-1])
+	}
+	content := buildPDF([]string{drawText(texts...), drawText(50, 700, "Second page")}, "")
+	document, err := extractPDF("manual.pdf", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := title + "\n\n" + strings.Join(left, "\n") + "\n\n" + strings.Join(right, "\n") + "\n"
+	if document.Text != first+"Second page\n" {
+		t.Fatalf("unexpected text %q", document.Text)
+	}
+	if fmt.Sprint(document.Pages) != fmt.Sprint([]int{0, len(first)}) {
+		t.Fatalf("unexpected page offsets %v", document.Pages)
+	}
+	pages := linePages(document.Text, document.Pages)
+	if pages[0] != 1 || pages[len(pages)-3] != 1 || pages[len(pages)-2] != 2 {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+	if linePages("no\fpages\n", nil) != nil {
+		t.Fatal("expected no pages for text without page offsets")
+	}
+}
+
+func TestExtractPDFErrors(t *testing.T) {
+	encrypted := buildPDF([]string{drawText(50, 700, "secret")}, "/Encrypt << /Filter /Custom >>")
+	if _, err := extractPDF("secret.pdf", encrypted); !errors.Is(err, ErrEncryptedPDF) {
+		t.Fatalf("expected ErrEncryptedPDF, got %v", err)
+	}
+	if _, err := extractPDF("broken.pdf", []byte("%PDF-1.4\nnot really")); err == nil {
+		t.Fatal("expected an error for a broken pdf")
+	}
+	if _, err := extractPDF("scan.pdf", buildPDF([]string{""}, "")); err == nil || !strings.Contains(err.Error(), "no text") {
+		t.Fatalf("expected an error for a pdf without text, got %v", err)
+	}
+}
+
+func TestConvertContentToEmbeddingsRecordsPages(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{})
+	previous := config
+	config.Chunker = "lines"
+	config.ChunkSize = 2
+	config.ChunkOverlap = 0
+	t.Cleanup(func() { config = previous })
+	embeddings, _, err := ConvertContentToEmbeddings("manual.pdf", Document{
+		Text:  "one\ntwo\nthree\nfour\nfive\n",
+		Pages: []int{0, 8, 19},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []string
+	for _, embedding := range embeddings {
+		pages = append(pages, fmt.Sprintf("%v-%v", embedding.PageStart, embedding.PageEnd))
+	}
+	if strings.Join(pages, " ") != "1-1 2-2 3-3" {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+	// A form feed in a source file is not a page break
+	embeddings, _, err = ConvertContentToEmbeddings("layout.go", Document{Text: "package main\n\f\nfunc main() {}\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, embedding := range embeddings {
+		if embedding.PageStart != 0 {
+			t.Fatalf("expected no pages for a go file, got %v", embedding.PageStart)
+		}
+	}
+}
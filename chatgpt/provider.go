@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	openAIBaseURL = "https://api.openai.com/v1"
+	// Default address of an OpenAI compatible server such as Ollama.
+	// llama.cpp and vLLM expose the same api, only on another port.
+	localBaseURL = "http://localhost:11434/v1"
+)
+
+// A Provider is the backend that answers chat, embedding and vision requests.
+// StartChat, StartEmbedding and StartVision only talk to the active provider,
+// so they can run against OpenAI, a local server or a fake in tests.
+type Provider interface {
+	Chat(messages []Message) (GptResponse, error)
+	// Like Chat, but every piece of the answer is passed to onToken as soon as it arrives.
+	// Cancelling ctx stops the request and returns ctx.Err().
+	ChatStream(ctx context.Context, messages []Message, onToken func(token string)) (GptResponse, error)
+	Embed(inputs []string) (EmbeddingResponse, error)
+	Vision(question string, image_path string) (VisionResponse, error)
+}
+
+// The provider used by CallChatgpt, CallEmbedding and CallVisionApi.
+// It is set in main from the --provider flag.
+var provider Provider
+
+// Provider for OpenAI and any server implementing the same REST api
+type OpenAIProvider struct {
+	BaseURL     string
+	Key         string // sent as bearer token, left out when empty
+	ChatModel   string
+	EmbedModel  string
+	VisionModel string
+	RerankModel string // model of the /rerank api, if the server has one
+	MaxTokens   int
+	Temperature *float64 // left out when nil
+}
+
+// Body of a chat completion request
+func (p *OpenAIProvider) chatBody(messages []Message) map[string]interface{} {
+	body := map[string]interface{}{
+		"model":      p.ChatModel,
+		"messages":   messages,
+		"max_tokens": p.MaxTokens,
+	}
+	if p.Temperature != nil {
+		body["temperature"] = *p.Temperature
+	}
+	return body
+}
+
+func (p *OpenAIProvider) request() *resty.Request {
+	request := resty.New().R().SetHeader("Content-Type", "application/json")
+	if p.Key != "" {
+		request.SetAuthToken(p.Key)
+	}
+	return request
+}
+
+// Send body to the endpoint and parse the json answer into result.
+// Error statuses are returned as *APIError with the message of the api.
+func (p *OpenAIProvider) post(endpoint string, body interface{}, result interface{}) error {
+	response, err := p.request().SetBody(body).Post(p.BaseURL + endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	if response.IsError() {
+		return newAPIError(response.StatusCode(), response.Header(), response.Body())
+	}
+	if err := json.Unmarshal(response.Body(), result); err != nil {
+		return fmt.Errorf("%w: %v", ErrParse, err)
+	}
+	return nil
+}
+
+// Turn an error response into an *APIError with the message of the api
+func newAPIError(status int, header http.Header, body []byte) *APIError {
+	var errorBody struct {
+		Error struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Code    interface{} `json:"code"` // a string for OpenAI, a number for some local servers
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &errorBody)
+	apiError := &APIError{
+		StatusCode: status,
+		Message:    errorBody.Error.Message,
+		Type:       errorBody.Error.Type,
+		RetryAfter: parseRetryAfter(header.Get("Retry-After")),
+	}
+	if errorBody.Error.Code != nil {
+		apiError.Code = fmt.Sprint(errorBody.Error.Code)
+	}
+	if apiError.Message == "" {
+		apiError.Message = strings.TrimSpace(string(body))
+	}
+	return apiError
+}
+
+func (p *OpenAIProvider) Chat(messages []Message) (GptResponse, error) {
+	var parsedResponse GptResponse
+	err := p.post("/chat/completions", p.chatBody(messages), &parsedResponse)
+	return parsedResponse, err
+}
+
+// One server-sent event of a streamed chat completion
+type chatStreamChunk struct {
+	Id      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta        Message `json:"delta"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"` // only in the last event, if usage was asked for
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Stream the answer with server-sent events
+func (p *OpenAIProvider) ChatStream(ctx context.Context, messages []Message, onToken func(token string)) (GptResponse, error) {
+	var parsedResponse GptResponse
+	request := p.chatBody(messages)
+	request["stream"] = true
+	// Without this streamed answers do not say how many tokens they used
+	request["stream_options"] = map[string]bool{"include_usage": true}
+	response, err := p.request().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetBody(request).
+		Post(p.BaseURL + "/chat/completions")
+	if ctx.Err() != nil {
+		return parsedResponse, ctx.Err()
+	}
+	if err != nil {
+		return parsedResponse, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	body := response.RawBody()
+	defer body.Close()
+	if response.IsError() {
+		content, _ := io.ReadAll(body)
+		return parsedResponse, newAPIError(response.StatusCode(), response.Header(), content)
+	}
+	parsedResponse, err = readChatStream(body, onToken)
+	if ctx.Err() != nil {
+		return parsedResponse, ctx.Err()
+	}
+	return parsedResponse, err
+}
+
+// Read the events of a streamed chat completion until the server sends [DONE].
+// The pieces of the answer are put together into a single choice.
+func readChatStream(body io.Reader, onToken func(token string)) (GptResponse, error) {
+	var parsedResponse GptResponse
+	var answer strings.Builder
+	finished := false
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Blank lines separate events, lines starting with ":" are comments
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			finished = true
+			break
+		}
+		var chunk chatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return parsedResponse, fmt.Errorf("%w: %v", ErrParse, err)
+		}
+		if chunk.Error != nil {
+			return parsedResponse, fmt.Errorf("%w: %v", ErrServer, chunk.Error.Message)
+		}
+		parsedResponse.Id = chunk.Id
+		parsedResponse.Created = chunk.Created
+		parsedResponse.Model = chunk.Model
+		if chunk.Usage != nil {
+			parsedResponse.Usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				answer.WriteString(choice.Delta.Content)
+				onToken(choice.Delta.Content)
+			}
+			if choice.FinishReason != "" {
+				finished = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return parsedResponse, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	if !finished {
+		return parsedResponse, fmt.Errorf("%w: stream ended before the answer was complete", ErrNetwork)
+	}
+	parsedResponse.Object = "chat.completion"
+	parsedResponse.Choices = []Choice{{Message: Message{Role: "assistant", Content: answer.String()}}}
+	return parsedResponse, nil
+}
+
+// Embed all inputs with a single request
+func (p *OpenAIProvider) Embed(inputs []string) (EmbeddingResponse, error) {
+	var parsedResponse EmbeddingResponse
+	err := p.post("/embeddings", map[string]interface{}{
+		"model": p.EmbedModel,
+		"input": inputs,
+	}, &parsedResponse)
+	// The api does not promise to keep the order of the inputs
+	sort.Slice(parsedResponse.Data, func(i, j int) bool {
+		return parsedResponse.Data[i].Index < parsedResponse.Data[j].Index
+	})
+	return parsedResponse, err
+}
+
+func (p *OpenAIProvider) Vision(question string, image_path string) (VisionResponse, error) {
+	var parsedResponse VisionResponse
+	image, err := encodeImage(image_path)
+	if err != nil {
+		return parsedResponse, err
+	}
+	err = p.post("/chat/completions", map[string]interface{}{
+		"model": p.VisionModel,
+		"messages": []map[string]interface{}{
+			{
+				"role": "user",
+				"content": []map[string]interface{}{
+					{"type": "text", "text": question},
+					{"type": "image_url", "image_url": map[string]string{
+						// "url": "data:image/jpeg;base64," + image,
+						"url": "data:image/png;base64," + image,
+					}},
+				},
+			},
+		},
+		"max_tokens": p.MaxTokens,
+	}, &parsedResponse)
+	return parsedResponse, err
+}
+
+// Return value of the environment variable or fallback if it is not set
+func getEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Create the provider named in the config.
+// Empty models and base url use the defaults of the provider.
+func NewProvider(config Config) (Provider, error) {
+	return newProvider(config, true)
+}
+
+// Like NewProvider, but it is also created without an api key, so runs that
+// send nothing, like dry runs, still know the models and their prices
+func NewOfflineProvider(config Config) (Provider, error) {
+	return newProvider(config, false)
+}
+
+func newProvider(config Config, needsKey bool) (Provider, error) {
+	switch strings.ToLower(config.Provider) {
+	case "", "openai":
+		key, err := getAPIKey("openai", config.KeyName)
+		if err != nil && (needsKey || !errors.Is(err, ErrAuth)) {
+			return nil, err
+		}
+		return &OpenAIProvider{
+			BaseURL:     orDefault(config.BaseURL, openAIBaseURL),
+			Key:         key,
+			ChatModel:   orDefault(config.ChatModel, modelChat),
+			EmbedModel:  orDefault(config.EmbedModel, modelEmbed),
+			VisionModel: orDefault(config.VisionModel, modelVision),
+			RerankModel: config.RerankModel,
+			MaxTokens:   config.MaxTokens,
+			Temperature: config.Temperature,
+		}, nil
+	case "local":
+		// Local servers usually do not need a key
+		key, err := getAPIKey("local", config.KeyName)
+		if err != nil && !errors.Is(err, ErrAuth) {
+			return nil, err
+		}
+		return &OpenAIProvider{
+			BaseURL:     orDefault(config.BaseURL, localBaseURL),
+			Key:         key,
+			ChatModel:   orDefault(config.ChatModel, localModelChat),
+			EmbedModel:  orDefault(config.EmbedModel, localModelEmbed),
+			VisionModel: orDefault(config.VisionModel, localModelVision),
+			RerankModel: config.RerankModel,
+			MaxTokens:   config.MaxTokens,
+			Temperature: config.Temperature,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown provider %q, expected openai or local", ErrUsage, config.Provider)
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
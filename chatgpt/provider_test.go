@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Provider that answers without network access.
+// Embeddings are looked up by input, unknown inputs get the zero vector.
+type fakeProvider struct {
+	vectors  map[string][]float64
+	answer   string
+	messages []Message
+	embedded []string // every input of Embed
+}
+
+func (p *fakeProvider) Chat(messages []Message) (GptResponse, error) {
+	p.messages = messages
+	return GptResponse{
+		Model:   "fake",
+		Choices: []Choice{{Message: Message{Role: "assistant", Content: p.answer}}},
+	}, nil
+}
+
+// Sends the answer word by word
+func (p *fakeProvider) ChatStream(ctx context.Context, messages []Message, onToken func(token string)) (GptResponse, error) {
+	response, _ := p.Chat(messages)
+	for _, word := range strings.SplitAfter(p.answer, " ") {
+		if err := ctx.Err(); err != nil {
+			return GptResponse{}, err
+		}
+		onToken(word)
+	}
+	return response, nil
+}
+
+func (p *fakeProvider) Embed(inputs []string) (EmbeddingResponse, error) {
+	p.embedded = append(p.embedded, inputs...)
+	response := EmbeddingResponse{Model: "fake"}
+	for i, input := range inputs {
+		vector, ok := p.vectors[input]
+		if !ok {
+			vector = []float64{0, 0}
+		}
+		response.Data = append(response.Data, EmbeddingData{Index: i, Embedding: vector})
+	}
+	return response, nil
+}
+
+func (p *fakeProvider) Vision(question string, image_path string) (VisionResponse, error) {
+	return VisionResponse{Model: "fake"}, nil
+}
+
+func useFakeProvider(t *testing.T, fake *fakeProvider) {
+	previous := provider
+	provider = fake
+	t.Cleanup(func() { provider = previous })
+}
+
+func TestGetEmbeddingDistancesUsesProvider(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{vectors: map[string][]float64{"question": {1, 0}}})
+	collection, err := OpenCollection("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = collection.Add([]Embedding{
+		{File: "far.txt", Vector: []float64{-1, 0}},
+		{File: "near.txt", Vector: []float64{0.9, 0.1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	distances, err := GetEmbeddingDistances("question", []*Collection{collection}, 2, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(distances) != 2 || distances[0].Embedding.File != "near.txt" {
+		t.Fatalf("expected near.txt first, got %+v", distances)
+	}
+}
+
+func TestCallChatgptWithContextSendsContext(t *testing.T) {
+	fake := &fakeProvider{answer: "the answer"}
+	useFakeProvider(t, fake)
+	response, err := CallChatgptWithContext("question", "some context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Choices[0].Message.Content != "the answer" {
+		t.Fatalf("unexpected answer %q", response.Choices[0].Message.Content)
+	}
+	if len(fake.messages) != 2 || fake.messages[1].Content != "question" {
+		t.Fatalf("unexpected messages %+v", fake.messages)
+	}
+	if !strings.Contains(fake.messages[0].Content, "some context") {
+		t.Fatal("system message does not contain the context")
+	}
+}
+
+func TestNewOfflineProviderWorksWithoutKey(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("CHATGPT_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	config := Config{KeyName: "missing", ChatModel: "gpt-4o-mini"}
+	if _, err := NewProvider(config); !errors.Is(err, ErrAuth) {
+		t.Fatalf("expected auth error without key, got %v", err)
+	}
+	p, err := NewOfflineProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.(*OpenAIProvider).ChatModel != "gpt-4o-mini" {
+		t.Fatalf("expected the model of the config, got %+v", p)
+	}
+}
+
+func TestNewProviderRejectsUnknownName(t *testing.T) {
+	if _, err := NewProvider(Config{Provider: "nope"}); err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
+
+func TestOpenAIProviderStreamsChat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		for _, token := range []string{"Hello", ", ", "world"} {
+			fmt.Fprintf(w, "data: {\"model\": \"test\", \"choices\": [{\"delta\": {\"content\": %q}}]}\n\n", token)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: {\"model\": \"test\", \"choices\": [{\"delta\": {}, \"finish_reason\": \"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"model\": \"test\", \"choices\": [], \"usage\": {\"prompt_tokens\": 12, \"completion_tokens\": 3, \"total_tokens\": 15}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	p := &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+	var tokens []string
+	response, err := p.ChatStream(context.Background(), nil, func(token string) { tokens = append(tokens, token) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 3 || response.Choices[0].Message.Content != "Hello, world" || response.Model != "test" || response.Usage.TotalTokens != 15 {
+		t.Fatalf("unexpected tokens %q and response %+v", tokens, response)
+	}
+}
+
+func TestOpenAIProviderStreamCancels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \"Hello\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		// Never finish, like a long answer
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	p := &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := p.ChatStream(ctx, nil, func(token string) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+	if ExitCode(err) != exitCancelled {
+		t.Fatalf("unexpected exit code %v", ExitCode(err))
+	}
+}
+
+func TestOpenAIProviderStreamCutOff(t *testing.T) {
+	recordSleeps(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \"Hel\"}}]}\n\n")
+	}))
+	defer server.Close()
+	previous := provider
+	provider = &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+	t.Cleanup(func() { provider = previous })
+	tokens := 0
+	_, err := CallChatgptStream(context.Background(), []Message{{Role: "user", Content: "question"}}, func(token string) { tokens++ })
+	// Started streams are not retried, that would print the answer twice
+	if !errors.Is(err, ErrNetwork) || tokens != 1 {
+		t.Fatalf("expected a network error after one token, got %v after %v tokens", err, tokens)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rerankers of --rerank
+const (
+	RerankNone         = "none"
+	RerankLLM          = "llm"
+	RerankCrossEncoder = "cross-encoder"
+)
+
+// Scores of reranked results come from the reranker, not from the index
+const MetricRerank Metric = "rerank"
+
+// Characters of a chunk shown to the chat model when it rates the chunks
+const rerankExcerpt = 1500
+
+// A Reranker scores how well documents answer a query, usually with a
+// cross-encoder model. Providers implement it if their server has a rerank api.
+type Reranker interface {
+	Rerank(query string, documents []string) ([]float64, error)
+}
+
+// Order the candidates by how well they answer the question, best first.
+// Without a reranker the candidates are returned as they are.
+func RerankChunks(question string, candidates []EmbeddingDistance, mode string) ([]EmbeddingDistance, error) {
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+	var documents []string
+	for _, candidate := range candidates {
+		documents = append(documents, candidate.Embedding.Content)
+	}
+	var scores []float64
+	var err error
+	switch mode {
+	case "", RerankNone:
+		return candidates, nil
+	case RerankLLM:
+		scores, err = rerankWithChat(question, documents)
+	case RerankCrossEncoder:
+		reranker, ok := provider.(Reranker)
+		if !ok {
+			return nil, fmt.Errorf("%w: the provider cannot rerank with a cross-encoder, use --rerank llm", ErrUsage)
+		}
+		if err := checkBudget(); err != nil {
+			return nil, err
+		}
+		fmt.Println("Calling Rerank API")
+		err = withRetry(func() error {
+			scores, err = reranker.Rerank(question, documents)
+			return err
+		})
+	default:
+		return nil, fmt.Errorf("%w: unknown reranker %q, expected none, llm or cross-encoder", ErrUsage, mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rerank: %w", err)
+	}
+	if len(scores) != len(candidates) {
+		return nil, fmt.Errorf("%w: got %v rerank scores for %v chunks", ErrParse, len(scores), len(candidates))
+	}
+	reranked := make([]EmbeddingDistance, len(candidates))
+	copy(reranked, candidates)
+	for i := range reranked {
+		reranked[i].Score = scores[i]
+		reranked[i].Distance = -scores[i]
+		reranked[i].Metric = MetricRerank
+	}
+	sort.SliceStable(reranked, func(i, j int) bool { return reranked[i].Score > reranked[j].Score })
+	return reranked, nil
+}
+
+// The start of text, at most size bytes without splitting characters
+func excerpt(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size] + "..."
+}
+
+var scoresPattern = regexp.MustCompile(`\[[^\[\]]*\]`)
+
+// Ask the chat model to rate every chunk from 0 to 10
+func rerankWithChat(question string, documents []string) ([]float64, error) {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Question: %v\n\n", question)
+	for i, document := range documents {
+		fmt.Fprintf(&prompt, "Passage %v:\n%v\n\n", i+1, excerpt(document, rerankExcerpt))
+	}
+	response, err := CallChatgpt(prompt.String(),
+		"Rate how well each passage helps to answer the question, from 0 (not at all) to 10 (answers it). "+
+			fmt.Sprintf("Reply only with a json array of %v numbers, one per passage in the given order.", len(documents)))
+	if err != nil {
+		return nil, err
+	}
+	// Models like to wrap the array in text or a code block
+	array := scoresPattern.FindString(response.Choices[0].Message.Content)
+	var scores []float64
+	if err := json.Unmarshal([]byte(array), &scores); err != nil {
+		return nil, fmt.Errorf("%w: rerank scores %q: %v", ErrParse, response.Choices[0].Message.Content, err)
+	}
+	return scores, nil
+}
+
+// Score the documents with the /rerank api of servers like llama.cpp, vLLM, Jina or Cohere
+func (p *OpenAIProvider) Rerank(query string, documents []string) ([]float64, error) {
+	var parsedResponse struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	err := p.post("/rerank", map[string]interface{}{
+		"model":     p.RerankModel,
+		"query":     query,
+		"documents": documents,
+	}, &parsedResponse)
+	if err != nil {
+		return nil, err
+	}
+	scores := make([]float64, len(documents))
+	for _, result := range parsedResponse.Results {
+		if result.Index < 0 || result.Index >= len(documents) {
+			return nil, fmt.Errorf("%w: rerank result for document %v of %v", ErrParse, result.Index, len(documents))
+		}
+		scores[result.Index] = result.RelevanceScore
+	}
+	if len(parsedResponse.Results) != len(documents) {
+		return nil, fmt.Errorf("%w: got %v rerank results for %v documents", ErrParse, len(parsedResponse.Results), len(documents))
+	}
+	return scores, nil
+}
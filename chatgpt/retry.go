@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	retryAttempts = 6
+	retryBaseWait = time.Second
+	retryMaxWait  = time.Minute
+)
+
+// Replaced in tests so retries do not actually wait
+var sleep = time.Sleep
+
+// Only rate limits, server errors and network errors are worth retrying.
+// A bad key, a used up quota, a bad request, an answer that cannot be parsed
+// or any other error fails the same way the next time, and a cancelled
+// request was stopped on purpose.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	for _, kind := range []error{ErrRateLimit, ErrServer, ErrNetwork} {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the Retry-After header, which is either seconds or a http date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := time.Parse(time.RFC1123, header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Call fn until it succeeds, fails with an error that is not worth retrying
+// or retryAttempts is reached. Waits grow exponentially with some jitter
+// unless the server said how long to wait with Retry-After.
+func withRetry(fn func() error) error {
+	wait := retryBaseWait
+	var err error
+	for attempt := 1; attempt <= retryAttempts; attempt++ {
+		err = fn()
+		if err == nil || !isRetryable(err) || attempt == retryAttempts {
+			return err
+		}
+		delay := wait + time.Duration(rand.Int63n(int64(wait)/2+1))
+		var apiError *APIError
+		if errors.As(err, &apiError) && apiError.RetryAfter > 0 {
+			delay = apiError.RetryAfter
+		}
+		sleep(min(delay, retryMaxWait))
+		wait = min(wait*2, retryMaxWait)
+	}
+	return err
+}
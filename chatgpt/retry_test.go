@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recordSleeps(t *testing.T) *[]time.Duration {
+	var sleeps []time.Duration
+	previous := sleep
+	sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	t.Cleanup(func() { sleep = previous })
+	return &sleeps
+}
+
+func TestWithRetryHonoursRetryAfter(t *testing.T) {
+	sleeps := recordSleeps(t)
+	calls := 0
+	err := withRetry(func() error {
+		calls++
+		if calls < 3 {
+			return &APIError{StatusCode: 429, RetryAfter: 7 * time.Second}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %v after %v", err, calls)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != 7*time.Second {
+		t.Fatalf("expected to wait 7s twice, waited %v", *sleeps)
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	sleeps := recordSleeps(t)
+	calls := 0
+	err := withRetry(func() error {
+		calls++
+		return &APIError{StatusCode: 400, Message: "bad input"}
+	})
+	if calls != 1 || err == nil {
+		t.Fatalf("bad requests must not be retried, got %v calls", calls)
+	}
+	// Errors of unknown kind fail the same way again
+	calls = 0
+	err = withRetry(func() error {
+		calls++
+		return errors.New("unexpected end of json")
+	})
+	if calls != 1 || err == nil {
+		t.Fatalf("unknown errors must not be retried, got %v calls", calls)
+	}
+	calls = 0
+	err = withRetry(func() error {
+		calls++
+		return fmt.Errorf("%w: connection reset", ErrNetwork)
+	})
+	if calls != retryAttempts || err == nil {
+		t.Fatalf("expected %v attempts, got %v", retryAttempts, calls)
+	}
+	for i := 1; i < len(*sleeps); i++ {
+		if (*sleeps)[i] < (*sleeps)[i-1] {
+			t.Fatalf("expected growing waits, got %v", *sleeps)
+		}
+	}
+}
+
+func TestOpenAIProviderBatchesAndRetries(t *testing.T) {
+	recordSleeps(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"message": "slow down"}}`)
+			return
+		}
+		// Answer in reverse order to check the inputs are matched by index
+		fmt.Fprint(w, `{"model": "test", "data": [{"index": 1, "embedding": [0, 1]}, {"index": 0, "embedding": [1, 0]}]}`)
+	}))
+	defer server.Close()
+	previous := provider
+	provider = &OpenAIProvider{BaseURL: server.URL, EmbedModel: "test"}
+	t.Cleanup(func() { provider = previous })
+
+	response, err := CallEmbeddings([]string{"first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || response.Data[0].Embedding[0] != 1 || response.Data[1].Embedding[1] != 1 {
+		t.Fatalf("unexpected response after %v requests: %+v", requests, response.Data)
+	}
+}
+
+func TestCallChatgptRetriesServerErrors(t *testing.T) {
+	recordSleeps(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"model": "test", "choices": [{"message": {"role": "assistant", "content": "answer"}}]}`)
+	}))
+	defer server.Close()
+	previous := provider
+	provider = &OpenAIProvider{BaseURL: server.URL, ChatModel: "test"}
+	t.Cleanup(func() { provider = previous })
+
+	response, err := CallChatgptMessages([]Message{{Role: "user", Content: "question"}})
+	if err != nil || requests != 2 || response.Choices[0].Message.Content != "answer" {
+		t.Fatalf("expected an answer after a retry, got %v after %v requests", err, requests)
+	}
+}
+
+func TestBatchChunksRespectsLimits(t *testing.T) {
+	var chunks []Chunk
+	for i := 0; i < embedBatchSize+10; i++ {
+		chunks = append(chunks, Chunk{Content: "small"})
+	}
+	chunks = append(chunks, Chunk{Content: strings.Repeat("x", embedBatchTokens*4)})
+	batches := batchChunks(chunks)
+	if len(batches) != 3 || len(batches[0]) != embedBatchSize || len(batches[2]) != 1 {
+		t.Fatalf("unexpected batches of sizes %v, %v, %v", len(batches[0]), len(batches[1]), len(batches[2]))
+	}
+}
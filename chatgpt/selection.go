@@ -0,0 +1,230 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// Chunks retrieved before they are reranked and selected for the context
+	contextCandidates = 20
+	// Tokens of retrieved chunks given to the model
+	contextBudget = 1500
+	// Weight of relevance against diversity in maximal marginal relevance
+	mmrLambda = 0.7
+)
+
+// Pick the chunks of the candidates that are given to the model as context.
+// The candidates are reranked if configured, then chosen with maximal marginal
+// relevance until the token budget is reached, or config.RetrievalK if it is set, and finally
+// overlapping and adjacent chunks of the same file are merged into one block.
+func SelectContext(question string, candidates []EmbeddingDistance, collections []*Collection) ([]EmbeddingDistance, error) {
+	candidates, err := RerankChunks(question, candidates, config.Rerank)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadVectors(candidates, collections); err != nil {
+		return nil, err
+	}
+	selected := SelectMMR(candidates, config.MMRLambda, config.ContextBudget, config.RetrievalK)
+	return MergeChunks(selected), nil
+}
+
+// Search results carry no vectors, read them from the index for the diversity
+func loadVectors(candidates []EmbeddingDistance, collections []*Collection) error {
+	byName := map[string]*Collection{}
+	for _, collection := range collections {
+		byName[collection.Name] = collection
+	}
+	for i := range candidates {
+		collection := byName[candidates[i].Collection]
+		if collection == nil || len(candidates[i].Embedding.Vector) > 0 {
+			continue
+		}
+		vector, err := collection.Vector(candidates[i].Id)
+		if err != nil {
+			return err
+		}
+		candidates[i].Embedding.Vector = vector
+	}
+	return nil
+}
+
+// Maximal marginal relevance: repeatedly take the chunk that is most relevant
+// to the question and least similar to the chunks taken so far. A lambda of 1
+// only looks at relevance, lower values prefer chunks that add something new.
+// The best chunk is always taken, the others only while they fit the budget
+// and, if n is above 0, until n chunks are taken.
+func SelectMMR(candidates []EmbeddingDistance, lambda float64, budget int, n int) []EmbeddingDistance {
+	relevance := normaliseDistances(candidates)
+	taken := make([]bool, len(candidates))
+	var selected []EmbeddingDistance
+	var selectedIdx []int
+	used := 0
+	for n <= 0 || len(selected) < n {
+		best, bestValue := -1, math.Inf(-1)
+		for i, candidate := range candidates {
+			tokens := EstimateTokens(candidate.Embedding.Content)
+			if taken[i] || (len(selected) > 0 && used+tokens > budget) {
+				continue
+			}
+			redundancy := 0.0
+			for _, j := range selectedIdx {
+				redundancy = max(redundancy, similarity(candidate, candidates[j]))
+			}
+			value := lambda*relevance[i] - (1-lambda)*redundancy
+			if value > bestValue {
+				best, bestValue = i, value
+			}
+		}
+		if best < 0 {
+			break
+		}
+		taken[best] = true
+		used += EstimateTokens(candidates[best].Embedding.Content)
+		selected = append(selected, candidates[best])
+		selectedIdx = append(selectedIdx, best)
+	}
+	return selected
+}
+
+// Relevance between 0 and 1 from the distances, which are lower for better
+// matches under every metric, rank fusion and reranking
+func normaliseDistances(candidates []EmbeddingDistance) []float64 {
+	relevance := make([]float64, len(candidates))
+	if len(candidates) == 0 {
+		return relevance
+	}
+	lowest, highest := candidates[0].Distance, candidates[0].Distance
+	for _, candidate := range candidates {
+		lowest, highest = min(lowest, candidate.Distance), max(highest, candidate.Distance)
+	}
+	for i, candidate := range candidates {
+		relevance[i] = 1
+		if highest > lowest {
+			relevance[i] = (highest - candidate.Distance) / (highest - lowest)
+		}
+	}
+	return relevance
+}
+
+// How much two chunks say the same, between 0 and 1. Chunks that share lines
+// of a file are as similar as the share of their lines, otherwise the cosine
+// of their vectors is used, or the overlap of their words without vectors.
+func similarity(a EmbeddingDistance, b EmbeddingDistance) float64 {
+	shared := 0.0
+	if a.Collection == b.Collection && a.Embedding.File == b.Embedding.File {
+		overlap := min(a.Embedding.RowEnd, b.Embedding.RowEnd) - max(a.Embedding.RowStart, b.Embedding.RowStart)
+		shorter := min(a.Embedding.RowEnd-a.Embedding.RowStart, b.Embedding.RowEnd-b.Embedding.RowStart)
+		if overlap > 0 && shorter > 0 {
+			shared = float64(overlap) / float64(shorter)
+		}
+	}
+	if len(a.Embedding.Vector) > 0 && len(a.Embedding.Vector) == len(b.Embedding.Vector) {
+		return max(shared, cosine(a.Embedding.Vector, b.Embedding.Vector))
+	}
+	return max(shared, jaccard(Tokenize(a.Embedding.Content), Tokenize(b.Embedding.Content)))
+}
+
+func cosine(vector1 []float64, vector2 []float64) float64 {
+	var dot, norm1, norm2 float64
+	for i := range vector1 {
+		dot += vector1[i] * vector2[i]
+		norm1 += vector1[i] * vector1[i]
+		norm2 += vector2[i] * vector2[i]
+	}
+	if norm1 == 0 || norm2 == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(norm1*norm2)
+}
+
+func jaccard(terms1 []string, terms2 []string) float64 {
+	set := map[string]int{}
+	for _, term := range terms1 {
+		set[term] |= 1
+	}
+	for _, term := range terms2 {
+		set[term] |= 2
+	}
+	both := 0
+	for _, in := range set {
+		if in == 3 {
+			both++
+		}
+	}
+	if len(set) == 0 {
+		return 0
+	}
+	return float64(both) / float64(len(set))
+}
+
+// Merge chunks of the same file whose lines overlap or follow each other into
+// one block, so the model reads a region once. Blocks keep the order, id and
+// score of their best chunk.
+func MergeChunks(chunks []EmbeddingDistance) []EmbeddingDistance {
+	type key struct {
+		collection string
+		file       string
+	}
+	type block struct {
+		chunk EmbeddingDistance
+		rank  int
+	}
+	groups := map[key][]block{}
+	var keys []key
+	for i, chunk := range chunks {
+		k := key{chunk.Collection, chunk.Embedding.File}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], block{chunk, i})
+	}
+	var blocks []block
+	for _, k := range keys {
+		group := groups[k]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].chunk.Embedding.RowStart < group[j].chunk.Embedding.RowStart })
+		current := group[0]
+		for _, next := range group[1:] {
+			if next.chunk.Embedding.RowStart > current.chunk.Embedding.RowEnd {
+				blocks = append(blocks, current)
+				current = next
+				continue
+			}
+			merged := mergeChunk(current.chunk, next.chunk)
+			if next.rank < current.rank {
+				current.rank = next.rank
+				merged.Id, merged.Score, merged.Distance = next.chunk.Id, next.chunk.Score, next.chunk.Distance
+			}
+			current.chunk = merged
+		}
+		blocks = append(blocks, current)
+	}
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].rank < blocks[j].rank })
+	var merged []EmbeddingDistance
+	for _, b := range blocks {
+		merged = append(merged, b.chunk)
+	}
+	return merged
+}
+
+// Join the content of the next chunk to the current one by line range. The
+// lines both cover are taken from the current chunk, a next chunk that lies
+// inside the current one adds nothing.
+func mergeChunk(current EmbeddingDistance, next EmbeddingDistance) EmbeddingDistance {
+	if next.Embedding.RowEnd <= current.Embedding.RowEnd {
+		return current
+	}
+	currentContent := strings.TrimRight(current.Embedding.Content, "\n")
+	nextLines := strings.Split(strings.TrimRight(next.Embedding.Content, "\n"), "\n")
+	if shared := current.Embedding.RowEnd - next.Embedding.RowStart; shared > 0 {
+		nextLines = nextLines[min(shared, len(nextLines)):]
+	}
+	if len(nextLines) > 0 {
+		current.Embedding.Content = currentContent + "\n" + strings.Join(nextLines, "\n")
+	}
+	current.Embedding.RowEnd = next.Embedding.RowEnd
+	current.Embedding.PageEnd = max(current.Embedding.PageEnd, next.Embedding.PageEnd)
+	return current
+}
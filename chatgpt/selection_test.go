@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSelectMMRSkipsNearDuplicates(t *testing.T) {
+	candidates := []EmbeddingDistance{
+		{Id: 0, Distance: 0.1, Embedding: Embedding{File: "a.go", RowStart: 0, RowEnd: 200, Vector: []float64{1, 0}, Content: "first"}},
+		{Id: 1, Distance: 0.12, Embedding: Embedding{File: "a.go", RowStart: 150, RowEnd: 350, Vector: []float64{0.99, 0.1}, Content: "overlap"}},
+		{Id: 2, Distance: 0.3, Embedding: Embedding{File: "b.go", RowStart: 0, RowEnd: 100, Vector: []float64{0, 1}, Content: "other"}},
+	}
+	selected := SelectMMR(candidates, 0.5, 1000, 2)
+	if len(selected) != 2 || selected[0].Id != 0 || selected[1].Id != 2 {
+		t.Fatalf("unexpected selection %+v", selected)
+	}
+
+	// Only the best chunk is taken when the others do not fit the budget
+	selected = SelectMMR(candidates, 0.5, 1, 3)
+	if len(selected) != 1 || selected[0].Id != 0 {
+		t.Fatalf("unexpected selection within budget %+v", selected)
+	}
+
+	// Without a limit on the number of chunks the budget decides
+	if selected = SelectMMR(candidates, 0.5, 1000, 0); len(selected) != 3 {
+		t.Fatalf("expected every chunk within the budget, got %+v", selected)
+	}
+	budget := EstimateTokens("first") + EstimateTokens("other")
+	if selected = SelectMMR(candidates, 0.5, budget, 0); len(selected) != 2 || selected[1].Id != 2 {
+		t.Fatalf("expected the chunks that fit the budget, got %+v", selected)
+	}
+}
+
+func TestMergeChunksJoinsOverlappingLines(t *testing.T) {
+	chunks := []EmbeddingDistance{
+		{Id: 5, Score: 0.5, Embedding: Embedding{File: "a.go", RowStart: 2, RowEnd: 5, Content: "c\nd\ne\n"}},
+		{Id: 7, Score: 0.3, Embedding: Embedding{File: "b.go", RowStart: 0, RowEnd: 1, Content: "x\n"}},
+		{Id: 3, Score: 0.9, Embedding: Embedding{File: "a.go", RowStart: 0, RowEnd: 3, Content: "a\nb\nc\n"}},
+		{Id: 4, Score: 0.2, Embedding: Embedding{File: "a.go", RowStart: 5, RowEnd: 6, Content: "f\n"}},
+	}
+	merged := MergeChunks(chunks)
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 blocks, got %+v", merged)
+	}
+	block := merged[0]
+	if block.Embedding.File != "a.go" || block.Embedding.RowStart != 0 || block.Embedding.RowEnd != 6 || block.Id != 5 {
+		t.Fatalf("unexpected block %+v", block)
+	}
+	if block.Embedding.Content != "a\nb\nc\nd\ne\nf" {
+		t.Fatalf("unexpected content %q", block.Embedding.Content)
+	}
+	if merged[1].Embedding.File != "b.go" {
+		t.Fatalf("unexpected order %+v", merged)
+	}
+}
+
+func TestMergeChunksKeepsLinesOfContainedChunks(t *testing.T) {
+	chunks := []EmbeddingDistance{
+		{Id: 1, Embedding: Embedding{File: "a.md", RowStart: 0, RowEnd: 4, Content: "a\nb\nc\nd\n"}},
+		// Inside the first chunk, but chunked with a heading in front
+		{Id: 2, Embedding: Embedding{File: "a.md", RowStart: 1, RowEnd: 3, Content: "# A\nb\nc\n"}},
+		// Shares a line with the first chunk whose text differs
+		{Id: 3, Embedding: Embedding{File: "a.md", RowStart: 3, RowEnd: 5, Content: "D\ne\n"}},
+	}
+	merged := MergeChunks(chunks)
+	if len(merged) != 1 || merged[0].Embedding.Content != "a\nb\nc\nd\ne" || merged[0].Embedding.RowEnd != 5 {
+		t.Fatalf("unexpected merge %+v", merged)
+	}
+}
+
+func TestRerankChunksWithChatModel(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{answer: "Scores:\n```json\n[2, 9.5]\n```"})
+	candidates := []EmbeddingDistance{
+		{Id: 1, Distance: 0.1, Embedding: Embedding{Content: "unrelated"}},
+		{Id: 2, Distance: 0.2, Embedding: Embedding{Content: "the answer"}},
+	}
+	reranked, err := RerankChunks("question", candidates, RerankLLM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reranked[0].Id != 2 || reranked[0].Score != 9.5 || reranked[0].Metric != MetricRerank {
+		t.Fatalf("unexpected order %+v", reranked)
+	}
+
+	// The fake provider has no rerank api
+	if _, err := RerankChunks("question", candidates, RerankCrossEncoder); err == nil {
+		t.Fatal("expected an error without a cross-encoder")
+	}
+}
+
+func TestExcerptKeepsCharactersWhole(t *testing.T) {
+	text := "abéé"
+	if e := excerpt(text, 3); e != "ab..." || !utf8.ValidString(e) {
+		t.Fatalf("unexpected excerpt %q", e)
+	}
+	if e := excerpt(text, 4); e != "abé..." {
+		t.Fatalf("unexpected excerpt %q", e)
+	}
+	if e := excerpt(text, len(text)); e != text {
+		t.Fatalf("expected the whole text, got %q", e)
+	}
+}
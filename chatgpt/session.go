@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Default number of tokens the chat model can read and write in one request
+	chatContextTokens = 4096
+	// Default number of tokens the answer may use at most
+	chatMaxTokens = 1000
+	// Messages at the end of the history that are only summarised when they do not fit
+	sessionKeepMessages = 4
+	// The latest question and answer, they are never summarised
+	sessionLatestTurn = 2
+	// Tokens set aside for a new summary when there is no previous summary to go by
+	sessionSummaryTokens = 200
+	// Earlier questions of the session that are added to the search for context
+	sessionRetrievalQuestions = 2
+)
+
+const summaryInstructions = "Summarise the conversation so far in a few sentences. " +
+	"Keep names, files, numbers and decisions, they are needed to answer follow up questions."
+
+// A Session is a named conversation saved in the user's home directory.
+// Its history is sent with every question so follow ups can refer to earlier answers.
+// Once the history gets too long for the model, older messages are replaced by a summary.
+type Session struct {
+	Name     string
+	Created  time.Time
+	Updated  time.Time
+	Summary  string // summary of messages that were dropped from the history
+	Messages []Message
+	path     string
+}
+
+// Sessions are saved as json files in the data directory
+func getSessionsPath() (string, error) {
+	return getDataPath("sessions")
+}
+
+// Open the session with the given name, a new session is created if it does not exist
+func LoadSession(name string) (*Session, error) {
+	if !collectionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid session name %q, use letters, digits, dots, dashes and underscores", ErrUsage, name)
+	}
+	sessionsPath, err := getSessionsPath()
+	if err != nil {
+		return nil, err
+	}
+	return OpenSession(name, filepath.Join(sessionsPath, name+".json"))
+}
+
+// Open the session saved at path
+func OpenSession(name string, path string) (*Session, error) {
+	session := &Session{Name: name, Created: time.Now(), path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return session, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	if err := json.Unmarshal(content, session); err != nil {
+		return nil, fmt.Errorf("failed to parse session %v: %w", name, err)
+	}
+	return session, nil
+}
+
+func (s *Session) Save() error {
+	s.Updated = time.Now()
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions folder: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Remember a question and its answer
+func (s *Session) Add(question string, answer string) {
+	s.Messages = append(s.Messages,
+		Message{Role: "user", Content: question},
+		Message{Role: "assistant", Content: answer},
+	)
+}
+
+// Text used to search the collections. Follow ups like "explain the second point"
+// say little on their own, so the last questions of the session are searched too.
+func (s *Session) RetrievalQuery(question string) string {
+	if s == nil {
+		return question
+	}
+	var questions []string
+	for i := len(s.Messages) - 1; i >= 0 && len(questions) < sessionRetrievalQuestions; i-- {
+		if s.Messages[i].Role == "user" {
+			questions = append([]string{s.Messages[i].Content}, questions...)
+		}
+	}
+	return strings.Join(append(questions, question), "\n")
+}
+
+// The messages to send for a question: instructions with the summary, the history and the question
+func (s *Session) ChatMessages(system_content string, question string) []Message {
+	if s == nil {
+		return []Message{
+			{Role: "system", Content: system_content},
+			{Role: "user", Content: question},
+		}
+	}
+	if s.Summary != "" {
+		system_content += "\n\nSummary of the conversation so far:\n" + s.Summary
+	}
+	messages := []Message{{Role: "system", Content: system_content}}
+	messages = append(messages, s.Messages...)
+	return append(messages, Message{Role: "user", Content: question})
+}
+
+func messageTokens(messages []Message) int {
+	tokens := 0
+	for _, message := range messages {
+		// Every message costs a few tokens for its role
+		tokens += EstimateTokens(message.Content) + 4
+	}
+	return tokens
+}
+
+// Make the history fit into budget tokens. The oldest messages are summarised
+// together with the previous summary, the last sessionKeepMessages are kept as they are.
+// If the summary cannot be created the oldest messages are dropped instead.
+// The latest question and answer are always kept, even when they do not fit.
+func (s *Session) Compact(budget int) error {
+	// The context and the question may already take up more than the window
+	budget = max(budget, 0)
+	if messageTokens(s.Messages)+EstimateTokens(s.Summary) <= budget {
+		return nil
+	}
+	// The new summary is sent along with the kept messages, so its tokens are
+	// set aside before deciding which messages to keep
+	historyBudget := max(budget-max(EstimateTokens(s.Summary), sessionSummaryTokens), 0)
+	// Keep as many recent messages as fit into half of the budget
+	keep, tokens := 0, 0
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		messageCost := messageTokens(s.Messages[i : i+1])
+		if keep >= sessionKeepMessages && tokens+messageCost > historyBudget/2 {
+			break
+		}
+		keep++
+		tokens += messageCost
+	}
+	old := s.Messages[:len(s.Messages)-keep]
+	recent := s.Messages[len(s.Messages)-keep:]
+	for len(recent) > sessionLatestTurn && messageTokens(recent) > historyBudget {
+		// Even the newest messages are too long, move question and answer pairs to the summary
+		old = append(old, recent[:sessionLatestTurn]...)
+		recent = recent[sessionLatestTurn:]
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	var conversation strings.Builder
+	if s.Summary != "" {
+		conversation.WriteString("Earlier: " + s.Summary + "\n\n")
+	}
+	for _, message := range old {
+		conversation.WriteString(message.Role + ": " + message.Content + "\n\n")
+	}
+	s.Messages = append([]Message(nil), recent...)
+	fmt.Println("Summarising the start of session", s.Name)
+	response, err := CallChatgpt(conversation.String(), summaryInstructions)
+	if err != nil {
+		return fmt.Errorf("failed to summarise session, dropped %v old messages: %w", len(old), err)
+	}
+	s.Summary = response.Choices[0].Message.Content
+	// The summary came out longer than set aside, drop the oldest kept turns
+	for len(s.Messages) > sessionLatestTurn && messageTokens(s.Messages)+EstimateTokens(s.Summary) > budget {
+		s.Messages = s.Messages[sessionLatestTurn:]
+	}
+	return nil
+}
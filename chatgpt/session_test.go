@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionIsSavedAndLoaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions", "work.json")
+	session, err := OpenSession("work", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Add("what is the deadline?", "Friday")
+	if err := session.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := OpenSession("work", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Messages) != 2 || loaded.Messages[1].Content != "Friday" {
+		t.Fatalf("unexpected messages %+v", loaded.Messages)
+	}
+	messages := loaded.ChatMessages("instructions", "and the one after?")
+	if len(messages) != 4 || messages[0].Role != "system" || messages[3].Content != "and the one after?" {
+		t.Fatalf("unexpected chat messages %+v", messages)
+	}
+}
+
+func TestSessionRetrievalQueryUsesEarlierQuestions(t *testing.T) {
+	var stateless *Session
+	if query := stateless.RetrievalQuery("question"); query != "question" {
+		t.Fatalf("expected only the question without a session, got %q", query)
+	}
+	session := &Session{}
+	session.Add("first", "a")
+	session.Add("second", "b")
+	session.Add("third", "c")
+	query := session.RetrievalQuery("explain the second point")
+	if query != "second\nthird\nexplain the second point" {
+		t.Fatalf("unexpected query %q", query)
+	}
+}
+
+func TestSessionCompactSummarisesOldMessages(t *testing.T) {
+	fake := &fakeProvider{answer: "they talked about deadlines"}
+	useFakeProvider(t, fake)
+	session := &Session{Name: "long"}
+	for i := 0; i < 10; i++ {
+		session.Add(strings.Repeat("question ", 50), strings.Repeat("answer ", 50))
+	}
+	if err := session.Compact(1000); err != nil {
+		t.Fatal(err)
+	}
+	if session.Summary != "they talked about deadlines" {
+		t.Fatalf("expected a summary, got %q", session.Summary)
+	}
+	if len(session.Messages) < sessionKeepMessages || messageTokens(session.Messages) > 1000 {
+		t.Fatalf("unexpected history of %v messages and %v tokens", len(session.Messages), messageTokens(session.Messages))
+	}
+	if !strings.Contains(fake.messages[1].Content, "question") {
+		t.Fatal("old messages were not sent to be summarised")
+	}
+	messages := session.ChatMessages("instructions", "next")
+	if !strings.Contains(messages[0].Content, "they talked about deadlines") {
+		t.Fatal("summary is not part of the instructions")
+	}
+}
+
+func TestSessionCompactKeepsTheLatestTurnWithoutBudget(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{answer: "summary"})
+	session := &Session{Name: "full"}
+	for i := 0; i < 4; i++ {
+		session.Add(fmt.Sprintf("question %v", i), fmt.Sprintf("answer %v", i))
+	}
+	if err := session.Compact(-500); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Messages) != 2 || session.Messages[0].Content != "question 3" || session.Messages[1].Content != "answer 3" {
+		t.Fatalf("expected only the latest turn to be kept, got %+v", session.Messages)
+	}
+	if session.Summary != "summary" {
+		t.Fatalf("expected the older turns to be summarised, got %q", session.Summary)
+	}
+}
+
+func TestSessionCompactCountsTheSummary(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{answer: strings.Repeat("they talked about deadlines ", 100)})
+	session := &Session{Name: "long"}
+	for i := 0; i < 10; i++ {
+		session.Add(strings.Repeat("question ", 50), strings.Repeat("answer ", 50))
+	}
+	if err := session.Compact(1000); err != nil {
+		t.Fatal(err)
+	}
+	if tokens := messageTokens(session.Messages) + EstimateTokens(session.Summary); tokens > 1000 {
+		t.Fatalf("history and summary take %v tokens, more than the budget of 1000", tokens)
+	}
+	if len(session.Messages) < sessionLatestTurn {
+		t.Fatalf("expected the latest turn to be kept, got %+v", session.Messages)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sourcesFileName = "sources.json"
+
+// A Source is a file or website that was embedded into the index.
+// It remembers which records belong to it, so re-embedding a changed file
+// replaces its chunks instead of adding them a second time.
+type Source struct {
+	Path     string
+	Hash     string // sha256 of the content, empty for migrated sources
+	ModTime  time.Time
+	Size     int64
+	Ids      []int
+	Embedded time.Time
+	Tags     map[string]string `json:",omitempty"` // given with --tag, used by filters
+}
+
+// What happened to a source during StartEmbedding
+const (
+	SourceAdded     = "added"
+	SourceUpdated   = "updated"
+	SourceUnchanged = "unchanged"
+	SourceRemoved   = "removed"
+	SourceFailed    = "failed"
+	SourceSkipped   = "skipped" // binary files without an extractor
+)
+
+// Result of embedding a single path
+type EmbedResult struct {
+	Source     Source
+	Status     string
+	Embeddings []Embedding
+	Failed     []FailedChunk
+	Err        error
+}
+
+func hashContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "https:") || strings.HasPrefix(path, "http:")
+}
+
+// Sources are tracked by absolute path so the working directory does not matter
+func sourcePath(path string) string {
+	if isURL(path) {
+		if normalised, err := normaliseURL(path); err == nil {
+			return normalised
+		}
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func (ix *VectorIndex) loadSources() error {
+	ix.sources = map[string]Source{}
+	content, err := os.ReadFile(ix.path(sourcesFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read sources: %w", err)
+	}
+	if err := json.Unmarshal(content, &ix.sources); err != nil {
+		return fmt.Errorf("failed to parse sources: %w", err)
+	}
+	return nil
+}
+
+func (ix *VectorIndex) saveSources() error {
+	content, err := json.Marshal(ix.sources)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sources: %w", err)
+	}
+	tmp := ix.path(sourcesFileName + ".tmp")
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write sources: %w", err)
+	}
+	return os.Rename(tmp, ix.path(sourcesFileName))
+}
+
+// The tracked source of a path, the second result is false if it was never embedded
+func (ix *VectorIndex) Source(path string) (Source, bool) {
+	source, ok := ix.sources[path]
+	return source, ok
+}
+
+// All tracked sources sorted by path
+func (ix *VectorIndex) Sources() []Source {
+	var sources []Source
+	for _, source := range ix.sources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path })
+	return sources
+}
+
+// Delete the old records of the source and store the new embeddings instead
+func (ix *VectorIndex) ReplaceSource(source Source, embeddings []Embedding) error {
+	if previous, ok := ix.sources[source.Path]; ok && len(previous.Ids) > 0 {
+		if err := ix.Delete(previous.Ids); err != nil {
+			return err
+		}
+	}
+	ids, err := ix.Add(embeddings)
+	if err != nil {
+		return err
+	}
+	source.Ids = ids
+	ix.sources[source.Path] = source
+	return ix.saveSources()
+}
+
+// Update what is known about a source without touching its records
+func (ix *VectorIndex) TouchSource(source Source) error {
+	ix.sources[source.Path] = source
+	return ix.saveSources()
+}
+
+// Delete all records of the source
+func (ix *VectorIndex) RemoveSource(path string) error {
+	source, ok := ix.sources[path]
+	if !ok {
+		return fmt.Errorf("%v is not in the index", path)
+	}
+	if err := ix.Delete(source.Ids); err != nil {
+		return err
+	}
+	delete(ix.sources, path)
+	return ix.saveSources()
+}
+
+// Point the sources at the new ids after the index was compacted
+func (ix *VectorIndex) remapSources(newIds map[int]int) {
+	for path, source := range ix.sources {
+		var ids []int
+		for _, id := range source.Ids {
+			if newId, ok := newIds[id]; ok {
+				ids = append(ids, newId)
+			}
+		}
+		source.Ids = ids
+		ix.sources[path] = source
+	}
+}
+
+// Group records that have no source yet by file, for example after migrating
+// the old json file. Their hash is empty so the next --embed replaces them.
+func (ix *VectorIndex) adoptUntrackedRecords() error {
+	tracked := map[int]bool{}
+	for _, source := range ix.sources {
+		for _, id := range source.Ids {
+			tracked[id] = true
+		}
+	}
+	err := ix.Records(func(id int, embedding Embedding) error {
+		if tracked[id] {
+			return nil
+		}
+		path := sourcePath(embedding.File)
+		source := ix.sources[path]
+		source.Path = path
+		source.Embedded = embedding.Created
+		source.Ids = append(source.Ids, id)
+		ix.sources[path] = source
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ix.saveSources()
+}
+
+// Check a local file or website against what was embedded before.
+// Files with the same size and modification time are not read again,
+// the content of everything else is read with read and compared by hash.
+func CheckSource(path string, previous Source, known bool, read func(path string) (Document, error)) EmbedResult {
+	source := Source{Path: path}
+	if !isURL(path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return EmbedResult{Source: previous, Status: SourceFailed, Err: err}
+		}
+		source.ModTime = info.ModTime()
+		source.Size = info.Size()
+		if known && previous.Hash != "" && previous.Size == source.Size && previous.ModTime.Equal(source.ModTime) {
+			return EmbedResult{Source: previous, Status: SourceUnchanged}
+		}
+	}
+	document, err := read(path)
+	if errors.Is(err, ErrBinaryFile) {
+		return EmbedResult{Source: previous, Status: SourceSkipped, Err: err}
+	}
+	if err != nil {
+		return EmbedResult{Source: previous, Status: SourceFailed, Err: err}
+	}
+	source.Hash = hashContent(document.Text)
+	if known && previous.Hash == source.Hash {
+		// Touched but not changed, remember the new modification time
+		source.Ids = previous.Ids
+		source.Embedded = previous.Embedded
+		return EmbedResult{Source: source, Status: SourceUnchanged}
+	}
+	embeddings, failed, err := ConvertContentToEmbeddings(path, document)
+	if err != nil {
+		return EmbedResult{Source: previous, Status: SourceFailed, Err: err}
+	}
+	// Saving only part of a file would mark it as embedded,
+	// so the file is kept as it was and tried again next time
+	if len(failed) > 0 {
+		err := fmt.Errorf("%v of %v chunks failed: %w", len(failed), len(failed)+len(embeddings), failed[0].Err)
+		return EmbedResult{Source: previous, Status: SourceFailed, Failed: failed, Err: err}
+	}
+	source.Embedded = time.Now()
+	status := SourceAdded
+	if known {
+		status = SourceUpdated
+	}
+	return EmbedResult{Source: source, Status: status, Embeddings: embeddings}
+}
+
+// Sources below root that were not seen while walking it again, because their
+// files are gone or ignored. Sources in the files and folders this run filtered
+// out with its options are not missing.
+func missingSources(sources map[string]Source, root string, seen map[string]bool, filtered []string) []string {
+	var missing []string
+	for path := range sources {
+		if seen[path] || !isBelow(path, root) {
+			continue
+		}
+		kept := false
+		for _, left := range filtered {
+			kept = kept || isBelow(path, left)
+		}
+		if !kept {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Whether path is dir or inside it
+func isBelow(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
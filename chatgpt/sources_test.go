@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReembeddingOnlyChangedFiles(t *testing.T) {
+	useFakeProvider(t, &fakeProvider{})
+	dir := t.TempDir()
+	index, err := OpenIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notes.txt")
+	os.WriteFile(path, []byte("first version"), 0644)
+
+	embed := func(expected string) {
+		t.Helper()
+		previous, known := index.Source(path)
+		result := CheckSource(path, previous, known, ReadFile)
+		if result.Status != expected {
+			t.Fatalf("expected %v, got %v (%v)", expected, result.Status, result.Err)
+		}
+		if result.Status == SourceAdded || result.Status == SourceUpdated {
+			if err := index.ReplaceSource(result.Source, result.Embeddings); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	embed(SourceAdded)
+	embed(SourceUnchanged)
+	os.WriteFile(path, []byte("second version"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	embed(SourceUpdated)
+	if index.Len() != 1 {
+		t.Fatalf("expected the old chunk to be replaced, index has %v records", index.Len())
+	}
+	os.Remove(path)
+	missing := missingSources(index.sources, dir, map[string]bool{}, nil)
+	if len(missing) != 1 || missing[0] != path {
+		t.Fatalf("expected %v to be missing, got %v", path, missing)
+	}
+	if err := index.RemoveSource(path); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 0 {
+		t.Fatalf("expected an empty index, got %v records", index.Len())
+	}
+}
+
+func TestCompactKeepsSourcesInSync(t *testing.T) {
+	index, err := OpenIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(4, 4, 6)
+	index.ReplaceSource(Source{Path: "/a"}, embeddings[:2])
+	index.ReplaceSource(Source{Path: "/b"}, embeddings[2:])
+	index.RemoveSource("/a")
+	if err := index.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	source, _ := index.Source("/b")
+	if len(source.Ids) != 2 || source.Ids[0] != 0 || source.Ids[1] != 1 {
+		t.Fatalf("expected ids 0 and 1 after compacting, got %v", source.Ids)
+	}
+}
+
+func TestRemoveFromIndexMatchesGlobsAndFolders(t *testing.T) {
+	index, err := OpenIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddings := randomEmbeddings(3, 4, 7)
+	index.ReplaceSource(Source{Path: "/docs/a.md"}, embeddings[:1])
+	index.ReplaceSource(Source{Path: "/docs/sub/b.pdf"}, embeddings[1:2])
+	index.ReplaceSource(Source{Path: "/src/c.go"}, embeddings[2:])
+	if err := RemoveFromIndex(index, []string{"/docs/*.md"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveFromIndex(index, []string{"/docs"}); err != nil {
+		t.Fatal(err)
+	}
+	sources := index.Sources()
+	if len(sources) != 1 || sources[0].Path != "/src/c.go" || index.Len() != 1 {
+		t.Fatalf("expected only /src/c.go to be left, got %+v", sources)
+	}
+	if err := RemoveFromIndex(index, []string{"/nothing"}); err == nil {
+		t.Fatal("expected error when nothing matches")
+	}
+	if err := RemoveFromIndex(index, nil); !errors.Is(err, ErrUsage) {
+		t.Fatalf("expected a usage error without a pattern, got %v", err)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for age, expected := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		if d, err := parseAge(age); err != nil || d != expected {
+			t.Fatalf("parseAge(%v) = %v, %v", age, d, err)
+		}
+	}
+}
+
+func TestOnlyGoneOrIgnoredSourcesAreMissing(t *testing.T) {
+	root := t.TempDir()
+	sources := map[string]Source{}
+	for _, name := range []string{"readme.md", "main.go", "big.txt", "docs/guide.md", "deleted.md", "debug.log"} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("content of "+name), 0644)
+		sources[path] = Source{Path: path}
+	}
+	os.Remove(filepath.Join(root, "deleted.md"))
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+	os.WriteFile(filepath.Join(root, "big.txt"), make([]byte, 2048), 0644)
+
+	collected, err := collectSources(root, WalkOptions{Include: []string{"*.md"}, Exclude: []string{"docs"}, MaxFileSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := collected.missing(root, sources)
+	expected := []string{filepath.Join(root, "debug.log"), filepath.Join(root, "deleted.md")}
+	if len(missing) != len(expected) || missing[0] != expected[0] || missing[1] != expected[1] {
+		t.Fatalf("expected only %v to be missing, got %v", expected, missing)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Price of a model in dollars per million tokens
+type Price struct {
+	Input  float64 `yaml:"input"`  // tokens sent, like the prompt or the chunks to embed
+	Output float64 `yaml:"output"` // tokens of the answer
+}
+
+// Prices of the OpenAI models the tool uses. Models are looked up by the
+// longest name they start with, so gpt-3.5-turbo-0125 costs as much as
+// gpt-3.5-turbo. The prices section of the config replaces or adds models.
+var modelPrices = map[string]Price{
+	"text-embedding-ada-002": {Input: 0.10},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"gpt-3.5-turbo":          {Input: 0.50, Output: 1.50},
+	"gpt-4":                  {Input: 30, Output: 60},
+	"gpt-4-turbo":            {Input: 10, Output: 30},
+	"gpt-4-vision-preview":   {Input: 10, Output: 30},
+	"gpt-4o":                 {Input: 2.50, Output: 10},
+	"gpt-4o-mini":            {Input: 0.15, Output: 0.60},
+	// The built in embedder runs on this machine
+	"hashing-": {},
+}
+
+// Price of the model, false if it is not known.
+// Models of a local server cost nothing unless the config gives them a price.
+func priceOf(model string) (Price, bool) {
+	if price, ok := longestPrefix(config.Prices, model); ok {
+		return price, true
+	}
+	if strings.ToLower(config.Provider) == "local" {
+		return Price{}, true
+	}
+	return longestPrefix(modelPrices, model)
+}
+
+func longestPrefix(prices map[string]Price, model string) (Price, bool) {
+	best := ""
+	for name := range prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	price, ok := prices[best]
+	return price, ok && model != ""
+}
+
+// Cost in dollars of sending input tokens to the model and getting output tokens back
+func costOf(model string, input int, output int) (float64, bool) {
+	price, ok := priceOf(model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(input)*price.Input + float64(output)*price.Output) / 1e6, true
+}
+
+// Cost for printing, or a hint to configure the price if it is not known
+func formatCost(model string, input int, output int) string {
+	cost, ok := costOf(model, input, output)
+	if !ok {
+		return "price unknown, add it under prices in the config"
+	}
+	return fmt.Sprintf("$%.4f", cost)
+}
+
+const usageFileName = "usage.jsonl"
+
+// Kinds of api calls in the usage ledger
+const (
+	UsageChat      = "chat"
+	UsageEmbedding = "embedding"
+	UsageVision    = "vision"
+)
+
+// A line of the usage ledger, one per api call
+type UsageEntry struct {
+	Time             time.Time
+	Kind             string
+	Model            string
+	Collection       string `json:",omitempty"` // collections the call was made for
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64 // dollars, 0 when the price of the model is not known
+}
+
+// Tokens used by the api calls of this run, by model. Once the ledger is
+// opened every call is also appended to it, and calls are refused when
+// they would go over the monthly budget.
+var usage = struct {
+	sync.Mutex
+	models      map[string]Usage
+	path        string // the ledger, empty until it is opened
+	collection  string // collection the calls are made for
+	month       string // month of monthCost and monthTokens, empty until they are loaded
+	monthCost   float64
+	monthTokens int
+}{models: map[string]Usage{}}
+
+// Append the api calls of this run to the ledger in the data directory
+func OpenUsageLedger() error {
+	path, err := getDataPath(usageFileName)
+	if err != nil {
+		return err
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	usage.path = path
+	usage.month = ""
+	return nil
+}
+
+// Name of the collections the following calls are made for
+func setUsageCollection(collection string) {
+	usage.Lock()
+	defer usage.Unlock()
+	usage.collection = collection
+}
+
+// Add the usage reported by a response to the tokens of this run and to the ledger
+func recordUsage(kind string, model string, used Usage) {
+	if used.TotalTokens == 0 {
+		used.TotalTokens = used.PromtTokens + used.CompletionTokens
+	}
+	if used.TotalTokens == 0 {
+		return
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	total := usage.models[model]
+	total.PromtTokens += used.PromtTokens
+	total.CompletionTokens += used.CompletionTokens
+	total.TotalTokens += used.TotalTokens
+	usage.models[model] = total
+	cost, _ := costOf(model, used.PromtTokens, used.CompletionTokens)
+	entry := UsageEntry{
+		Time:             time.Now(),
+		Kind:             kind,
+		Model:            model,
+		Collection:       usage.collection,
+		PromptTokens:     used.PromtTokens,
+		CompletionTokens: used.CompletionTokens,
+		Cost:             cost,
+	}
+	if usage.month == entry.Time.Format("2006-01") {
+		usage.monthCost += entry.Cost
+		usage.monthTokens += entry.PromptTokens + entry.CompletionTokens
+	}
+	if usage.path == "" {
+		return
+	}
+	if err := appendUsage(usage.path, entry); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: failed to record usage:", err)
+	}
+}
+
+func appendUsage(path string, entry UsageEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Read the entries of the ledger, a missing ledger has none
+func ReadUsage(path string) ([]UsageEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	defer file.Close()
+	var entries []UsageEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry UsageEntry
+		// A line cut off by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	return entries, nil
+}
+
+// Refuse the call if this month already used up monthly_budget or monthly_tokens.
+// The ledger is read once, after that the calls of this run are added as they are recorded.
+func checkBudget() error {
+	if config.MonthlyBudget == 0 && config.MonthlyTokens == 0 {
+		return nil
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	month := time.Now().Format("2006-01")
+	if usage.month != month {
+		usage.month, usage.monthCost, usage.monthTokens = month, 0, 0
+		if usage.path != "" {
+			entries, err := ReadUsage(usage.path)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.Time.Local().Format("2006-01") == month {
+					usage.monthCost += entry.Cost
+					usage.monthTokens += entry.PromptTokens + entry.CompletionTokens
+				}
+			}
+		}
+	}
+	if config.MonthlyBudget > 0 && usage.monthCost >= config.MonthlyBudget {
+		return fmt.Errorf("%w: $%.2f of the monthly budget of $%.2f are used up", ErrBudget, usage.monthCost, config.MonthlyBudget)
+	}
+	if config.MonthlyTokens > 0 && usage.monthTokens >= config.MonthlyTokens {
+		return fmt.Errorf("%w: %v of the %v monthly tokens are used up", ErrBudget, usage.monthTokens, config.MonthlyTokens)
+	}
+	return nil
+}
+
+// Usage of an embedding response, which only has prompt tokens
+func embeddingUsage(response EmbeddingResponse) Usage {
+	return Usage{
+		PromtTokens: response.Usage["prompt_tokens"],
+		TotalTokens: response.Usage["total_tokens"],
+	}
+}
+
+// Usage of a chat response. Servers that do not report it get an estimate,
+// so budgets also hold for them.
+func chatUsage(messages []Message, response GptResponse) Usage {
+	if response.Usage.PromtTokens+response.Usage.CompletionTokens > 0 {
+		return response.Usage
+	}
+	var used Usage
+	for _, message := range messages {
+		used.PromtTokens += EstimateTokens(message.Content)
+	}
+	for _, choice := range response.Choices {
+		used.CompletionTokens += EstimateTokens(choice.Message.Content)
+	}
+	return used
+}
+
+// Print the tokens used by this run and what they cost, nothing if no api was called
+func PrintUsage() {
+	usage.Lock()
+	defer usage.Unlock()
+	var models []string
+	for model := range usage.models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		used := usage.models[model]
+		fmt.Printf("\nUsed %v tokens of %v: %v\n", used.TotalTokens, model,
+			formatCost(model, used.PromtTokens, used.CompletionTokens))
+	}
+}
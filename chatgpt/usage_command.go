@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const usageUsage = `Usage:
+  chatgpt usage [--since 2024-05-01] [--until 2024-06-01]
+
+Tokens and cost of the api calls by day, model and collection,
+from the start of this month unless --since is given.`
+
+// Calls of the ledger that have the same day, model or collection
+type UsageSummary struct {
+	Key              string
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+// Add up the entries by the key of each entry, sorted by key
+func SummarizeUsage(entries []UsageEntry, key func(entry UsageEntry) string) []UsageSummary {
+	byKey := map[string]*UsageSummary{}
+	var summaries []*UsageSummary
+	for _, entry := range entries {
+		k := key(entry)
+		summary, ok := byKey[k]
+		if !ok {
+			summary = &UsageSummary{Key: k}
+			byKey[k] = summary
+			summaries = append(summaries, summary)
+		}
+		summary.Calls++
+		summary.PromptTokens += entry.PromptTokens
+		summary.CompletionTokens += entry.CompletionTokens
+		summary.Cost += entry.Cost
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+	result := make([]UsageSummary, len(summaries))
+	for i, summary := range summaries {
+		result[i] = *summary
+	}
+	return result
+}
+
+// Starting point of chatgpt usage
+func StartUsageCommand(args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	since := flags.String("since", "", "First day to show, like 2024-05-01 (default the start of this month)")
+	until := flags.String("until", "", "Show the calls before this day")
+	flags.Usage = func() { fmt.Println(usageUsage) }
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	from, err := parseDate(*since)
+	if err != nil {
+		return fmt.Errorf("%w: invalid --since: %v", ErrUsage, err)
+	}
+	to, err := parseDate(*until)
+	if err != nil {
+		return fmt.Errorf("%w: invalid --until: %v", ErrUsage, err)
+	}
+	now := time.Now()
+	if from.IsZero() {
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	}
+	path, err := getDataPath(usageFileName)
+	if err != nil {
+		return err
+	}
+	entries, err := ReadUsage(path)
+	if err != nil {
+		return err
+	}
+	var selected []UsageEntry
+	for _, entry := range entries {
+		if entry.Time.Before(from) || (!to.IsZero() && !entry.Time.Before(to)) {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	if len(selected) == 0 {
+		fmt.Println("No api calls since", from.Format("2006-01-02"))
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printUsageTable(writer, "DAY", SummarizeUsage(selected, func(entry UsageEntry) string {
+		return entry.Time.Local().Format("2006-01-02")
+	}))
+	printUsageTable(writer, "MODEL", SummarizeUsage(selected, func(entry UsageEntry) string {
+		return entry.Model
+	}))
+	printUsageTable(writer, "COLLECTION", SummarizeUsage(selected, func(entry UsageEntry) string {
+		return orDefault(entry.Collection, "-")
+	}))
+	total := SummarizeUsage(selected, func(entry UsageEntry) string { return "" })[0]
+	fmt.Fprintf(writer, "Total:\t%v calls\t%v tokens\t$%.4f\n", total.Calls, total.PromptTokens+total.CompletionTokens, total.Cost)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return printBudget(entries, now)
+}
+
+func printUsageTable(writer io.Writer, name string, summaries []UsageSummary) {
+	fmt.Fprintf(writer, "%v\tCALLS\tPROMPT\tCOMPLETION\tCOST\n", name)
+	for _, summary := range summaries {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t$%.4f\n", summary.Key, summary.Calls, summary.PromptTokens, summary.CompletionTokens, summary.Cost)
+	}
+	fmt.Fprintln(writer)
+}
+
+// How much of the monthly budgets this month used, nothing if there are none
+func printBudget(entries []UsageEntry, now time.Time) error {
+	if config.MonthlyBudget == 0 && config.MonthlyTokens == 0 {
+		return nil
+	}
+	var cost float64
+	var tokens int
+	for _, entry := range entries {
+		if entry.Time.Local().Format("2006-01") == now.Format("2006-01") {
+			cost += entry.Cost
+			tokens += entry.PromptTokens + entry.CompletionTokens
+		}
+	}
+	fmt.Println()
+	if config.MonthlyBudget > 0 {
+		fmt.Printf("Budget of %v: $%.2f of $%.2f used\n", now.Format("January"), cost, config.MonthlyBudget)
+	}
+	if config.MonthlyTokens > 0 {
+		fmt.Printf("Tokens of %v: %v of %v used\n", now.Format("January"), tokens, config.MonthlyTokens)
+	}
+	return nil
+}
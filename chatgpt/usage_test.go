@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPriceOf(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+	config = defaultConfig()
+	// Dated models cost as much as the model they start with, the longest name wins
+	if price, ok := priceOf("gpt-4o-mini-2024-07-18"); !ok || price != modelPrices["gpt-4o-mini"] {
+		t.Fatalf("unexpected price %v, %v", price, ok)
+	}
+	if _, ok := priceOf("mistral"); ok {
+		t.Fatal("expected no price for an unknown model")
+	}
+	config.Prices = map[string]Price{"mistral": {Input: 1, Output: 2}}
+	if cost, ok := costOf("mistral", 500000, 250000); !ok || cost != 1 {
+		t.Fatalf("unexpected cost %v, %v", cost, ok)
+	}
+	config.Provider = "local"
+	if cost, ok := costOf("llama3", 1000, 1000); !ok || cost != 0 {
+		t.Fatalf("expected local models to be free, got %v, %v", cost, ok)
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	previous := usage.models
+	usage.models = map[string]Usage{}
+	t.Cleanup(func() { usage.models = previous })
+	recordUsage(UsageEmbedding, "text-embedding-ada-002", embeddingUsage(EmbeddingResponse{Usage: map[string]int{"prompt_tokens": 10, "total_tokens": 10}}))
+	recordUsage(UsageEmbedding, "text-embedding-ada-002", embeddingUsage(EmbeddingResponse{Usage: map[string]int{"prompt_tokens": 5, "total_tokens": 5}}))
+	recordUsage(UsageVision, "gpt-4-vision-preview", Usage{PromtTokens: 100, CompletionTokens: 20})
+	recordUsage(UsageEmbedding, "fake", Usage{})
+	if used := usage.models["text-embedding-ada-002"]; used.PromtTokens != 15 || used.TotalTokens != 15 {
+		t.Fatalf("unexpected usage %+v", used)
+	}
+	if used := usage.models["gpt-4-vision-preview"]; used.TotalTokens != 120 {
+		t.Fatalf("unexpected usage %+v", used)
+	}
+	if _, ok := usage.models["fake"]; ok {
+		t.Fatal("responses without usage should not be recorded")
+	}
+}
+
+func TestUsageLedgerAndBudget(t *testing.T) {
+	previousConfig, previousProvider := config, provider
+	t.Cleanup(func() {
+		config, provider = previousConfig, previousProvider
+		usage.path, usage.month, usage.collection = "", "", ""
+	})
+	config = defaultConfig()
+	config.DataDir = t.TempDir()
+	provider = &fakeProvider{answer: "an answer of a few words"}
+	if err := OpenUsageLedger(); err != nil {
+		t.Fatal(err)
+	}
+	// Last month does not count towards the budget of this one
+	lastMonth := UsageEntry{Time: time.Now().AddDate(0, -1, 0), Kind: UsageChat, Model: "gpt-4", PromptTokens: 1000000, Cost: 30}
+	if err := appendUsage(usage.path, lastMonth); err != nil {
+		t.Fatal(err)
+	}
+	config.MonthlyBudget = 0.01
+	setUsageCollection("docs")
+	// gpt-4 costs $30 per million prompt tokens, so 1000 tokens cost $0.03
+	recordUsage(UsageChat, "gpt-4", Usage{PromtTokens: 1000})
+	if _, err := CallChatgpt("question", "context"); !errors.Is(err, ErrBudget) || ExitCode(err) != exitBudget {
+		t.Fatalf("expected the budget to refuse the call, got %v", err)
+	}
+	config.MonthlyBudget = 1
+	if _, err := CallChatgpt("question", "context"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadUsage(usage.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Collection != "docs" || entries[1].Cost != 0.03 {
+		t.Fatalf("unexpected ledger %+v", entries)
+	}
+	// The fake does not report usage, so it is estimated
+	if entries[2].Model != "fake" || entries[2].PromptTokens == 0 || entries[2].CompletionTokens != EstimateTokens("an answer of a few words") {
+		t.Fatalf("unexpected estimated usage %+v", entries[2])
+	}
+	byModel := SummarizeUsage(entries, func(entry UsageEntry) string { return entry.Model })
+	if len(byModel) != 2 || byModel[1].Key != "gpt-4" || byModel[1].Calls != 2 || byModel[1].PromptTokens != 1001000 {
+		t.Fatalf("unexpected summary %+v", byModel)
+	}
+}
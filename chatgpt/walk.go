@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Largest file embedded from a folder unless max_file_size is set
+const maxFileSize = "10MB"
+
+// Ignore files read in every folder that is embedded, rules of the later file win
+var ignoreFileNames = []string{".gitignore", ".chatgptignore"}
+
+// Folders and files that are never worth embedding. They are the first rules
+// of the folder, so an ignore file can add them back with a rule like !vendor/.
+var defaultIgnores = []string{
+	".git/", ".hg/", ".svn/", "node_modules/", "vendor/", "__pycache__/",
+	".venv/", "venv/", "dist/", "build/", "target/", ".DS_Store",
+	".gitignore", ".chatgptignore",
+}
+
+// Which files below a folder are embedded
+type WalkOptions struct {
+	Include     []string // globs of the files to embed, every file when empty
+	Exclude     []string // globs of files and folders to leave out
+	MaxFileSize int64    // larger files are skipped, 0 embeds files of any size
+}
+
+// A line of an ignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool // the rule started with ! and adds files back
+	dirOnly bool // the rule ended with / and only matches folders
+}
+
+// Rules of one ignore file, they match paths relative to its folder
+type ignoreRules struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// Parse the lines of a .gitignore. Patterns without a slash match a name
+// in any folder below dir, other patterns match the path from dir.
+func parseIgnore(dir string, lines []string) ignoreRules {
+	rules := ignoreRules{dir: dir}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		pattern, err := globPattern(strings.TrimPrefix(line, "/"))
+		if err != nil {
+			continue
+		}
+		rule.pattern = pattern
+		rules.rules = append(rules.rules, rule)
+	}
+	return rules
+}
+
+// Whether the ignore files of the folders above path ignore it.
+// The last matching rule decides, so a later !rule adds a file back.
+func isIgnored(rules []ignoreRules, path string, isDir bool) bool {
+	ignored := false
+	for _, ignore := range rules {
+		relative, err := filepath.Rel(ignore.dir, path)
+		if err != nil || strings.HasPrefix(relative, "..") {
+			continue
+		}
+		relative = filepath.ToSlash(relative)
+		for _, rule := range ignore.rules {
+			if (!rule.dirOnly || isDir) && rule.pattern.MatchString(relative) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// Checks if path is a website, file or folder and returns what should be embedded.
+// Folders are walked recursively, leaving out what their .gitignore and
+// .chatgptignore files ignore, what the options exclude and files that are too large.
+// Links to folders are followed once, so links that point back up do not loop.
+func CollectFiles(path string, options WalkOptions) []string {
+	paths, _ := collectFiles(path, options)
+	return paths
+}
+
+// Like CollectFiles, but also returns the files and folders the options left out.
+// Unlike ignored files they are kept in the index when they were embedded before.
+func collectFiles(path string, options WalkOptions) (paths []string, filtered []string) {
+	// website
+	if isURL(path) {
+		return []string{path}, nil
+	}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return nil, nil
+	}
+	if fileInfo.Mode().IsRegular() {
+		fmt.Println("Found file: ", path)
+		return []string{path}, nil
+	}
+	if !fileInfo.IsDir() {
+		return nil, nil
+	}
+	walker := walker{options: options, visited: map[string]bool{}}
+	rules := append([]ignoreRules{parseIgnore(path, defaultIgnores)}, parentIgnores(path)...)
+	walker.walk(path, rules)
+	return walker.paths, walker.filtered
+}
+
+// Rules of the ignore files in the folders above dir up to the root of its git
+// repository, so a subfolder of a repository leaves out what the repository
+// ignores. Folders outside a repository have no parent rules. The rules only
+// apply to absolute paths, which is how folders are embedded.
+func parentIgnores(dir string) []ignoreRules {
+	if !filepath.IsAbs(dir) || isGitRoot(dir) {
+		return nil
+	}
+	var parents []string
+	parent := filepath.Dir(dir)
+	for !isGitRoot(parent) {
+		if parent == filepath.Dir(parent) {
+			// Reached the root of the file system without finding a repository
+			return nil
+		}
+		parents = append([]string{parent}, parents...)
+		parent = filepath.Dir(parent)
+	}
+	parents = append([]string{parent}, parents...)
+	var rules []ignoreRules
+	for _, parent := range parents {
+		for _, name := range ignoreFileNames {
+			if content, err := os.ReadFile(filepath.Join(parent, name)); err == nil {
+				rules = append(rules, parseIgnore(parent, strings.Split(string(content), "\n")))
+			}
+		}
+	}
+	return rules
+}
+
+// Whether dir is the root of a git repository, .git is a file in worktrees
+func isGitRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+type walker struct {
+	options  WalkOptions
+	visited  map[string]bool // real paths of the folders walked so far
+	paths    []string
+	filtered []string // files and folders left out by the options
+}
+
+func (w *walker) walk(dir string, rules []ignoreRules) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		fmt.Printf("Error reading folder: %v\n%v\n", dir, err)
+		return
+	}
+	if w.visited[real] {
+		fmt.Println("Skipped folder that was already embedded through a link: ", dir)
+		return
+	}
+	w.visited[real] = true
+	fmt.Println("Found folder", dir)
+	for _, name := range ignoreFileNames {
+		if content, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			rules = append(rules, parseIgnore(dir, strings.Split(string(content), "\n")))
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Printf("Error reading folder: %v\n%v\n", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		// Links are followed to what they point to
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		if isIgnored(rules, path, info.IsDir()) {
+			continue
+		}
+		if w.excluded(path) {
+			w.filtered = append(w.filtered, path)
+			continue
+		}
+		if info.IsDir() {
+			w.walk(path, rules)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if !w.included(path) {
+			w.filtered = append(w.filtered, path)
+			continue
+		}
+		if w.options.MaxFileSize > 0 && info.Size() > w.options.MaxFileSize {
+			fmt.Printf("Skipped %v, it is larger than %v\n", path, formatSize(w.options.MaxFileSize))
+			w.filtered = append(w.filtered, path)
+			continue
+		}
+		w.paths = append(w.paths, path)
+	}
+}
+
+func (w *walker) excluded(path string) bool {
+	for _, glob := range w.options.Exclude {
+		if matchPath(glob, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walker) included(path string) bool {
+	for _, glob := range w.options.Include {
+		if matchPath(glob, path) {
+			return true
+		}
+	}
+	return len(w.options.Include) == 0
+}
+
+var (
+	sizePattern = regexp.MustCompile(`^(\d+)\s*([kmg]?)i?b?$`)
+	sizeShifts  = map[string]int{"": 0, "k": 10, "m": 20, "g": 30}
+)
+
+// Parse a size like 10MB, 512kb or 2048 bytes. Units count in steps of 1024.
+func parseSize(size string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes or a size like 10MB", size)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", size, err)
+	}
+	return n << sizeShifts[match[2]], nil
+}
+
+// Size in the largest unit that divides it, like 10MB
+func formatSize(size int64) string {
+	for _, unit := range []string{"GB", "MB", "KB"} {
+		shift := sizeShifts[strings.ToLower(unit[:1])]
+		if size >= 1<<shift && size%(1<<shift) == 0 {
+			return fmt.Sprintf("%v%v", size>>shift, unit)
+		}
+	}
+	return fmt.Sprintf("%v bytes", size)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCollectFilesHonoursIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		".gitignore":           "*.log\n!keep.log\n/secret.txt\n# comment\ncache/\n*.py[co]\n",
+		".chatgptignore":       "!vendor/\ndrafts/**\n",
+		"readme.md":            "hello",
+		"secret.txt":           "hidden",
+		"debug.log":            "noise",
+		"keep.log":             "kept",
+		"main.pyc":             "compiled",
+		".git/config":          "git",
+		"node_modules/x/a.js":  "dependency",
+		"vendor/lib.go":        "vendored",
+		"drafts/idea.md":       "draft",
+		"docs/cache/page.html": "cached",
+		"docs/secret.txt":      "not at the root",
+		"docs/.gitignore":      "*.tmp\n",
+		"docs/notes.tmp":       "temporary",
+		"docs/big.txt":         strings.Repeat("x", 2048),
+		"docs/guide.md":        "guide",
+	} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link back to the root must not be walked again
+	if err := os.Symlink(root, filepath.Join(root, "docs", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	collect := func(options WalkOptions) string {
+		var files []string
+		for _, path := range CollectFiles(root, options) {
+			relative, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(relative))
+		}
+		sort.Strings(files)
+		return strings.Join(files, " ")
+	}
+	expected := "docs/guide.md docs/secret.txt keep.log readme.md vendor/lib.go"
+	if files := collect(WalkOptions{MaxFileSize: 1024}); files != expected {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if files := collect(WalkOptions{Include: []string{"*.md"}, Exclude: []string{"docs/**"}, MaxFileSize: 1024}); files != "readme.md" {
+		t.Fatalf("unexpected files with include and exclude %v", files)
+	}
+	if files := collect(WalkOptions{Include: []string{"docs/*.txt"}}); files != "docs/big.txt docs/secret.txt" {
+		t.Fatalf("unexpected files without a size limit %v", files)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]int64{"10MB": 10 << 20, "512kb": 512 << 10, "2048": 2048, "1 GiB": 1 << 30, "0": 0} {
+		n, err := parseSize(size)
+		if err != nil || n != expected {
+			t.Errorf("parseSize(%q) = %v, %v, expected %v", size, n, err, expected)
+		}
+	}
+	if _, err := parseSize("ten megabytes"); err == nil {
+		t.Fatal("expected an error for an invalid size")
+	}
+	if s := formatSize(10 << 20); s != "10MB" {
+		t.Fatalf("unexpected size %q", s)
+	}
+}
+
+func TestCollectFilesOfSubfolderHonoursRepositoryIgnores(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		".git/HEAD":               "ref: refs/heads/main",
+		".gitignore":              "*.log\n/sub/generated/\n",
+		"sub/guide.md":            "guide",
+		"sub/debug.log":           "noise",
+		"sub/generated/api.md":    "generated",
+		"sub/deeper/.gitignore":   "!keep.log\n",
+		"sub/deeper/keep.log":     "kept",
+		"sub/deeper/other.log":    "noise",
+		"sub/deeper/generated.md": "not at the root",
+	} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var files []string
+	for _, path := range CollectFiles(filepath.Join(root, "sub"), WalkOptions{}) {
+		relative, _ := filepath.Rel(root, path)
+		files = append(files, filepath.ToSlash(relative))
+	}
+	sort.Strings(files)
+	if strings.Join(files, " ") != "sub/deeper/generated.md sub/deeper/keep.log sub/guide.md" {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
@@ -2,13 +2,15 @@ module my-go-journey
 
 go 1.21.6
 
-require rsc.io/quote/v4 v4.0.1
+require (
+	github.com/dslipak/pdf v0.0.2
+	github.com/go-resty/resty/v2 v2.11.0
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
+	rsc.io/quote/v4 v4.0.1
+)
 
 require (
-	github.com/dslipak/pdf v0.0.2 // indirect
-	github.com/go-resty/resty/v2 v2.11.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 	rsc.io/sampler v1.3.0 // indirect
 )